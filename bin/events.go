@@ -0,0 +1,359 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	mysqlLog "github.com/vadimtk/mysql-log-parser/log"
+	"github.com/vadimtk/mysql-log-parser/log/parser"
+	"github.com/xitongsys/parquet-go/parquet"
+	"github.com/xitongsys/parquet-go/writer"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+)
+
+// An EventWriter writes parsed events to a file.
+type EventWriter interface {
+	Write(e *mysqlLog.Event) error
+	Close() error
+}
+
+// eventColumns are the columns of an event in a CSV or Parquet file: the
+// Event fields, then every Meta id and metric seen in the logs, sorted by
+// name, so the columns are the same for the same logs.
+type eventColumns struct {
+	meta          []string
+	timeMetrics   []string
+	numberMetrics []string
+	boolMetrics   []string
+}
+
+var eventFields = []string{"Offset", "Ts", "Timestamp", "Admin", "Query", "User", "Host", "Db"}
+
+// scanEventColumns parses the logs to get the names of all metrics.
+func scanEventColumns(filenames []string, o parser.Options, workers int) (eventColumns, error) {
+	meta := make(map[string]bool)
+	timeMetrics := make(map[string]bool)
+	numberMetrics := make(map[string]bool)
+	boolMetrics := make(map[string]bool)
+	err := parseEvents(filenames, o, workers, func(e *mysqlLog.Event) error {
+		for name := range e.Meta {
+			meta[name] = true
+		}
+		for metric := range e.TimeMetrics {
+			timeMetrics[metric] = true
+		}
+		for metric := range e.NumberMetrics {
+			numberMetrics[metric] = true
+		}
+		for metric := range e.BoolMetrics {
+			boolMetrics[metric] = true
+		}
+		return nil
+	})
+	columns := eventColumns{
+		meta:          sortedKeys(meta),
+		timeMetrics:   sortedKeys(timeMetrics),
+		numberMetrics: sortedKeys(numberMetrics),
+		boolMetrics:   sortedKeys(boolMetrics),
+	}
+	return columns, err
+}
+
+func (c eventColumns) header() []string {
+	header := append([]string{}, eventFields...)
+	header = append(header, c.meta...)
+	header = append(header, c.timeMetrics...)
+	header = append(header, c.numberMetrics...)
+	return append(header, c.boolMetrics...)
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// NDJSON
+/////////////////////////////////////////////////////////////////////////////
+
+type ndjsonWriter struct {
+	enc *json.Encoder
+}
+
+func newNDJSONWriter(w io.Writer) *ndjsonWriter {
+	return &ndjsonWriter{enc: json.NewEncoder(w)}
+}
+
+func (w *ndjsonWriter) Write(e *mysqlLog.Event) error {
+	return w.enc.Encode(e)
+}
+
+func (w *ndjsonWriter) Close() error {
+	return nil
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// CSV
+/////////////////////////////////////////////////////////////////////////////
+
+// A csvWriter writes a header row, then a row per event.  A metric that an
+// event does not have is an empty value.
+type csvWriter struct {
+	w       *csv.Writer
+	columns eventColumns
+	row     []string
+}
+
+func newCSVWriter(w io.Writer, columns eventColumns) (*csvWriter, error) {
+	cw := &csvWriter{
+		w:       csv.NewWriter(w),
+		columns: columns,
+	}
+	if err := cw.w.Write(columns.header()); err != nil {
+		return nil, err
+	}
+	return cw, nil
+}
+
+func (w *csvWriter) Write(e *mysqlLog.Event) error {
+	row := append(w.row[:0],
+		strconv.FormatUint(e.Offset, 10),
+		e.Ts,
+		strconv.FormatInt(e.Timestamp, 10),
+		strconv.FormatBool(e.Admin),
+		e.Query,
+		e.User,
+		e.Host,
+		e.Db,
+	)
+	for _, name := range w.columns.meta {
+		val := ""
+		if v, ok := e.Meta[name]; ok {
+			val = strconv.FormatUint(v, 10)
+		}
+		row = append(row, val)
+	}
+	for _, metric := range w.columns.timeMetrics {
+		val := ""
+		if v, ok := e.TimeMetrics[metric]; ok {
+			val = strconv.FormatFloat(float64(v), 'f', -1, 32)
+		}
+		row = append(row, val)
+	}
+	for _, metric := range w.columns.numberMetrics {
+		val := ""
+		if v, ok := e.NumberMetrics[metric]; ok {
+			val = strconv.FormatUint(v, 10)
+		}
+		row = append(row, val)
+	}
+	for _, metric := range w.columns.boolMetrics {
+		val := ""
+		if v, ok := e.BoolMetrics[metric]; ok {
+			val = strconv.FormatBool(v)
+		}
+		row = append(row, val)
+	}
+	w.row = row
+	return w.w.Write(row)
+}
+
+func (w *csvWriter) Close() error {
+	w.w.Flush()
+	return w.w.Error()
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Parquet
+/////////////////////////////////////////////////////////////////////////////
+
+// A parquetWriter writes the same columns as csvWriter.  Meta ids and
+// metrics are optional (null if an event does not have it); Meta ids are
+// INT64, time metrics are FLOAT, number metrics are INT64, and bool metrics
+// are BOOLEAN.
+type parquetWriter struct {
+	pw      *writer.CSVWriter
+	columns eventColumns
+}
+
+// parquetSchema returns the columns as a writer.NewCSVWriterFromWriter schema.
+func parquetSchema(columns eventColumns) []string {
+	schema := []string{
+		"name=Offset, type=INT64",
+		"name=Ts, type=BYTE_ARRAY, convertedtype=UTF8",
+		"name=Timestamp, type=INT64",
+		"name=Admin, type=BOOLEAN",
+		"name=Query, type=BYTE_ARRAY, convertedtype=UTF8",
+		"name=User, type=BYTE_ARRAY, convertedtype=UTF8",
+		"name=Host, type=BYTE_ARRAY, convertedtype=UTF8",
+		"name=Db, type=BYTE_ARRAY, convertedtype=UTF8",
+	}
+	for _, name := range columns.meta {
+		schema = append(schema, "name="+name+", type=INT64, repetitiontype=OPTIONAL")
+	}
+	for _, metric := range columns.timeMetrics {
+		schema = append(schema, "name="+metric+", type=FLOAT, repetitiontype=OPTIONAL")
+	}
+	for _, metric := range columns.numberMetrics {
+		schema = append(schema, "name="+metric+", type=INT64, repetitiontype=OPTIONAL")
+	}
+	for _, metric := range columns.boolMetrics {
+		schema = append(schema, "name="+metric+", type=BOOLEAN, repetitiontype=OPTIONAL")
+	}
+	return schema
+}
+
+func newParquetWriter(w io.Writer, columns eventColumns) (*parquetWriter, error) {
+	pw, err := writer.NewCSVWriterFromWriter(parquetSchema(columns), w, 4)
+	if err != nil {
+		return nil, err
+	}
+	pw.CompressionType = parquet.CompressionCodec_SNAPPY
+	return &parquetWriter{pw: pw, columns: columns}, nil
+}
+
+func (w *parquetWriter) Write(e *mysqlLog.Event) error {
+	row := []interface{}{int64(e.Offset), e.Ts, e.Timestamp, e.Admin, e.Query, e.User, e.Host, e.Db}
+	for _, name := range w.columns.meta {
+		var val interface{}
+		if v, ok := e.Meta[name]; ok {
+			val = int64(v)
+		}
+		row = append(row, val)
+	}
+	for _, metric := range w.columns.timeMetrics {
+		var val interface{}
+		if v, ok := e.TimeMetrics[metric]; ok {
+			val = v
+		}
+		row = append(row, val)
+	}
+	for _, metric := range w.columns.numberMetrics {
+		var val interface{}
+		if v, ok := e.NumberMetrics[metric]; ok {
+			val = int64(v)
+		}
+		row = append(row, val)
+	}
+	for _, metric := range w.columns.boolMetrics {
+		var val interface{}
+		if v, ok := e.BoolMetrics[metric]; ok {
+			val = v
+		}
+		row = append(row, val)
+	}
+	return w.pw.Write(row)
+}
+
+func (w *parquetWriter) Close() error {
+	return w.pw.WriteStop()
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// events subcommand
+/////////////////////////////////////////////////////////////////////////////
+
+// runEvents writes the events of the logs to a file without aggregating them.
+func runEvents(args []string) error {
+	fs := flag.NewFlagSet("events", flag.ExitOnError)
+	format := fs.String("format", "ndjson", "output format: ndjson, csv or parquet")
+	outFile := fs.String("out", "-", "output file, - for stdout")
+	workers := fs.Int("workers", 1, "parse an uncompressed log file in this many chunks at once")
+	filterExpr := fs.String("filter", "", "write only the events that match, e.g. 'Query_time > 1 and Db = \"orders\"'")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s events [flags] [FILE...]\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Write the events in MySQL slow logs as NDJSON, CSV or Parquet.  The CSV and\n")
+		fmt.Fprintf(os.Stderr, "Parquet columns are the event fields and all metrics in the logs, so the\n")
+		fmt.Fprintf(os.Stderr, "logs are parsed twice.\n\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	filenames := fs.Args()
+	if len(filenames) == 0 {
+		filenames = []string{"-"}
+	}
+	var filter *mysqlLog.Filter
+	if *filterExpr != "" {
+		var err error
+		if filter, err = mysqlLog.NewFilter(*filterExpr); err != nil {
+			return err
+		}
+	}
+
+	var out io.Writer = os.Stdout
+	if *outFile != "-" {
+		file, err := os.Create(*outFile)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		out = file
+	}
+
+	return writeEvents(out, *format, filenames, parser.Options{}, *workers, filter)
+}
+
+// writeEvents writes the events of the logs that match the filter, if any, to
+// out in the format: ndjson, csv or parquet.
+func writeEvents(out io.Writer, format string, filenames []string, o parser.Options, workers int, filter *mysqlLog.Filter) error {
+	var w EventWriter
+	switch format {
+	case "ndjson":
+		w = newNDJSONWriter(out)
+	case "csv", "parquet":
+		// stdin cannot be parsed twice, so save it first.
+		filenames = append([]string{}, filenames...)
+		for i, filename := range filenames {
+			if filename != "-" {
+				continue
+			}
+			tmpFile, err := ioutil.TempFile("", "parser-cli-")
+			if err != nil {
+				return err
+			}
+			defer os.Remove(tmpFile.Name())
+			_, err = io.Copy(tmpFile, os.Stdin)
+			tmpFile.Close()
+			if err != nil {
+				return err
+			}
+			filenames[i] = tmpFile.Name()
+		}
+
+		columns, err := scanEventColumns(filenames, o, workers)
+		if err != nil {
+			return err
+		}
+		if format == "csv" {
+			w, err = newCSVWriter(out, columns)
+		} else {
+			w, err = newParquetWriter(out, columns)
+		}
+		if err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("invalid -format: %s: expected ndjson, csv or parquet", format)
+	}
+
+	err := parseEvents(filenames, o, workers, func(e *mysqlLog.Event) error {
+		if filter != nil && !filter.Match(e) {
+			return nil
+		}
+		return w.Write(e)
+	})
+	if err != nil {
+		return err
+	}
+	return w.Close()
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	mysqlLog "github.com/vadimtk/mysql-log-parser/log"
+	"github.com/vadimtk/mysql-log-parser/log/parser"
+	. "launchpad.net/gocheck"
+	"sort"
+	"strings"
+)
+
+/////////////////////////////////////////////////////////////////////////////
+// Events test suite
+// //////////////////////////////////////////////////////////////////////////
+
+type EventsTestSuite struct {
+}
+
+var _ = Suite(&EventsTestSuite{})
+
+const SLOW001 = "../test/logs/slow001.log"
+
+func (s *EventsTestSuite) TestColumns(t *C) {
+	metrics := []string{"Lock_time", "Query_time", "Rows_examined", "Rows_sent"}
+	tests := []struct {
+		format  string
+		columns func(t *C, out []byte) []string
+		expect  []string
+	}{
+		{
+			format: "ndjson",
+			columns: func(t *C, out []byte) []string {
+				// The Event fields and the metrics of the first event,
+				// sorted.
+				var e map[string]interface{}
+				t.Assert(json.Unmarshal(bytes.SplitN(out, []byte("\n"), 2)[0], &e), IsNil)
+				var columns []string
+				for field := range e {
+					columns = append(columns, field)
+				}
+				for _, m := range []string{"TimeMetrics", "NumberMetrics"} {
+					for metric := range e[m].(map[string]interface{}) {
+						columns = append(columns, metric)
+					}
+				}
+				sort.Strings(columns)
+				return columns
+			},
+			expect: []string{
+				"Admin", "BoolMetrics", "Command", "Db", "EndOffset", "Host", "Lock_time", "NumberMetrics",
+				"Offset", "Query", "Query_time", "RateLimit", "RateType", "Rows_examined", "Rows_sent",
+				"TimeMetrics", "Timestamp", "Ts", "User",
+			},
+		},
+		{
+			format: "csv",
+			columns: func(t *C, out []byte) []string {
+				header, err := csv.NewReader(bytes.NewReader(out)).Read()
+				t.Assert(err, IsNil)
+				return header
+			},
+			expect: append(append([]string{}, eventFields...), metrics...),
+		},
+		{
+			// The output is binary, so check the schema it is written with.
+			format: "parquet",
+			columns: func(t *C, out []byte) []string {
+				columns, err := scanEventColumns([]string{SLOW001}, parser.Options{}, 1)
+				t.Assert(err, IsNil)
+				var names []string
+				for _, col := range parquetSchema(columns) {
+					names = append(names, strings.TrimPrefix(strings.Split(col, ",")[0], "name="))
+				}
+				return names
+			},
+			expect: append(append([]string{}, eventFields...), metrics...),
+		},
+	}
+	for _, test := range tests {
+		var out bytes.Buffer
+		err := writeEvents(&out, test.format, []string{SLOW001}, parser.Options{}, 1, nil)
+		t.Assert(err, IsNil, Commentf(test.format))
+		t.Check(test.columns(t, out.Bytes()), DeepEquals, test.expect, Commentf(test.format))
+	}
+}
+
+func (s *EventsTestSuite) TestCSVRows(t *C) {
+	var out bytes.Buffer
+	err := writeEvents(&out, "csv", []string{SLOW001}, parser.Options{}, 1, nil)
+	t.Assert(err, IsNil)
+	rows, err := csv.NewReader(&out).ReadAll()
+	t.Assert(err, IsNil)
+	t.Check(rows, DeepEquals, [][]string{
+		{"Offset", "Ts", "Timestamp", "Admin", "Query", "User", "Host", "Db", "Lock_time", "Query_time", "Rows_examined", "Rows_sent"},
+		{"199", "071015 21:43:52", "0", "false", "select sleep(2) from n", "root", "localhost", "test", "0", "2", "0", "1"},
+		{"358", "071015 21:45:10", "0", "false", "select sleep(2) from test.n", "root", "localhost", "sakila", "0", "2", "0", "1"},
+	})
+}
+
+// NDJSON decodes to the same events as parsed, and the filter is applied.
+func (s *EventsTestSuite) TestNDJSONRoundTrip(t *C) {
+	var parsed []*mysqlLog.Event
+	err := parseEvents([]string{SLOW001}, parser.Options{}, 1, func(e *mysqlLog.Event) error {
+		parsed = append(parsed, e)
+		return nil
+	})
+	t.Assert(err, IsNil)
+	t.Assert(parsed, HasLen, 2)
+
+	filter, err := mysqlLog.NewFilter(`Db = "sakila"`)
+	t.Assert(err, IsNil)
+	for _, f := range []*mysqlLog.Filter{nil, filter} {
+		var out bytes.Buffer
+		err := writeEvents(&out, "ndjson", []string{SLOW001}, parser.Options{}, 1, f)
+		t.Assert(err, IsNil)
+		var got []*mysqlLog.Event
+		scanner := bufio.NewScanner(&out)
+		for scanner.Scan() {
+			e := &mysqlLog.Event{}
+			t.Assert(json.Unmarshal(scanner.Bytes(), e), IsNil)
+			got = append(got, e)
+		}
+		if f == nil {
+			t.Check(got, DeepEquals, parsed)
+		} else {
+			t.Check(got, DeepEquals, parsed[1:])
+		}
+	}
+}
+
+func (s *EventsTestSuite) TestInvalidFormat(t *C) {
+	var out bytes.Buffer
+	err := writeEvents(&out, "xml", []string{SLOW001}, parser.Options{}, 1, nil)
+	t.Check(err, ErrorMatches, "invalid -format: xml: .*")
+}
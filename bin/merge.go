@@ -0,0 +1,48 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	mysqlLog "github.com/vadimtk/mysql-log-parser/log"
+	"os"
+)
+
+// MergeDigests merges results saved as JSON (-output json) into one result,
+// as if their logs were parsed together.  Query classes with the same Id are
+// merged.
+func MergeDigests(filenames []string, so mysqlLog.StatsOptions) (*mysqlLog.Result, error) {
+	a := mysqlLog.NewAggregator(mysqlLog.AggregatorOptions{
+		Examples: true,
+		Stats:    so,
+	})
+
+	for _, filename := range filenames {
+		file := os.Stdin
+		if filename != "-" {
+			var err error
+			file, err = os.Open(filename)
+			if err != nil {
+				return nil, err
+			}
+		}
+		digest := &mysqlLog.Result{}
+		err := json.NewDecoder(file).Decode(digest)
+		file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", filename, err)
+		}
+		if digest.Global == nil || digest.Global.Metrics == nil {
+			return nil, fmt.Errorf("%s: not a JSON digest", filename)
+		}
+
+		if err := a.Merge(digest); err != nil {
+			return nil, fmt.Errorf("%s: %s", filename, err)
+		}
+	}
+
+	res := a.Finalize()
+	if res.Global.TotalQueries == 0 {
+		return nil, fmt.Errorf("no queries")
+	}
+	return res, nil
+}
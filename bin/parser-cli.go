@@ -1,155 +1,277 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"flag"
 	"fmt"
 	mysqlLog "github.com/vadimtk/mysql-log-parser/log"
 	"github.com/vadimtk/mysql-log-parser/log/parser"
-	//"github.com/davecgh/go-spew/spew"
-//	"github.com/davecheney/profile"
 	l "log"
 	"os"
-	"time"
-	"flag"
 	"runtime"
-	"sync"
+	"strconv"
+	"strings"
+	"time"
 )
 
-var logFile = flag.String("log", "", "log file to parse")
+var workers = flag.Int("workers", 1, "parse an uncompressed log file in this many chunks at once")
+var sortOrder = flag.String("sort", "Query_time:sum", "rank query classes by metric:stat (stat: sum, avg, max, min, pct95, med, stddev, vm or cnt)")
+var limit = flag.Int("limit", 20, "report the top N query classes, 0 for all")
+var minShare = flag.Float64("min-share", 0, "do not rank query classes with less than this percent of the sort value")
+var exact = flag.Bool("exact", false, "keep every value for exact percentiles instead of estimates within 1%")
+var percentiles = flag.String("percentiles", "", "comma-separated percentiles of every metric in the json output, e.g. 50,90,95,99,99.9")
+var histogram = flag.Bool("histogram", false, "count metric values in log-scale buckets (1us, 10us, ..., 10s+) and report the Query_time distribution")
+var window = flag.Duration("window", 0, "report each interval of this duration, e.g. 1m or 1h, by event time, as the logs are read")
+var timeZone = flag.String("time-zone", "UTC", "time zone of event times in the logs for -window, e.g. America/New_York or Local")
+var groupBy = flag.String("group-by", "fingerprint", "comma-separated attributes of the query classes: fingerprint, user, host, db, tables or admin, e.g. user or fingerprint,db")
+var filterExpr = flag.String("filter", "", "report only the events that match, e.g. 'Query_time > 1 and Db = \"orders\" and Full_scan = true'")
+var tables = flag.Bool("tables", false, "report the response time of the query classes of each table they read or write")
+var output = flag.String("output", "report", "output format: report, json (the whole result) or ndjson (one query class per line)")
 
-type WorkRes struct {
-	Event *mysqlLog.Event 
-	Fingerprint string
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s [report] [flags] [FILE...]\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "       %s merge [flags] [FILE...]\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "       %s events [flags] [FILE...]\n\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "Report the queries in MySQL slow logs like pt-query-digest, or write their\n")
+	fmt.Fprintf(os.Stderr, "events (see %s events -h).  FILE is - or no FILE for stdin, and may be\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "gzip, bzip2, zstd or xz compressed.  merge reports the digests of several\n")
+	fmt.Fprintf(os.Stderr, "logs, saved with -output json (without -exact), as one.\n\n")
+	flag.PrintDefaults()
 }
 
-type Result struct {
-        Global     *mysqlLog.GlobalClass
-        Classes    []*mysqlLog.QueryClass
+func newParser(file *os.File, stopChan <-chan bool, o parser.Options, workers int) (mysqlLog.MySQLLogParser, error) {
+	if workers > 1 && file != os.Stdin {
+		dr, compressed, err := parser.Decompress(file)
+		if err != nil {
+			return nil, err
+		}
+		dr.Close()
+		if _, err := file.Seek(0, os.SEEK_SET); err != nil {
+			return nil, err
+		}
+		if !compressed {
+			return parser.NewParallelSlowLogParser(file, stopChan, o, workers), nil
+		}
+	}
+	return parser.NewSlowLogParserFromReader(file, stopChan, o)
 }
 
-func Worker(id int, queue chan *mysqlLog.Event, req chan *WorkRes) {
-    var wp *mysqlLog.Event
-    for {
-        // get work item (pointer) from the queue
-        wp = <-queue
-        if wp == nil {
-            break
-        }
-
-        fingerprint := mysqlLog.Fingerprint(wp.Query)
- 	req <- &WorkRes{wp, fingerprint}	
-    }
+// parseEvents parses the slow logs and calls fn for each event in order.  It
+// stops at the first error from fn.
+func parseEvents(filenames []string, o parser.Options, workers int, fn func(*mysqlLog.Event) error) error {
+	for _, filename := range filenames {
+		file := os.Stdin
+		if filename != "-" {
+			var err error
+			file, err = os.Open(filename)
+			if err != nil {
+				return err
+			}
+		}
+
+		p, err := newParser(file, nil, o, workers)
+		if err != nil {
+			file.Close()
+			return fmt.Errorf("%s: %s", filename, err)
+		}
+		go p.Start(context.Background())
+		var fnErr error
+		for event := range p.Events() {
+			if fnErr != nil {
+				continue
+			}
+			if fnErr = fn(event); fnErr != nil {
+				p.Stop()
+			}
+		}
+		file.Close()
+		if fnErr != nil {
+			return fnErr
+		}
+		if err := p.Err(); err != nil {
+			return fmt.Errorf("%s: %s", filename, err)
+		}
+	}
+	return nil
 }
 
-func ParseSlowLog(filename string, o parser.Options) (*Result, error) {
-	file, err := os.Open(filename)
+// ParseSlowLog parses the slow logs and aggregates their events into query
+// classes.
+func ParseSlowLog(filenames []string, o parser.Options, ao mysqlLog.AggregatorOptions) (*mysqlLog.Result, error) {
+	a := mysqlLog.NewAggregator(ao)
+	err := parseEvents(filenames, o, *workers, func(event *mysqlLog.Event) error {
+		a.AddEvent(event)
+		return nil
+	})
+	res := a.Finalize()
 	if err != nil {
-		l.Fatal(err)
+		return nil, err
 	}
-	stopChan := make(<-chan bool, 1)
-
-	queue := make(chan *mysqlLog.Event)
-	res := make(chan *WorkRes)
-
-	// spawn workers
-	for i := 0; i < runtime.NumCPU(); i++ {
-		go Worker(i, queue, res)
+	if res.Global.TotalQueries == 0 {
+		return nil, fmt.Errorf("no queries")
 	}
+	return res, nil
+}
 
-	p := parser.NewSlowLogParser(file, stopChan, o)
+// ParseSlowLogWindows parses the slow logs and aggregates their events into
+// query classes per window of the interval.  It calls fn with each window, in
+// time order, when it is complete.
+func ParseSlowLogWindows(filenames []string, o parser.Options, ao mysqlLog.AggregatorOptions, interval time.Duration, loc *time.Location, fn func(*mysqlLog.Window) error) error {
+	a := mysqlLog.NewWindowAggregator(interval, ao.Stats, ao.Examples)
+	a.Location = loc
+	a.GroupBy = ao.GroupBy
+	a.Filter = ao.Filter
+	err := parseEvents(filenames, o, *workers, func(event *mysqlLog.Event) error {
+		for _, w := range a.AddEvent(event) {
+			if err := fn(w); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
 	if err != nil {
-		l.Fatal(err)
+		return err
 	}
+	for _, w := range a.Flush() {
+		if err := fn(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-        global := mysqlLog.NewGlobalClass()
-        queries := make(map[string]*mysqlLog.QueryClass)
-	result := &Result{}
-
-	var wg sync.WaitGroup
-
-
-	go p.Run()
-
-	go func(){
-		for {
-			// get work item (pointer) from the queue
-wp := <-res
-	    classId := mysqlLog.Checksum(wp.Fingerprint)
-	    class, haveClass := queries[classId]
-	    if !haveClass {
-		    class = mysqlLog.NewQueryClass(classId, wp.Fingerprint, true)
-			    queries[classId] = class
-	    }
-
-    // Add the event to its query class.
-    class.AddEvent(wp.Event)
-	wg.Done()
+// parsePercentiles parses a comma-separated list of percentiles.
+func parsePercentiles(list string) ([]float64, error) {
+	if list == "" {
+		return nil, nil
+	}
+	var percentiles []float64
+	for _, s := range strings.Split(list, ",") {
+		p, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+		if err != nil || p < 0 || p > 100 {
+			return nil, fmt.Errorf("invalid percentile: %s: expected a number from 0 to 100", s)
 		}
+		percentiles = append(percentiles, p)
+	}
+	return percentiles, nil
+}
 
-	}()
+func main() {
+	runtime.GOMAXPROCS(runtime.NumCPU())
 
-	for event := range p.EventChan {
-		//got = append(got, *e)
-		global.AddEvent(event)
-		queue <- event
-		wg.Add(1)
+	merge := false
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "events":
+			if err := runEvents(os.Args[2:]); err != nil {
+				l.Fatal(err)
+			}
+			return
+		case "merge":
+			merge = true
+			os.Args = append(os.Args[:1], os.Args[2:]...)
+		case "report":
+			os.Args = append(os.Args[:1], os.Args[2:]...)
+		}
 	}
 
-	wg.Wait()
-        for _, class := range queries {
-                class.Finalize()
-        }
-        global.Finalize(uint64(len(queries)))
+	flag.Usage = usage
+	flag.Parse()
 
+	filenames := flag.Args()
+	if len(filenames) == 0 {
+		filenames = []string{"-"}
+	}
 
-        nQueries := len(queries)
-        classes := make([]*mysqlLog.QueryClass, nQueries)
-        for _, class := range queries {
-                // Decr before use; can't classes[--nQueries] in Go.
-                nQueries--
-                classes[nQueries] = class
-        }
+	sortMetric, sortStat, err := ParseSortOrder(*sortOrder)
+	if err != nil {
+		l.Fatal(err)
+	}
+	switch *output {
+	case "report", "json", "ndjson":
+	default:
+		l.Fatalf("invalid -output: %s: expected report, json or ndjson", *output)
+	}
+	so := mysqlLog.StatsOptions{
+		ExactValues: *exact,
+		Histogram:   *histogram,
+	}
+	if so.Percentiles, err = parsePercentiles(*percentiles); err != nil {
+		l.Fatal(err)
+	}
+	ao := mysqlLog.AggregatorOptions{
+		Examples: true,
+		Workers:  runtime.NumCPU(),
+		GroupBy:  strings.Split(*groupBy, ","),
+		Stats:    so,
+	}
+	if err := mysqlLog.CheckGroupBy(ao.GroupBy); err != nil {
+		l.Fatal(err)
+	}
+	if *filterExpr != "" {
+		if merge {
+			l.Fatal("-filter cannot filter merged digests")
+		}
+		if ao.Filter, err = mysqlLog.NewFilter(*filterExpr); err != nil {
+			l.Fatal(err)
+		}
+	}
+	report := &Report{
+		SortMetric: sortMetric,
+		SortStat:   sortStat,
+		Limit:      *limit,
+		MinShare:   *minShare,
+		Tables:     *tables,
+	}
 
-        result.Global = global
-        result.Classes = classes
+	if *window > 0 {
+		if merge || *output == "json" {
+			l.Fatal("-window needs -output report or ndjson, and cannot merge")
+		}
+		loc, err := time.LoadLocation(*timeZone)
+		if err != nil {
+			l.Fatal(err)
+		}
+		enc := json.NewEncoder(os.Stdout)
+		err = ParseSlowLogWindows(filenames, parser.Options{}, ao, *window, loc, func(w *mysqlLog.Window) error {
+			res := &mysqlLog.Result{Global: w.Global, Classes: w.Classes}
+			report.Sort(res)
+			w.Classes = res.Classes
+			if *output == "ndjson" {
+				return enc.Encode(w)
+			}
+			fmt.Printf("# Window %s to %s\n", w.Start.Format(time.RFC3339), w.End.Format(time.RFC3339))
+			report.Print(os.Stdout, res)
+			return nil
+		})
+		if err != nil {
+			l.Fatal(err)
+		}
+		return
+	}
 
-	return result, nil
-}
+	var res *mysqlLog.Result
+	if merge {
+		res, err = MergeDigests(filenames, so)
+	} else {
+		res, err = ParseSlowLog(filenames, parser.Options{}, ao)
+	}
+	if err != nil {
+		l.Fatal(err)
+	}
 
-func main() {
-//  defer profile.Start(profile.CPUProfile).Stop()
-// re := pcre.MustCompile("(",0)
- flag.Parse()
- runtime.GOMAXPROCS(runtime.NumCPU())
-
- startT := time.Now()
- gotG, _ := ParseSlowLog(*logFile, parser.Options{Debug:false})
- sinceT := time.Since(startT)
- fmt.Printf("Events: %d, time: %f sec, rate: %f\n", gotG.Global.TotalQueries,sinceT.Seconds(),float64(gotG.Global.TotalQueries)/sinceT.Seconds())
- //i:=0.05
-
- for i:=0.00;i<=1.04;i+=0.05 {
-	val,rmin,rmax := gotG.Global.Metrics.TimeMetrics["Query_time"].GKq.QueryRank(i)
-	 fmt.Printf("%f pct query time : %f, (%d-%d)\n", i, val, rmin, rmax)
- }
-
- fmt.Printf("Real 95pct %f, med: %f\n",  gotG.Global.Metrics.TimeMetrics["Query_time"].Pct95,gotG.Global.Metrics.TimeMetrics["Query_time"].Med )
- fmt.Printf("GK length: %d\n",  len(gotG.Global.Metrics.TimeMetrics["Query_time"].GKq.Items))
- gotG.Global.Metrics.TimeMetrics["Query_time"].GKq.Histo(20)
- for _,v := range gotG.Classes {
-  if v.TotalQueries > gotG.Global.TotalQueries / 10 {
- fmt.Printf("Query ID %s, Events: %d\n", v.Id, v.TotalQueries)
-
- for i:=0.00;i<=1.04;i+=0.05 {
-	 val,rmin,rmax := v.Metrics.TimeMetrics["Query_time"].GKq.QueryRank(i)
-	 fmt.Printf("%f pct query time : %f, (%d-%d)\n", i, val, rmin, rmax)
- }
- fmt.Printf("Real 95pct %f, med: %f\n",  v.Metrics.TimeMetrics["Query_time"].Pct95,v.Metrics.TimeMetrics["Query_time"].Med )
- fmt.Printf("GK length: %d\n",  len(v.Metrics.TimeMetrics["Query_time"].GKq.Items))
- 	v.Metrics.TimeMetrics["Query_time"].GKq.Histo(20)
- }
-// fmt.Printf("%.7f\n",v)
- }
-
-
-// spew.Dump(gotG)
+	switch *output {
+	case "json":
+		report.Sort(res)
+		err = res.WriteJSON(os.Stdout)
+	case "ndjson":
+		report.Sort(res)
+		err = res.WriteNDJSON(os.Stdout)
+	default:
+		report.Print(os.Stdout, res)
+	}
+	if err != nil {
+		l.Fatal(err)
+	}
 }
@@ -0,0 +1,521 @@
+package main
+
+import (
+	"fmt"
+	mysqlLog "github.com/vadimtk/mysql-log-parser/log"
+	"io"
+	"math"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// A Report is a pt-query-digest style report of a Result: the overall stats,
+// a profile of the top query classes, and details of each one.
+type Report struct {
+	SortMetric string  // e.g. Query_time
+	SortStat   string  // sum, avg, max, min, pct95, med, stddev, vm or cnt
+	Limit      int     // top N classes, 0 for all
+	MinShare   float64 // percent of the sort value; smaller classes are not ranked
+	Tables     bool    // print the load of each table after the profile
+}
+
+// A rankedClass is a query class in the profile.
+type rankedClass struct {
+	rank  int
+	class *mysqlLog.QueryClass
+	value float64 // of SortMetric:SortStat
+}
+
+// ParseSortOrder parses a metric:stat sort order, e.g. Query_time:sum.
+func ParseSortOrder(order string) (metric string, stat string, err error) {
+	parts := strings.SplitN(order, ":", 2)
+	metric = parts[0]
+	stat = "sum"
+	if len(parts) == 2 {
+		stat = parts[1]
+	}
+	switch stat {
+	case "sum", "avg", "max", "min", "pct95", "med", "stddev", "vm", "cnt":
+	default:
+		return "", "", fmt.Errorf("invalid sort stat: %s: expected sum, avg, max, min, pct95, med, stddev, vm or cnt", stat)
+	}
+	if metric == "" {
+		return "", "", fmt.Errorf("invalid sort order: %s: expected metric:stat", order)
+	}
+	return metric, stat, nil
+}
+
+// Print prints the report of res to w.
+func (r *Report) Print(w io.Writer, res *mysqlLog.Result) {
+	ranked, misc := r.rank(res)
+
+	r.printOverall(w, res.Global)
+	r.printProfile(w, res.Global, ranked, misc)
+	if r.Tables {
+		r.printTables(w, res)
+	}
+	for _, rc := range ranked {
+		r.printClass(w, res.Global, rc)
+	}
+}
+
+// Sort sorts res.Classes by the sort value, descending, like the profile.
+func (r *Report) Sort(res *mysqlLog.Result) {
+	ranked, misc := r.rank(res)
+	classes := make([]*mysqlLog.QueryClass, 0, len(res.Classes))
+	for _, rc := range append(ranked, misc...) {
+		classes = append(classes, rc.class)
+	}
+	res.Classes = classes
+}
+
+// rank sorts the classes by the sort value, descending, and returns the top
+// Limit classes with at least MinShare of the total sort value, and the rest.
+func (r *Report) rank(res *mysqlLog.Result) ([]rankedClass, []rankedClass) {
+	all := make([]rankedClass, len(res.Classes))
+	total := 0.0
+	for i, class := range res.Classes {
+		all[i] = rankedClass{class: class, value: sortValue(class.Metrics, class.TotalQueries, r.SortMetric, r.SortStat)}
+		total += all[i].value
+	}
+	sort.Sort(byValue(all))
+
+	var ranked, misc []rankedClass
+	for _, rc := range all {
+		if (r.Limit > 0 && len(ranked) >= r.Limit) || (total > 0 && rc.value/total*100 < r.MinShare) {
+			misc = append(misc, rc)
+			continue
+		}
+		rc.rank = len(ranked) + 1
+		ranked = append(ranked, rc)
+	}
+	return ranked, misc
+}
+
+type byValue []rankedClass
+
+func (a byValue) Len() int      { return len(a) }
+func (a byValue) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a byValue) Less(i, j int) bool {
+	if a[i].value == a[j].value {
+		return a[i].class.Id < a[j].class.Id
+	}
+	return a[i].value > a[j].value // descending order
+}
+
+// sortValue returns the stat of the metric, or 0 if there is no such metric.
+func sortValue(s *mysqlLog.EventStats, cnt uint64, metric string, stat string) float64 {
+	if stat == "cnt" {
+		return float64(cnt)
+	}
+	if t, ok := s.TimeMetrics[metric]; ok {
+		switch stat {
+		case "sum":
+			return t.Sum
+		case "avg":
+			return t.Avg
+		case "max":
+			return t.Max
+		case "min":
+			return t.Min
+		case "pct95":
+			return t.Pct95
+		case "med":
+			return t.Med
+		case "stddev":
+			return t.Stddev
+		case "vm":
+			return t.VarMean
+		}
+	}
+	if n, ok := s.NumberMetrics[metric]; ok {
+		switch stat {
+		case "sum":
+			return float64(n.Sum)
+		case "avg":
+			return float64(n.Avg)
+		case "max":
+			return float64(n.Max)
+		case "min":
+			return float64(n.Min)
+		case "pct95":
+			return float64(n.Pct95)
+		case "med":
+			return float64(n.Med)
+		case "stddev":
+			return n.Stddev
+		case "vm":
+			return n.VarMean
+		}
+	}
+	return 0
+}
+
+func (r *Report) printOverall(w io.Writer, global *mysqlLog.GlobalClass) {
+	fmt.Fprintf(w, "# Overall: %s total, %s unique\n", shorten(float64(global.TotalQueries)), shorten(float64(global.UniqueQueries)))
+	if global.RateType != "" {
+		fmt.Fprintf(w, "# Rate limit: %s:%d\n", global.RateType, global.RateLimit)
+	}
+	fmt.Fprintf(w, "# %-24s %7s %7s %7s %7s %7s %7s %7s\n", "Attribute", "total", "min", "max", "avg", "95%", "stddev", "median")
+	fmt.Fprintf(w, "# %-24s %7s %7s %7s %7s %7s %7s %7s\n", strings.Repeat("=", 24), "=======", "=======", "=======", "=======", "=======", "=======", "=======")
+	printMetrics(w, global.Metrics, nil)
+	fmt.Fprintln(w)
+}
+
+func (r *Report) printProfile(w io.Writer, global *mysqlLog.GlobalClass, ranked []rankedClass, misc []rankedClass) {
+	totalTime := 0.0
+	if t, ok := global.Metrics.TimeMetrics["Query_time"]; ok {
+		totalTime = t.Sum
+	}
+
+	fmt.Fprintf(w, "# Profile (sorted by %s:%s)\n", r.SortMetric, r.SortStat)
+	fmt.Fprintf(w, "# Rank Query ID           Response time   Calls R/Call   V/M   Item\n")
+	fmt.Fprintf(w, "# ==== ================== =============== ===== ======== ===== ==========\n")
+	for _, rc := range ranked {
+		respTime, rCall, vm := 0.0, 0.0, 0.0
+		if t, ok := rc.class.Metrics.TimeMetrics["Query_time"]; ok {
+			respTime = t.Sum
+			rCall = t.Avg
+			vm = t.VarMean
+		}
+		fmt.Fprintf(w, "# %4d 0x%-16s %8.4f %5.1f%% %5d %8.4f %5.2f %s\n",
+			rc.rank, rc.class.Id, respTime, share(respTime, totalTime), rc.class.TotalQueries, rCall, vm, item(label(rc.class)))
+	}
+	if len(misc) > 0 {
+		respTime := 0.0
+		calls := uint64(0)
+		for _, rc := range misc {
+			if t, ok := rc.class.Metrics.TimeMetrics["Query_time"]; ok {
+				respTime += t.Sum
+			}
+			calls += rc.class.TotalQueries
+		}
+		fmt.Fprintf(w, "# MISC 0xMISC%-10s %8.4f %5.1f%% %5d %8.4f %5s <%d ITEMS>\n",
+			"", respTime, share(respTime, totalTime), calls, respTime/float64(calls), "0.0", len(misc))
+	}
+	fmt.Fprintln(w)
+}
+
+// A tableLoad is the queries of the classes that read or write a table.
+type tableLoad struct {
+	table    string
+	respTime float64
+	calls    uint64
+	read     bool
+	written  bool
+}
+
+// printTables prints the response time of the query classes of each table,
+// like the profile.  A class is counted once for every table it reads or
+// writes, so the total can be greater than 100%.
+func (r *Report) printTables(w io.Writer, res *mysqlLog.Result) {
+	totalTime := 0.0
+	if t, ok := res.Global.Metrics.TimeMetrics["Query_time"]; ok {
+		totalTime = t.Sum
+	}
+	loads := make(map[string]*tableLoad)
+	var tables []*tableLoad
+	add := func(class *mysqlLog.QueryClass, table string, written bool) {
+		load, ok := loads[table]
+		if !ok {
+			load = &tableLoad{table: table}
+			loads[table] = load
+			tables = append(tables, load)
+		}
+		if t, ok := class.Metrics.TimeMetrics["Query_time"]; ok {
+			load.respTime += t.Sum
+		}
+		load.calls += class.TotalQueries
+		if written {
+			load.written = true
+		} else {
+			load.read = true
+		}
+	}
+	for _, class := range res.Classes {
+		if class.Statement == nil {
+			continue
+		}
+		for _, table := range class.Statement.Written {
+			add(class, table, true)
+		}
+		for _, table := range class.Statement.Read {
+			add(class, table, false)
+		}
+	}
+	if len(tables) == 0 {
+		return
+	}
+	sort.Sort(byRespTime(tables))
+
+	fmt.Fprintf(w, "# Tables (sorted by Query_time:sum)\n")
+	fmt.Fprintf(w, "# Rank Response time   Calls  R/W Table\n")
+	fmt.Fprintf(w, "# ==== =============== ====== === ==========\n")
+	for i, load := range tables {
+		rw := ""
+		if load.read {
+			rw += "R"
+		}
+		if load.written {
+			rw += "W"
+		}
+		fmt.Fprintf(w, "# %4d %8.4f %5.1f%% %6d %-3s %s\n",
+			i+1, load.respTime, share(load.respTime, totalTime), load.calls, rw, load.table)
+	}
+	fmt.Fprintln(w)
+}
+
+type byRespTime []*tableLoad
+
+func (a byRespTime) Len() int      { return len(a) }
+func (a byRespTime) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a byRespTime) Less(i, j int) bool {
+	if a[i].respTime == a[j].respTime {
+		return a[i].table < a[j].table
+	}
+	return a[i].respTime > a[j].respTime // descending order
+}
+
+func (r *Report) printClass(w io.Writer, global *mysqlLog.GlobalClass, rc rankedClass) {
+	class := rc.class
+	if class.Distill != "" {
+		fmt.Fprintf(w, "# Query %d: ID 0x%s %s\n", rc.rank, class.Id, class.Distill)
+	} else {
+		fmt.Fprintf(w, "# Query %d: ID 0x%s\n", rc.rank, class.Id)
+	}
+	fmt.Fprintf(w, "# %-20s %3s %7s %7s %7s %7s %7s %7s %7s\n", "Attribute", "pct", "total", "min", "max", "avg", "95%", "stddev", "median")
+	fmt.Fprintf(w, "# %-20s %3s %7s %7s %7s %7s %7s %7s %7s\n", strings.Repeat("=", 20), "===", "=======", "=======", "=======", "=======", "=======", "=======", "=======")
+	fmt.Fprintf(w, "# %-20s %3.0f %7s\n", "Count", share(float64(class.TotalQueries), float64(global.TotalQueries)), shorten(float64(class.TotalQueries)))
+	printMetrics(w, class.Metrics, global.Metrics)
+	if t, ok := class.Metrics.TimeMetrics["Query_time"]; ok && len(t.Histogram) > 0 {
+		printHistogram(w, "Query_time", t.Histogram)
+	}
+	if len(class.Attributes) > 0 {
+		fmt.Fprintf(w, "# Group by\n#    %s\n", attributes(class.Attributes))
+	}
+	if class.Statement != nil && len(class.Statement.Read)+len(class.Statement.Written) > 0 {
+		fmt.Fprintf(w, "# Tables\n")
+		for _, table := range append(append([]string{}, class.Statement.Written...), class.Statement.Read...) {
+			fmt.Fprintf(w, "#    SHOW TABLE STATUS%s LIKE '%s'\\G\n", fromDb(table), lastPart(table))
+			fmt.Fprintf(w, "#    SHOW CREATE TABLE %s\\G\n", quoteTable(table))
+		}
+	}
+	if class.Fingerprint != "" {
+		fmt.Fprintf(w, "# Fingerprint\n#    %s\n", class.Fingerprint)
+	}
+	if class.Example.Query != "" {
+		if class.Example.Ts != "" {
+			fmt.Fprintf(w, "# Example at %s\n", class.Example.Ts)
+		}
+		fmt.Fprintf(w, "%s\\G\n", class.Example.Query)
+		if class.Example.AsSelect != "" {
+			fmt.Fprintf(w, "# Converted for EXPLAIN\n# EXPLAIN /*!50100 PARTITIONS*/\n%s\\G\n", class.Example.AsSelect)
+		}
+	}
+	fmt.Fprintln(w)
+}
+
+// printHistogram prints a distribution of the metric like pt-query-digest:
+// a bar of up to 64 # per bucket, relative to the largest bucket.
+func printHistogram(w io.Writer, metric string, h []mysqlLog.Bucket) {
+	max := uint64(0)
+	for _, b := range h {
+		if b.Cnt > max {
+			max = b.Cnt
+		}
+	}
+	fmt.Fprintf(w, "# %s distribution\n", metric)
+	for i, b := range h {
+		label := microT(b.Min)
+		if i == len(h)-1 {
+			label += "+"
+		}
+		bar := ""
+		if b.Cnt > 0 {
+			bar = strings.Repeat("#", int(math.Ceil(float64(b.Cnt)*64/float64(max))))
+		}
+		fmt.Fprintln(w, strings.TrimRight(fmt.Sprintf("# %5s  %s", label, bar), " "))
+	}
+}
+
+// printMetrics prints a line of stats for every metric.  If global is not
+// nil, the pct column is the percent of the global total.
+func printMetrics(w io.Writer, s *mysqlLog.EventStats, global *mysqlLog.EventStats) {
+	pct := func(total float64, globalTotal float64) string {
+		if global == nil {
+			return ""
+		}
+		return fmt.Sprintf(" %3.0f", share(total, globalTotal))
+	}
+	// Wide enough for the longest metric names, like InnoDB_rec_lock_wait.
+	width := 24
+	if global != nil {
+		width = 20
+	}
+
+	for _, metric := range timeMetricNames(s) {
+		t := s.TimeMetrics[metric]
+		globalTotal := 0.0
+		if global != nil {
+			if g, ok := global.TimeMetrics[metric]; ok {
+				globalTotal = g.Sum
+			}
+		}
+		fmt.Fprintf(w, "# %-*s%s %7s %7s %7s %7s %7s %7s %7s\n", width, metricName(metric), pct(t.Sum, globalTotal),
+			microT(t.Sum), microT(t.Min), microT(t.Max), microT(t.Avg), microT(t.Pct95), microT(t.Stddev), microT(t.Med))
+	}
+
+	numberMetrics := make([]string, 0, len(s.NumberMetrics))
+	for metric := range s.NumberMetrics {
+		numberMetrics = append(numberMetrics, metric)
+	}
+	sort.Strings(numberMetrics)
+	for _, metric := range numberMetrics {
+		n := s.NumberMetrics[metric]
+		globalTotal := 0.0
+		if global != nil {
+			if g, ok := global.NumberMetrics[metric]; ok {
+				globalTotal = float64(g.Sum)
+			}
+		}
+		fmt.Fprintf(w, "# %-*s%s %7s %7s %7s %7s %7s %7s %7s\n", width, metricName(metric), pct(float64(n.Sum), globalTotal),
+			shorten(float64(n.Sum)), shorten(float64(n.Min)), shorten(float64(n.Max)), shorten(float64(n.Avg)),
+			shorten(float64(n.Pct95)), shorten(n.Stddev), shorten(float64(n.Med)))
+	}
+
+	boolMetrics := make([]string, 0, len(s.BoolMetrics))
+	for metric := range s.BoolMetrics {
+		boolMetrics = append(boolMetrics, metric)
+	}
+	sort.Strings(boolMetrics)
+	if len(boolMetrics) > 0 {
+		fmt.Fprintf(w, "# Boolean:\n")
+	}
+	for _, metric := range boolMetrics {
+		b := s.BoolMetrics[metric]
+		yes := share(float64(b.True), float64(b.Cnt))
+		fmt.Fprintf(w, "# %-*s %3.0f%% yes, %3.0f%% no\n", width, metricName(metric), yes, 100-yes)
+	}
+}
+
+// timeMetricNames returns the time metrics in the order pt-query-digest prints
+// them: Query_time, Lock_time, then the others by name.
+func timeMetricNames(s *mysqlLog.EventStats) []string {
+	names := []string{}
+	for _, metric := range []string{"Query_time", "Lock_time"} {
+		if _, ok := s.TimeMetrics[metric]; ok {
+			names = append(names, metric)
+		}
+	}
+	others := []string{}
+	for metric := range s.TimeMetrics {
+		if metric != "Query_time" && metric != "Lock_time" {
+			others = append(others, metric)
+		}
+	}
+	sort.Strings(others)
+	return append(names, others...)
+}
+
+// metricName returns a human name for the metric like pt-query-digest,
+// e.g. Rows_examined is "Rows examined" and Query_time is "Exec time".
+func metricName(metric string) string {
+	if metric == "Query_time" {
+		return "Exec time"
+	}
+	return strings.Replace(metric, "_", " ", -1)
+}
+
+// fromDb returns " FROM `db`" of db.table, else "".
+func fromDb(table string) string {
+	if i := strings.LastIndex(table, "."); i >= 0 {
+		return " FROM `" + table[:i] + "`"
+	}
+	return ""
+}
+
+func lastPart(table string) string {
+	return table[strings.LastIndex(table, ".")+1:]
+}
+
+// quoteTable returns `db`.`table` of db.table.
+func quoteTable(table string) string {
+	return "`" + strings.Replace(table, ".", "`.`", 1) + "`"
+}
+
+// label returns the group-by values of the class, else its distill, like
+// pt-query-digest, else its fingerprint.
+func label(class *mysqlLog.QueryClass) string {
+	if len(class.Attributes) > 0 {
+		return attributes(class.Attributes)
+	}
+	if class.Distill != "" {
+		return class.Distill
+	}
+	return class.Fingerprint
+}
+
+// attributes returns the group-by values like "db=test user=root", sorted by
+// attribute, with the fingerprint last because it is the longest.
+func attributes(attrs map[string]string) string {
+	names := make([]string, 0, len(attrs))
+	for name := range attrs {
+		if name != "fingerprint" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	if _, ok := attrs["fingerprint"]; ok {
+		names = append(names, "fingerprint")
+	}
+	values := make([]string, len(names))
+	for i, name := range names {
+		values[i] = name + "=" + attrs[name]
+	}
+	return strings.Join(values, " ")
+}
+
+// item returns the label of a class shortened to fit the profile.
+func item(label string) string {
+	item := strings.Join(strings.Fields(label), " ")
+	if utf8.RuneCountInString(item) > 60 {
+		item = string([]rune(item)[0:57]) + "..."
+	}
+	return item
+}
+
+func share(val float64, total float64) float64 {
+	if total == 0 {
+		return 0
+	}
+	return val / total * 100
+}
+
+// microT formats seconds like pt-query-digest: 2s, 150ms, 20us.
+func microT(secs float64) string {
+	switch {
+	case secs == 0:
+		return "0"
+	case secs >= 1:
+		return fmt.Sprintf("%.0fs", secs)
+	case secs >= 0.001:
+		return fmt.Sprintf("%.0fms", secs*1000)
+	default:
+		return fmt.Sprintf("%.0fus", secs*1000000)
+	}
+}
+
+// shorten formats n like pt-query-digest: 999, 1.50k, 2.00M.
+func shorten(n float64) string {
+	units := []string{"", "k", "M", "G", "T"}
+	i := 0
+	for n >= 1000 && i < len(units)-1 {
+		n /= 1000
+		i++
+	}
+	if i == 0 {
+		return fmt.Sprintf("%.0f", n)
+	}
+	return fmt.Sprintf("%.2f%s", n, units[i])
+}
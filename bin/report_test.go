@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	mysqlLog "github.com/vadimtk/mysql-log-parser/log"
+	. "launchpad.net/gocheck"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+// Hook gocheck into the "go test" runner.
+// http://labix.org/gocheck
+func Test(t *testing.T) { TestingT(t) }
+
+/////////////////////////////////////////////////////////////////////////////
+// Report test suite
+// //////////////////////////////////////////////////////////////////////////
+
+type ReportTestSuite struct {
+}
+
+var _ = Suite(&ReportTestSuite{})
+
+// result returns the result of the queries, each with its Query_time.
+func result(queries []string, times []float32) *mysqlLog.Result {
+	a := mysqlLog.NewAggregator(mysqlLog.AggregatorOptions{})
+	for i, q := range queries {
+		e := mysqlLog.NewEvent()
+		e.Query = q
+		e.TimeMetrics["Query_time"] = times[i]
+		a.AddEvent(e)
+	}
+	return a.Finalize()
+}
+
+func (s *ReportTestSuite) TestRank(t *C) {
+	res := result(
+		[]string{"select c from t", "select b from t", "select a from t", "select b from t", "select d from t"},
+		[]float32{1, 1.5, 6, 1.5, 1},
+	)
+	ids := map[string]string{}
+	for _, class := range res.Classes {
+		ids[class.Fingerprint] = class.Id
+	}
+
+	r := &Report{SortMetric: "Query_time", SortStat: "sum", Limit: 2}
+	ranked, misc := r.rank(res)
+	t.Assert(ranked, HasLen, 2)
+	t.Check(ranked[0].class.Fingerprint, Equals, "select a from t")
+	t.Check(ranked[0].rank, Equals, 1)
+	t.Check(ranked[0].value, Equals, 6.0)
+	t.Check(ranked[1].class.Fingerprint, Equals, "select b from t")
+	t.Check(ranked[1].rank, Equals, 2)
+	t.Check(ranked[1].value, Equals, 3.0)
+
+	// Ties are in Id order.
+	t.Assert(misc, HasLen, 2)
+	first, second := "select c from t", "select d from t"
+	if ids[second] < ids[first] {
+		first, second = second, first
+	}
+	t.Check(misc[0].class.Fingerprint, Equals, first)
+	t.Check(misc[1].class.Fingerprint, Equals, second)
+
+	// Shares of the total response time, 11s.
+	var out bytes.Buffer
+	r.printProfile(&out, res.Global, ranked, misc)
+	profile := out.String()
+	t.Check(strings.Contains(profile, fmt.Sprintf("#    1 0x%-16s   6.0000  54.5%%     1   6.0000", ids["select a from t"])), Equals, true, Commentf("%s", profile))
+	t.Check(strings.Contains(profile, fmt.Sprintf("#    2 0x%-16s   3.0000  27.3%%     2   1.5000", ids["select b from t"])), Equals, true, Commentf("%s", profile))
+	t.Check(strings.Contains(profile, "# MISC 0xMISC             2.0000  18.2%     2   1.0000   0.0 <2 ITEMS>"), Equals, true, Commentf("%s", profile))
+
+	// Classes with less than MinShare are not ranked.
+	r = &Report{SortMetric: "Query_time", SortStat: "sum", MinShare: 20}
+	ranked, misc = r.rank(res)
+	t.Check(ranked, HasLen, 2)
+	t.Check(misc, HasLen, 2)
+
+	// Sort puts the misc classes last.
+	r.Sort(res)
+	t.Check(res.Classes[0].Fingerprint, Equals, "select a from t")
+	t.Check(res.Classes[1].Fingerprint, Equals, "select b from t")
+	t.Check(res.Classes[2].Fingerprint, Equals, first)
+}
+
+func (s *ReportTestSuite) TestItem(t *C) {
+	t.Check(item("SELECT  t\n  u"), Equals, "SELECT t u")
+
+	// Long items are cut by character, not by byte.
+	got := item("SELECT " + strings.Repeat("é", 60))
+	t.Check(utf8.ValidString(got), Equals, true)
+	t.Check(got, Equals, "SELECT "+strings.Repeat("é", 50)+"...")
+}
+
+func (s *ReportTestSuite) TestMetricsNotInGlobal(t *C) {
+	// A merged or edited digest can have metrics that the global class
+	// does not have: their share is 0%.
+	res := result([]string{"select a from t"}, []float32{1})
+	class := res.Classes[0]
+	class.Metrics.NumberMetrics["Rows_sent"] = &mysqlLog.NumberStats{Cnt: 1, Sum: 5, Min: 5, Max: 5, Avg: 5}
+	delete(res.Global.Metrics.TimeMetrics, "Query_time")
+
+	var out bytes.Buffer
+	printMetrics(&out, class.Metrics, res.Global.Metrics)
+	t.Check(out.String(), Matches, `(?s)# Exec time\s+0 .*# Rows sent\s+0 .*`)
+}
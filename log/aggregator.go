@@ -0,0 +1,310 @@
+package log
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// A Result is the global class and query classes of aggregated events.
+type Result struct {
+	Global  *GlobalClass
+	Classes []*QueryClass
+}
+
+// WriteJSON writes the result as one JSON document.
+func (res *Result) WriteJSON(w io.Writer) error {
+	bytes, err := json.MarshalIndent(res, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "%s\n", bytes)
+	return err
+}
+
+// WriteNDJSON writes the query classes as newline-delimited JSON, one class
+// per line.
+func (res *Result) WriteNDJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	for _, class := range res.Classes {
+		if err := enc.Encode(class); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type AggregatorOptions struct {
+	Examples bool     // keep the query with the greatest Query_time of each class
+	Workers  int      // fingerprint queries in this many goroutines (default 1)
+	GroupBy  []string // GROUP_BY_ATTRIBUTES of the classes (default fingerprint)
+	Filter   *Filter  // aggregate only the events that match
+	Stats    StatsOptions
+}
+
+// Attributes of events that classes can be grouped by, like pt-query-digest
+// --group-by: the fingerprint of the query, the User, Host and Db, each of
+// the Tables of the query, and the admin command (Query of Admin events).
+var GROUP_BY_ATTRIBUTES = []string{"fingerprint", "user", "host", "db", "tables", "admin"}
+
+// CheckGroupBy returns an error if an attribute is not in GROUP_BY_ATTRIBUTES.
+func CheckGroupBy(groupBy []string) error {
+	for _, attr := range groupBy {
+		valid := false
+		for _, a := range GROUP_BY_ATTRIBUTES {
+			if attr == a {
+				valid = true
+				break
+			}
+		}
+		if !valid {
+			return fmt.Errorf("invalid group-by attribute: %s (valid: %s)",
+				attr, strings.Join(GROUP_BY_ATTRIBUTES, ", "))
+		}
+	}
+	return nil
+}
+
+// An Aggregator aggregates events, e.g. from a MySQLLogParser, into a
+// GlobalClass and a QueryClass per fingerprint of the queries, with the class
+// Id Checksum(Fingerprint(query)).  With more than one worker, events are
+// fingerprinted concurrently, so they are added to their classes out of order.
+//
+// With GroupBy, there is a class per combination of the values of the
+// attributes, e.g. per user and db, with the values in QueryClass.Attributes
+// and the class Id the Checksum of the values.  An event is in no class if an
+// attribute has no value, e.g. no Db, and in a class per table with "tables".
+type Aggregator struct {
+	opt     AggregatorOptions
+	global  *GlobalClass
+	queries map[string]*QueryClass // by Id
+	// With more than one worker:
+	queue chan *Event
+	done  chan struct{}
+}
+
+// A classKey is a class of an event.
+type classKey struct {
+	id          string
+	fingerprint string
+	attributes  map[string]string // nil when grouped by fingerprint only
+}
+
+type keyedEvent struct {
+	event *Event
+	keys  []classKey
+}
+
+func NewAggregator(opt AggregatorOptions) *Aggregator {
+	a := &Aggregator{
+		opt:     opt,
+		global:  NewGlobalClassWithOptions(opt.Stats),
+		queries: make(map[string]*QueryClass),
+	}
+	if opt.Workers > 1 {
+		a.queue = make(chan *Event, opt.Workers)
+		a.done = make(chan struct{})
+		keyed := make(chan keyedEvent, opt.Workers)
+
+		// Fingerprinting a query is slow, so the workers do it, and one
+		// goroutine adds the events to their classes.
+		var wg sync.WaitGroup
+		wg.Add(opt.Workers)
+		for i := 0; i < opt.Workers; i++ {
+			go func() {
+				defer wg.Done()
+				for e := range a.queue {
+					keyed <- keyedEvent{e, a.classKeys(e)}
+				}
+			}()
+		}
+		go func() {
+			wg.Wait()
+			close(keyed)
+		}()
+		go func() {
+			defer close(a.done)
+			for k := range keyed {
+				a.addToClasses(k.event, k.keys)
+			}
+		}()
+	}
+	return a
+}
+
+// AddEvent adds the event to the global class and its query class, unless it
+// does not match the Filter.  It returns MixedRateLimitsError if the event has
+// a different rate limit than previous events, but adds the event anyway.
+func (a *Aggregator) AddEvent(e *Event) error {
+	if a.opt.Filter != nil && !a.opt.Filter.Match(e) {
+		return nil
+	}
+	err := a.global.AddEvent(e)
+	if a.queue != nil {
+		a.queue <- e
+	} else {
+		a.addToClasses(e, a.classKeys(e))
+	}
+	return err
+}
+
+// Aggregate adds the events that the parser sends until it is done, and
+// returns its error, if any, else the first AddEvent error.  The parser
+// must be started.
+func (a *Aggregator) Aggregate(p MySQLLogParser) error {
+	var addErr error
+	for e := range p.Events() {
+		if err := a.AddEvent(e); err != nil && addErr == nil {
+			addErr = err
+		}
+	}
+	if err := p.Err(); err != nil {
+		return err
+	}
+	return addErr
+}
+
+// Merge adds the classes of a result, e.g. saved as JSON by another
+// Aggregator, as if its events were added with AddEvent.  With more than one
+// worker, call Merge before AddEvent.
+func (a *Aggregator) Merge(res *Result) error {
+	err := a.global.Merge(res.Global)
+	for _, c := range res.Classes {
+		class, haveClass := a.queries[c.Id]
+		if !haveClass {
+			class = NewQueryClassWithOptions(c.Id, c.Fingerprint, a.opt.Examples, a.opt.Stats)
+			a.queries[c.Id] = class
+		}
+		class.Merge(c)
+	}
+	return err
+}
+
+// Finalize finalizes the classes and returns them, sorted by total Query_time,
+// descending.  The Aggregator cannot be used after.
+func (a *Aggregator) Finalize() *Result {
+	if a.queue != nil {
+		close(a.queue)
+		<-a.done
+	}
+
+	classes := make([]*QueryClass, 0, len(a.queries))
+	for _, class := range a.queries {
+		class.Finalize()
+		classes = append(classes, class)
+	}
+	a.global.Finalize(uint64(len(a.queries)))
+	sort.Sort(byQueryTime(classes))
+
+	res := &Result{
+		Global:  a.global,
+		Classes: classes,
+	}
+	return res
+}
+
+// classKeys returns the classes of the event: one per fingerprint by
+// default, else one per combination of the values of the GroupBy attributes.
+func (a *Aggregator) classKeys(e *Event) []classKey {
+	if len(a.opt.GroupBy) == 0 || (len(a.opt.GroupBy) == 1 && a.opt.GroupBy[0] == "fingerprint") {
+		fingerprint := Fingerprint(e.Query)
+		return []classKey{{id: Checksum(fingerprint), fingerprint: fingerprint}}
+	}
+
+	// Cross product of the values of the attributes.
+	combos := [][]string{nil}
+	for _, attr := range a.opt.GroupBy {
+		values := groupByValues(e, attr)
+		if len(values) == 0 {
+			return nil
+		}
+		next := make([][]string, 0, len(combos)*len(values))
+		for _, combo := range combos {
+			for _, v := range values {
+				next = append(next, append(combo[:len(combo):len(combo)], v))
+			}
+		}
+		combos = next
+	}
+
+	keys := make([]classKey, len(combos))
+	for i, combo := range combos {
+		keys[i].id = Checksum(strings.Join(combo, "\x00"))
+		keys[i].attributes = make(map[string]string, len(combo))
+		for j, attr := range a.opt.GroupBy {
+			keys[i].attributes[attr] = combo[j]
+			if attr == "fingerprint" {
+				keys[i].fingerprint = combo[j]
+			}
+		}
+	}
+	return keys
+}
+
+func groupByValues(e *Event, attr string) []string {
+	var v string
+	switch attr {
+	case "fingerprint":
+		v = Fingerprint(e.Query)
+	case "user":
+		v = e.User
+	case "host":
+		v = e.Host
+	case "db":
+		v = e.Db
+	case "tables":
+		return Tables(e.Query)
+	case "admin":
+		if e.Admin {
+			v = e.Query
+		}
+	}
+	if v == "" {
+		return nil
+	}
+	return []string{v}
+}
+
+func (a *Aggregator) addToClasses(e *Event, keys []classKey) {
+	for _, key := range keys {
+		class, haveClass := a.queries[key.id]
+		if !haveClass {
+			class = NewQueryClassWithOptions(key.id, key.fingerprint, a.opt.Examples, a.opt.Stats)
+			class.Attributes = key.attributes
+			if key.fingerprint != "" {
+				// The queries of the class have the same statement.
+				if e.Admin {
+					class.Distill = Distill("administrator command: " + e.Query)
+				} else {
+					st := ParseStatement(e.Query)
+					class.Statement = &st
+					class.Distill = Distill(e.Query)
+				}
+			}
+			a.queries[key.id] = class
+		}
+		class.AddEvent(e)
+	}
+}
+
+type byQueryTime []*QueryClass
+
+func (a byQueryTime) Len() int      { return len(a) }
+func (a byQueryTime) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a byQueryTime) Less(i, j int) bool {
+	ti, tj := queryTime(a[i]), queryTime(a[j])
+	if ti == tj {
+		return a[i].Id < a[j].Id
+	}
+	return ti > tj // descending order
+}
+
+func queryTime(class *QueryClass) float64 {
+	if t, ok := class.Metrics.TimeMetrics["Query_time"]; ok {
+		return t.Sum
+	}
+	return 0
+}
@@ -30,10 +30,14 @@ func (e MixedRateLimitsError) Error() string {
 }
 
 func NewGlobalClass() *GlobalClass {
+	return NewGlobalClassWithOptions(StatsOptions{})
+}
+
+func NewGlobalClassWithOptions(opt StatsOptions) *GlobalClass {
 	class := &GlobalClass{
 		TotalQueries:  0,
 		UniqueQueries: 0,
-		Metrics:       NewEventStats(),
+		Metrics:       NewEventStatsWithOptions(opt),
 	}
 	return class
 }
@@ -58,6 +62,24 @@ func (c *GlobalClass) AddEvent(e *Event) error {
 	return err
 }
 
+// Merge adds the queries of o, e.g. of another log, as if its events were
+// added with AddEvent.  UniqueQueries is not known until the query classes are
+// merged, so call Finalize after merging.
+func (c *GlobalClass) Merge(o *GlobalClass) error {
+	var err error
+	if o.RateType != "" {
+		if c.RateType == "" {
+			c.RateType = o.RateType
+			c.RateLimit = o.RateLimit
+		} else if c.RateType != o.RateType && c.RateLimit != o.RateLimit {
+			err = MixedRateLimitsError{c.RateType, c.RateLimit, o.RateType, o.RateLimit}
+		}
+	}
+	c.TotalQueries += o.TotalQueries
+	c.Metrics.Merge(o.Metrics)
+	return err
+}
+
 func (c *GlobalClass) Finalize(UniqueQueries uint64) {
 	c.UniqueQueries = UniqueQueries
 	c.Metrics.Current()
@@ -69,7 +91,10 @@ func (c *GlobalClass) Finalize(UniqueQueries uint64) {
 
 type QueryClass struct {
 	Id           string
-	Fingerprint  string
+	Fingerprint  string            // empty if not grouped by fingerprint
+	Distill      string            `json:",omitempty"` // summary of the fingerprint, e.g. SELECT t
+	Attributes   map[string]string `json:",omitempty"` // AggregatorOptions.GroupBy values
+	Statement    *Statement        `json:",omitempty"` // verb and tables, if grouped by fingerprint
 	Metrics      *EventStats
 	TotalQueries uint64
 	Example      Example `json:",omitempty"`
@@ -77,16 +102,22 @@ type QueryClass struct {
 }
 
 type Example struct {
-	QueryTime float64
-	Query     string
-	Ts        string `json:",omitempty"`
+	QueryTime     float64
+	Query         string
+	Ts            string `json:",omitempty"`
+	AsSelect      string `json:",omitempty"` // Query converted to a SELECT to EXPLAIN, unless it is a SELECT
+	AsSelectError string `json:",omitempty"` // why Query cannot be converted to a SELECT
 }
 
 func NewQueryClass(classId string, fingerprint string, example bool) *QueryClass {
+	return NewQueryClassWithOptions(classId, fingerprint, example, StatsOptions{})
+}
+
+func NewQueryClassWithOptions(classId string, fingerprint string, example bool, opt StatsOptions) *QueryClass {
 	class := &QueryClass{
 		Id:           classId,
 		Fingerprint:  fingerprint,
-		Metrics:      NewEventStats(),
+		Metrics:      NewEventStatsWithOptions(opt),
 		TotalQueries: 0,
 		example:      example,
 	}
@@ -116,6 +147,34 @@ func (c *QueryClass) AddEvent(e *Event) {
 	}
 }
 
+// Merge adds the queries of o, a class with the same Id, e.g. from another
+// log, as if its events were added with AddEvent: the example is the one with
+// the greatest Query_time.  Call Finalize after merging.
+func (c *QueryClass) Merge(o *QueryClass) {
+	c.TotalQueries += o.TotalQueries
+	c.Metrics.Merge(o.Metrics)
+	if c.Attributes == nil {
+		c.Attributes = o.Attributes
+	}
+	if c.Statement == nil {
+		c.Statement = o.Statement
+	}
+	if c.Distill == "" {
+		c.Distill = o.Distill
+	}
+	if c.example && o.Example.Query != "" && o.Example.QueryTime > c.Example.QueryTime {
+		c.Example = o.Example
+	}
+}
+
 func (c *QueryClass) Finalize() {
 	c.Metrics.Current()
+	if c.example && c.Example.Query != "" {
+		c.Example.AsSelect, c.Example.AsSelectError = "", ""
+		if sel, err := ConvertToSelect(c.Example.Query); err != nil {
+			c.Example.AsSelectError = err.Error()
+		} else if sel != c.Example.Query {
+			c.Example.AsSelect = sel
+		}
+	}
 }
@@ -0,0 +1,140 @@
+package log
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ConvertToSelect returns a SELECT that reads the same rows as the query, so
+// it can be EXPLAINed by MySQL before 5.6, which can only EXPLAIN SELECT:
+//
+//	UPDATE t1 JOIN t2 ON ... SET a = 1 WHERE ... ORDER BY ... LIMIT ...
+//	=> SELECT a = 1 FROM t1 JOIN t2 ON ... WHERE ... ORDER BY ... LIMIT ...
+//
+//	DELETE t1 FROM t1 JOIN t2 ON ... WHERE ...
+//	=> SELECT * FROM t1 JOIN t2 ON ... WHERE ...
+//
+//	INSERT INTO t1 SELECT ... ON DUPLICATE KEY UPDATE ...
+//	=> SELECT ...
+//
+// A SELECT is returned as is.  It returns an error if the query cannot be
+// converted, e.g. INSERT ... VALUES or DDL.
+func ConvertToSelect(query string) (string, error) {
+	p := &statementParser{tokens: tokenizeSQL(query)}
+	i := 0
+	for i < len(p.tokens) && isPunct(p.tokens[i], "(") {
+		i++
+	}
+	verb := p.word(i)
+	if verb == "" {
+		return "", fmt.Errorf("cannot convert query to SELECT: no statement")
+	}
+	i++
+
+	var sel string
+	switch verb {
+	case "select":
+		return query, nil
+	case "update":
+		i = p.skipModifiers(i)
+		set := p.find(i, "set")
+		if set == len(p.tokens) {
+			return "", fmt.Errorf("cannot convert UPDATE to SELECT: no SET")
+		}
+		where := p.findClause(set + 1)
+		sel = "SELECT " + p.text(query, set+1, where) + " FROM " + p.text(query, i, set) + p.tail(query, where)
+	case "delete":
+		i = p.skipModifiers(i)
+		from := p.find(i, "from")
+		if from == len(p.tokens) {
+			return "", fmt.Errorf("cannot convert DELETE to SELECT: no FROM")
+		}
+		refs := from + 1
+		if from == i {
+			// DELETE FROM t1 USING t1 JOIN t2, else USING is of a join
+			if using := p.find(refs, "using"); using < p.findClause(refs) {
+				refs = using + 1
+			}
+		}
+		where := p.findClause(refs)
+		sel = "SELECT * FROM " + p.text(query, refs, where) + p.tail(query, where)
+	case "insert", "replace":
+		// INSERT INTO t [PARTITION (p)] [(columns)] SELECT, not a SELECT
+		// in VALUES, e.g. VALUES ((SELECT ...)).
+		_, start, ok := p.tableRef(p.skipModifiers(i))
+		if ok && p.word(start) == "partition" && start+1 < len(p.tokens) && isPunct(p.tokens[start+1], "(") {
+			start = closingParen(p.tokens, start+1) + 1
+		}
+		if ok && start < len(p.tokens) && isPunct(p.tokens[start], "(") && p.word(start+1) != "select" {
+			start = closingParen(p.tokens, start) + 1
+		}
+		if start < len(p.tokens) && isPunct(p.tokens[start], "(") {
+			start++ // (SELECT ...)
+		}
+		if !ok || p.word(start) != "select" {
+			return "", fmt.Errorf("cannot convert %s without SELECT to SELECT", strings.ToUpper(verb))
+		}
+		end := len(p.tokens)
+		if isPunct(p.tokens[start-1], "(") {
+			// INSERT INTO t (SELECT ...)
+			end = closingParen(p.tokens, start-1)
+		} else if dup := p.find(start, "on"); dup+1 < len(p.tokens) && p.word(dup+1) == "duplicate" {
+			end = dup
+		}
+		sel = p.text(query, start, end)
+	default:
+		return "", fmt.Errorf("cannot convert %s to SELECT", strings.ToUpper(verb))
+	}
+	return sel, nil
+}
+
+// find returns the index of the word at or after tokens[i] not in
+// parentheses, or len(tokens) if there is none.
+func (p *statementParser) find(i int, word string) int {
+	for ; i < len(p.tokens); i++ {
+		if isPunct(p.tokens[i], "(") {
+			i = closingParen(p.tokens, i)
+		} else if p.word(i) == word {
+			return i
+		}
+	}
+	return len(p.tokens)
+}
+
+// findClause returns the index of the WHERE, ORDER BY or LIMIT at or after
+// tokens[i] not in parentheses, or len(tokens) if there is none.
+func (p *statementParser) findClause(i int) int {
+	for ; i < len(p.tokens); i++ {
+		if isPunct(p.tokens[i], "(") {
+			i = closingParen(p.tokens, i)
+			continue
+		}
+		switch p.word(i) {
+		case "where", "order", "limit":
+			return i
+		}
+	}
+	return len(p.tokens)
+}
+
+// text returns the query from tokens[i] to tokens[j], not including
+// tokens[j], as in the query but without leading and trailing space.
+func (p *statementParser) text(query string, i, j int) string {
+	if i >= j {
+		return ""
+	}
+	end := len(query)
+	if j < len(p.tokens) {
+		end = p.tokens[j].pos
+	}
+	return strings.TrimSpace(strings.TrimRight(strings.TrimSpace(query[p.tokens[i].pos:end]), ";"))
+}
+
+// tail returns the query from tokens[i], e.g. WHERE ..., after a space, or ""
+// if i is the end.
+func (p *statementParser) tail(query string, i int) string {
+	if i >= len(p.tokens) {
+		return ""
+	}
+	return " " + p.text(query, i, len(p.tokens))
+}
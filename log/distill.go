@@ -0,0 +1,72 @@
+package log
+
+import (
+	"strings"
+)
+
+// Words of SHOW statements that are not what is shown.
+var showModifiers = map[string]bool{
+	"global": true, "session": true, "full": true, "extended": true,
+}
+
+// Words that end what a SHOW statement shows, e.g. SHOW TABLES FROM db.
+var showEnd = map[string]bool{
+	"from": true, "in": true, "like": true, "where": true, "for": true, "limit": true,
+}
+
+// Distill returns a one-line summary of the query, like pt-query-digest: the
+// statement verb in upper case and the tables, e.g. SELECT orders customers.
+// DDL has the object, e.g. ALTER TABLE t; INSERT, REPLACE and CREATE of a
+// select are INSERT SELECT, etc.; SHOW has what is shown, e.g. SHOW STATUS;
+// administrator commands are ADMIN and the command, e.g. ADMIN PING; and
+// stored procedure calls are CALL and the procedure.
+func Distill(query string) string {
+	if adminCmdRe.MatchString(query) {
+		return "ADMIN " + strings.ToUpper(strings.TrimSpace(adminCmdRe.ReplaceAllLiteralString(query, "")))
+	} else if m := storedProcRe.FindStringSubmatch(query); m != nil {
+		return "CALL " + strings.TrimSpace(m[1][len("call"):])
+	}
+
+	st := ParseStatement(query)
+	if st.Verb == "" {
+		return ""
+	}
+	words := []string{st.Verb}
+	p := &statementParser{tokens: withoutVersionComments(tokenizeSQL(query))}
+	first := 0
+	for first < len(p.tokens) && isPunct(p.tokens[first], "(") {
+		first++
+	}
+
+	switch st.Verb {
+	case "CREATE", "ALTER", "DROP", "RENAME":
+		for i := first + 1; i < len(p.tokens); i++ {
+			if w := p.word(i); ddlObjects[w] {
+				words = append(words, strings.ToUpper(w))
+				break
+			}
+		}
+	case "SHOW":
+		for i := first + 1; i < len(p.tokens) && len(words) < 3; i++ {
+			w := p.word(i)
+			if w == "" || showEnd[w] {
+				break
+			}
+			if !showModifiers[w] {
+				words = append(words, strings.ToUpper(w))
+			}
+		}
+	}
+	switch st.Verb {
+	case "INSERT", "REPLACE", "CREATE":
+		for i := first + 1; i < len(p.tokens); i++ {
+			if p.word(i) == "select" {
+				words = append(words, "SELECT")
+				break
+			}
+		}
+	}
+
+	words = append(words, unique(append(st.Written, st.Read...))...)
+	return strings.Join(words, " ")
+}
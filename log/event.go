@@ -1,41 +1,26 @@
 package log
 
 import (
+	"bytes"
 	"crypto/md5"
 	"fmt"
 	"io"
 	"regexp"
 	"strings"
-	"github.com/glenn-brown/golang-pkg-pcre/src/pkg/pcre"
 )
 
-var spaceRe *regexp.Regexp = regexp.MustCompile(`\s+`)
-var nullRe *regexp.Regexp = regexp.MustCompile(`\bnull\b`)
-var limitRe *regexp.Regexp = regexp.MustCompile(`\blimit \?(?:, ?\?| offset \?)?`)
-var escapedQuoteRe *regexp.Regexp = regexp.MustCompile(`\\["']`)
-//var doubleQuotedValRe *regexp.Regexp = regexp.MustCompile(`".*?"`)
-var doubleQuotedValRe pcre.Regexp = pcre.MustCompile(`".*?"`,0)
-var singleQuotedValRe *regexp.Regexp = regexp.MustCompile(`'.*?'`)
-var number1Re *regexp.Regexp = regexp.MustCompile(`\b[0-9+-][0-9a-f.xb+-]*|[xb.+-]\?`)
-var number2Re *regexp.Regexp = regexp.MustCompile(`[xb.+-]\?`)
-var valueListRe *regexp.Regexp = regexp.MustCompile(`\b(in|values?)(?:[\s,]*\([\s?,]*\))+`)
-var multiLineCommentRe *regexp.Regexp = regexp.MustCompile(`(?sm)/\*[^!].*?\*/`)
-var orderByAscRe *regexp.Regexp = regexp.MustCompile(`(?i)order by (\S+) asc\b`)
-
-// Go re doesn't support ?=, but I don't think slow logs can have -- comments,
-// so we don't need this for now
-//var oneLineCommentRe *regexp.Regexp = regexp.MustCompile(`(?:--|#)[^'"\r\n]*(?=[\r\n]|\z)`)
-var oneLineHashCommentRe *regexp.Regexp = regexp.MustCompile(`#[^'"\r\n]*([\r\n]|\z)`)
-var useDbRe *regexp.Regexp = regexp.MustCompile(`\Ause .+\z`)
-var unionRe *regexp.Regexp = regexp.MustCompile(`\b(select\s.*?)(?:(\sunion(?:\sall)?)\s$1)+`)
 var adminCmdRe *regexp.Regexp = regexp.MustCompile(`\Aadministrator command: `)
 var storedProcRe *regexp.Regexp = regexp.MustCompile(`(?i)\A\s*(call\s+\S+)\(`)
+var escapedQuoteReplacer = strings.NewReplacer(`\'`, "", `\"`, "")
 
 type Event struct {
 	Offset        uint64 // byte offset in log file, start of event
+	EndOffset     uint64 // byte offset in log file, end of event: resume parsing after it here
 	Ts            string // if present in log file, often times not
+	Timestamp     int64  // Unix time of SET timestamp in slow log or binlog, else 0
 	Admin         bool   // Query is admin command not SQL query
 	Query         string // SQL query or admin command
+	Command       string // general log command, e.g. Query or Connect
 	User          string
 	Host          string
 	Db            string
@@ -44,6 +29,7 @@ type Event struct {
 	TimeMetrics   map[string]float32 // *_time and *_wait metrics
 	NumberMetrics map[string]uint64  // most metrics
 	BoolMetrics   map[string]bool    // yes/no metrics
+	Meta          map[string]uint64  `json:",omitempty"` // ids, e.g. Thread_id, that are not aggregated like metrics
 }
 
 func NewEvent() *Event {
@@ -54,48 +40,257 @@ func NewEvent() *Event {
 	return event
 }
 
+// StripComments removes the comments from the query, except /*! version
+// comments because MySQL executes them.
 func StripComments(q string) string {
-	// @todo See comment above
-	// q = oneLineCommentRe.ReplaceAllString(q, "")
-	q = oneLineHashCommentRe.ReplaceAllString(q, "")
-	q = multiLineCommentRe.ReplaceAllString(q, "")
-	return q
+	var b bytes.Buffer
+	for i := 0; i < len(q); {
+		j := i + 1
+		switch q[i] {
+		case '\'', '"':
+			j = stringEnd(q, i)
+		case '`':
+			j = quotedEnd(q, i)
+		default:
+			if n := commentLen(q, i); n > 0 {
+				i += n
+				continue
+			}
+		}
+		b.WriteString(q[i:j])
+		i = j
+	}
+	return b.String()
 }
 
+// Fingerprint returns the query with its values replaced by ?, lowercase, and
+// without comments and extra whitespace, so queries that differ only in their
+// values have the same fingerprint, like pt-query-digest.  Lists of values are
+// (?+), LIMIT is limit ?, ASC (the default order) is removed, and repeated
+// UNIONs of the same select are select ... /*repeat union*/.
 func Fingerprint(q string) string {
-	// First check for special case that shouldn't need any further processing.
-	if useDbRe.MatchString(q) {
-		return "use ?"
-	} else if adminCmdRe.MatchString(q) {
+	// First check for special cases that shouldn't need any further processing.
+	if adminCmdRe.MatchString(q) {
 		return q
-	} else if storedProcRe.MatchString(q) {
-		m := storedProcRe.FindStringSubmatch(q)
+	} else if m := storedProcRe.FindStringSubmatch(q); m != nil {
 		return strings.ToLower(m[1])
 	}
 
-	// Strip the fluff.
-	q = StripComments(q)
-	q = strings.TrimSpace(q)
-
-	// Do case-insensitive replacements
-	q = spaceRe.ReplaceAllLiteralString(q, " ")
-	q = escapedQuoteRe.ReplaceAllLiteralString(q, "")
-	//q = doubleQuotedValRe.ReplaceAllLiteralString(q, "?")
-	q = string(doubleQuotedValRe.ReplaceAll([]byte(q), []byte("?"),0))
-	q = singleQuotedValRe.ReplaceAllLiteralString(q, "?")
-	// @todo Are 2 passes really necessary?
-	q = number1Re.ReplaceAllLiteralString(q, "?")
-	//q = number2Re.ReplaceAllLiteralString(q, "?")
-
-	// Lowercase the query then do case-sensitive replacements
-	q = strings.ToLower(q)
-	q = valueListRe.ReplaceAllString(q, "$1(?+)")       // in|value (...) -> in|value (?+)
-	q = unionRe.ReplaceAllString(q, "$1 /*repeat$2*/")  // @todo
-	q = nullRe.ReplaceAllString(q, "?")                 // null -> ?
-	q = limitRe.ReplaceAllString(q, "limit ?")          // limit N -> limit ?
-	q = orderByAscRe.ReplaceAllString(q, "order by $1") // order by col asc -> order by col
-
-	return q
+	// Remove escaped quotes first, as the regexes did, so the fingerprints
+	// are the same as theirs, even of a string ending in an escaped
+	// backslash: '\\' is the unterminated quote '\.
+	tokens := tokenizeSQL(escapedQuoteReplacer.Replace(q))
+	if len(tokens) > 0 && tokens[0].kind == sqlWord && strings.EqualFold(tokens[0].text, "use") {
+		return "use ?"
+	}
+
+	// Replace values and lowercase the rest.
+	values := make([]sqlToken, 0, len(tokens))
+	for _, t := range tokens {
+		switch t.kind {
+		case sqlString, sqlNumber:
+			t.kind, t.text = sqlPunct, "?"
+		case sqlWord, sqlQuoted:
+			t.text = strings.ToLower(t.text)
+		}
+		if t.kind == sqlWord {
+			if t.text == "null" {
+				t.kind, t.text = sqlPunct, "?"
+			} else if t.text == "asc" {
+				continue
+			}
+		}
+		values = append(values, t)
+	}
+
+	// Collapse lists of values and LIMIT.
+	fp := make([]sqlToken, 0, len(values))
+	for i := 0; i < len(values); i++ {
+		t := values[i]
+		fp = append(fp, t)
+		if t.kind != sqlWord {
+			continue
+		}
+		switch t.text {
+		case "in", "value", "values":
+			if j := valueListEnd(values, i+1); j > i+1 {
+				fp = append(fp, sqlToken{kind: sqlPunct, text: "(?+)"})
+				i = j - 1
+			}
+		case "limit":
+			if j := limitEnd(values, i+1); j > i+1 {
+				fp = append(fp, sqlToken{kind: sqlPunct, text: "?", space: true})
+				i = j - 1
+			}
+		}
+	}
+	fp = collapseUnions(fp)
+
+	var b bytes.Buffer
+	for i, t := range fp {
+		if i > 0 && t.space {
+			b.WriteByte(' ')
+		}
+		b.WriteString(t.text)
+	}
+	return b.String()
+}
+
+// valueListEnd returns the index after the lists of values at tokens[i], like
+// (?, ?), (?, ?), or i if there are none.
+func valueListEnd(tokens []sqlToken, i int) int {
+	end := i
+	for {
+		j := end
+		for j < len(tokens) && isPunct(tokens[j], ",") {
+			j++
+		}
+		if j == len(tokens) || !isPunct(tokens[j], "(") {
+			return end
+		}
+		for j++; j < len(tokens) && (isPunct(tokens[j], "?") || isPunct(tokens[j], ",")); j++ {
+		}
+		if j == len(tokens) || !isPunct(tokens[j], ")") {
+			return end
+		}
+		end = j + 1
+	}
+}
+
+// limitEnd returns the index after the LIMIT values at tokens[i]: ?, ?, ? or
+// ? offset ?, or i if there are none.
+func limitEnd(tokens []sqlToken, i int) int {
+	if i == len(tokens) || !isPunct(tokens[i], "?") {
+		return i
+	}
+	if i+2 < len(tokens) && isPunct(tokens[i+2], "?") &&
+		(isPunct(tokens[i+1], ",") || (tokens[i+1].kind == sqlWord && tokens[i+1].text == "offset")) {
+		return i + 3
+	}
+	return i + 1
+}
+
+// collapseUnions replaces repeated UNIONs of the same select, e.g. select ?
+// union select ? union select ?, with select ? /*repeat union*/, in and out
+// of parentheses.
+func collapseUnions(tokens []sqlToken) []sqlToken {
+	out := make([]sqlToken, 0, len(tokens))
+	for i := 0; i < len(tokens); i++ {
+		out = append(out, tokens[i])
+		if isPunct(tokens[i], "(") {
+			j := closingParen(tokens, i)
+			out = append(out, collapseUnions(tokens[i+1:j])...)
+			i = j - 1
+		}
+	}
+
+	// Split into the selects and the unions between them.
+	var selects, unions [][]sqlToken
+	depth, start := 0, 0
+	for i := 0; i < len(out); i++ {
+		t := out[i]
+		if isPunct(t, "(") {
+			depth++
+		} else if isPunct(t, ")") {
+			depth--
+		} else if depth == 0 && t.kind == sqlWord && t.text == "union" {
+			end := i + 1
+			if end < len(out) && out[end].kind == sqlWord && (out[end].text == "all" || out[end].text == "distinct") {
+				end++
+			}
+			selects = append(selects, out[start:i])
+			unions = append(unions, out[i:end])
+			start = end
+			i = end - 1
+		}
+	}
+	if len(unions) == 0 {
+		return out
+	}
+	selects = append(selects, out[start:])
+
+	collapsed := append([]sqlToken{}, selects[0]...)
+	prev := lastSelect(selects[0])
+	var repeat []sqlToken // union of the current repeat
+	for i, union := range unions {
+		next := selects[i+1]
+		if sameTokens(prev, next) && (repeat == nil || sameTokens(repeat, union)) {
+			repeat = union
+			continue
+		}
+		if repeat != nil {
+			collapsed = append(collapsed, repeatComment(repeat))
+			repeat = nil
+		}
+		collapsed = append(collapsed, union...)
+		collapsed = append(collapsed, next...)
+		prev = next
+	}
+	if repeat != nil {
+		collapsed = append(collapsed, repeatComment(repeat))
+	}
+	return collapsed
+}
+
+// closingParen returns the index of the parenthesis that closes tokens[i], or
+// len(tokens) if it is not closed.
+func closingParen(tokens []sqlToken, i int) int {
+	depth := 0
+	for j := i; j < len(tokens); j++ {
+		if isPunct(tokens[j], "(") {
+			depth++
+		} else if isPunct(tokens[j], ")") {
+			if depth--; depth == 0 {
+				return j
+			}
+		}
+	}
+	return len(tokens)
+}
+
+// lastSelect returns the tokens from the last select not in parentheses, e.g.
+// select ? of insert into t select ?, or nil if there is none.
+func lastSelect(tokens []sqlToken) []sqlToken {
+	depth, last := 0, -1
+	for i, t := range tokens {
+		if isPunct(t, "(") {
+			depth++
+		} else if isPunct(t, ")") {
+			depth--
+		} else if depth == 0 && t.kind == sqlWord && t.text == "select" {
+			last = i
+		}
+	}
+	if last < 0 {
+		return nil
+	}
+	return tokens[last:]
+}
+
+// sameTokens returns true if a and b are the same, ignoring the space before
+// the first token.
+func sameTokens(a, b []sqlToken) bool {
+	if len(a) == 0 || len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].text != b[i].text || (i > 0 && a[i].space != b[i].space) {
+			return false
+		}
+	}
+	return true
+}
+
+func repeatComment(union []sqlToken) sqlToken {
+	words := make([]string, len(union))
+	for i, t := range union {
+		words[i] = t.text
+	}
+	return sqlToken{kind: sqlPunct, text: "/*repeat " + strings.Join(words, " ") + "*/", space: true}
+}
+
+func isPunct(t sqlToken, text string) bool {
+	return t.kind == sqlPunct && t.text == text
 }
 
 func Checksum(className string) string {
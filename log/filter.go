@@ -0,0 +1,415 @@
+package log
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// A Filter is a boolean expression of the fields and metrics of an event,
+// like pt-query-digest --filter but simpler, e.g.:
+//
+//	Query_time > 1 and Db = "orders" and Full_scan = true and User != "replication"
+//
+// A comparison is a field or metric, an operator and a value.  Fields are in
+// any case, but metrics are as in the log, e.g. Query_time.  The fields
+// User, Host, Db, Query, Ts, Command and RateType are compared with strings
+// using =, != or =~ and !~ for regular expressions.  Offset, Timestamp,
+// RateLimit, TimeMetrics, NumberMetrics and Meta ids, e.g. Thread_id, are
+// compared with numbers using =, !=, <, <=, > or >=; times are seconds, or a
+// number with the unit s, ms or us, e.g. Query_time > 100ms.  Admin and BoolMetrics are compared with true
+// or false (or yes or no) using = or !=.  Comparisons are combined with and,
+// or, not and parentheses.  A comparison of a metric that the event does not
+// have is false.
+type Filter struct {
+	expr string
+	root filterNode
+}
+
+// NewFilter parses the expression, and returns an error if it is invalid.
+func NewFilter(expr string) (*Filter, error) {
+	p := &filterParser{expr: expr}
+	if err := p.lex(); err != nil {
+		return nil, err
+	}
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tokEnd {
+		return nil, p.errorf(t, "unexpected %s", t.text)
+	}
+	f := &Filter{
+		expr: expr,
+		root: root,
+	}
+	return f, nil
+}
+
+// Match returns true if the event matches the filter.
+func (f *Filter) Match(e *Event) bool {
+	return f.root.match(e)
+}
+
+func (f *Filter) String() string {
+	return f.expr
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Expression tree
+/////////////////////////////////////////////////////////////////////////////
+
+type filterNode interface {
+	match(e *Event) bool
+}
+
+type andNode struct{ l, r filterNode }
+type orNode struct{ l, r filterNode }
+type notNode struct{ n filterNode }
+
+func (n andNode) match(e *Event) bool { return n.l.match(e) && n.r.match(e) }
+func (n orNode) match(e *Event) bool  { return n.l.match(e) || n.r.match(e) }
+func (n notNode) match(e *Event) bool { return !n.n.match(e) }
+
+var filterStringFields = map[string]func(e *Event) string{
+	"user":     func(e *Event) string { return e.User },
+	"host":     func(e *Event) string { return e.Host },
+	"db":       func(e *Event) string { return e.Db },
+	"query":    func(e *Event) string { return e.Query },
+	"ts":       func(e *Event) string { return e.Ts },
+	"command":  func(e *Event) string { return e.Command },
+	"ratetype": func(e *Event) string { return e.RateType },
+}
+
+var filterNumberFields = map[string]func(e *Event) float64{
+	"offset":    func(e *Event) float64 { return float64(e.Offset) },
+	"timestamp": func(e *Event) float64 { return float64(e.Timestamp) },
+	"ratelimit": func(e *Event) float64 { return float64(e.RateLimit) },
+}
+
+type stringCmp struct {
+	field func(e *Event) string
+	op    string
+	val   string
+	re    *regexp.Regexp // =~ and !~
+}
+
+func (n stringCmp) match(e *Event) bool {
+	v := n.field(e)
+	switch n.op {
+	case "=":
+		return v == n.val
+	case "!=":
+		return v != n.val
+	case "=~":
+		return n.re.MatchString(v)
+	default: // !~
+		return !n.re.MatchString(v)
+	}
+}
+
+type numberCmp struct {
+	field  func(e *Event) float64 // nil for a metric
+	metric string
+	op     string
+	val    float64
+}
+
+func (n numberCmp) match(e *Event) bool {
+	var v, val float64
+	if n.field != nil {
+		v, val = n.field(e), n.val
+	} else if t, ok := e.TimeMetrics[n.metric]; ok {
+		// Time metrics are float32, so compare the value as a float32, else
+		// Query_time = 0.1 would never be true.
+		v, val = float64(t), float64(float32(n.val))
+	} else if u, ok := e.NumberMetrics[n.metric]; ok {
+		v, val = float64(u), n.val
+	} else if u, ok := e.Meta[n.metric]; ok {
+		v, val = float64(u), n.val
+	} else {
+		return false
+	}
+	switch n.op {
+	case "=":
+		return v == val
+	case "!=":
+		return v != val
+	case "<":
+		return v < val
+	case "<=":
+		return v <= val
+	case ">":
+		return v > val
+	default: // >=
+		return v >= val
+	}
+}
+
+type boolCmp struct {
+	metric string // empty for Admin
+	op     string
+	val    bool
+}
+
+func (n boolCmp) match(e *Event) bool {
+	v := e.Admin
+	if n.metric != "" {
+		var ok bool
+		if v, ok = e.BoolMetrics[n.metric]; !ok {
+			return false
+		}
+	}
+	if n.op == "=" {
+		return v == n.val
+	}
+	return v != n.val
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Parser
+/////////////////////////////////////////////////////////////////////////////
+
+const (
+	tokEnd = iota
+	tokIdent
+	tokString
+	tokNumber
+	tokOp
+	tokLParen
+	tokRParen
+)
+
+type filterToken struct {
+	kind int
+	text string  // as in the expression, or the unquoted string
+	num  float64 // of tokNumber, in seconds if it has a unit
+	pos  int
+}
+
+type filterParser struct {
+	expr   string
+	tokens []filterToken
+	i      int
+}
+
+var filterUnits = map[string]float64{"": 1, "s": 1, "ms": 1e-3, "us": 1e-6}
+
+func (p *filterParser) lex() error {
+	s := p.expr
+	for i := 0; i < len(s); {
+		c := rune(s[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case c == '(' || c == ')':
+			kind := tokLParen
+			if c == ')' {
+				kind = tokRParen
+			}
+			p.tokens = append(p.tokens, filterToken{kind: kind, text: string(c), pos: i})
+			i++
+		case strings.ContainsRune("=!<>", c):
+			op := string(c)
+			if i+1 < len(s) && strings.ContainsRune("=~", rune(s[i+1])) {
+				op += string(s[i+1])
+			}
+			n := len(op)
+			switch op {
+			case "=", "!=", "<", "<=", ">", ">=", "=~", "!~":
+			case "==":
+				op = "="
+			default:
+				return fmt.Errorf("invalid filter: invalid operator %s at offset %d", op, i)
+			}
+			p.tokens = append(p.tokens, filterToken{kind: tokOp, text: op, pos: i})
+			i += n
+		case c == '"' || c == '\'':
+			var val []byte
+			j := i + 1
+			for ; j < len(s) && rune(s[j]) != c; j++ {
+				if s[j] == '\\' && j+1 < len(s) {
+					j++
+				}
+				val = append(val, s[j])
+			}
+			if j == len(s) {
+				return fmt.Errorf("invalid filter: unterminated string at offset %d", i)
+			}
+			p.tokens = append(p.tokens, filterToken{kind: tokString, text: string(val), pos: i})
+			i = j + 1
+		case c == '-' || c == '.' || unicode.IsDigit(c):
+			j := i + 1
+			for j < len(s) && (s[j] == '.' || s[j] == 'e' || unicode.IsDigit(rune(s[j]))) {
+				j++
+			}
+			k := j
+			for k < len(s) && unicode.IsLetter(rune(s[k])) {
+				k++
+			}
+			n, err := strconv.ParseFloat(s[i:j], 64)
+			unit, validUnit := filterUnits[strings.ToLower(s[j:k])]
+			if err != nil || !validUnit {
+				return fmt.Errorf("invalid filter: invalid number %s at offset %d", s[i:k], i)
+			}
+			p.tokens = append(p.tokens, filterToken{kind: tokNumber, text: s[i:k], num: n * unit, pos: i})
+			i = k
+		case c == '_' || unicode.IsLetter(c):
+			j := i + 1
+			for j < len(s) && (s[j] == '_' || unicode.IsLetter(rune(s[j])) || unicode.IsDigit(rune(s[j]))) {
+				j++
+			}
+			p.tokens = append(p.tokens, filterToken{kind: tokIdent, text: s[i:j], pos: i})
+			i = j
+		default:
+			return fmt.Errorf("invalid filter: unexpected %c at offset %d", c, i)
+		}
+	}
+	p.tokens = append(p.tokens, filterToken{kind: tokEnd, text: "end of filter", pos: len(s)})
+	return nil
+}
+
+func (p *filterParser) peek() filterToken {
+	return p.tokens[p.i]
+}
+
+func (p *filterParser) next() filterToken {
+	t := p.tokens[p.i]
+	if t.kind != tokEnd {
+		p.i++
+	}
+	return t
+}
+
+func (p *filterParser) keyword(word string) bool {
+	if t := p.peek(); t.kind == tokIdent && strings.EqualFold(t.text, word) {
+		p.i++
+		return true
+	}
+	return false
+}
+
+func (p *filterParser) errorf(t filterToken, format string, args ...interface{}) error {
+	return fmt.Errorf("invalid filter: %s at offset %d", fmt.Sprintf(format, args...), t.pos)
+}
+
+// or := and ("or" and)*
+func (p *filterParser) parseOr() (filterNode, error) {
+	l, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("or") {
+		r, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		l = orNode{l, r}
+	}
+	return l, nil
+}
+
+// and := not ("and" not)*
+func (p *filterParser) parseAnd() (filterNode, error) {
+	l, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("and") {
+		r, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		l = andNode{l, r}
+	}
+	return l, nil
+}
+
+// not := "not" not | "(" or ")" | comparison
+func (p *filterParser) parseNot() (filterNode, error) {
+	if p.keyword("not") {
+		n, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return notNode{n}, nil
+	}
+	if p.peek().kind == tokLParen {
+		p.next()
+		n, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if t := p.next(); t.kind != tokRParen {
+			return nil, p.errorf(t, "expected ) but got %s", t.text)
+		}
+		return n, nil
+	}
+	return p.parseComparison()
+}
+
+// comparison := ident op value
+func (p *filterParser) parseComparison() (filterNode, error) {
+	ident := p.next()
+	if ident.kind != tokIdent {
+		return nil, p.errorf(ident, "expected a field or metric but got %s", ident.text)
+	}
+	op := p.next()
+	if op.kind != tokOp {
+		return nil, p.errorf(op, "expected an operator after %s but got %s", ident.text, op.text)
+	}
+	val := p.next()
+	name := strings.ToLower(ident.text)
+
+	if field, ok := filterStringFields[name]; ok {
+		if val.kind != tokString {
+			return nil, p.errorf(val, "expected a string to compare with %s but got %s", ident.text, val.text)
+		}
+		n := stringCmp{field: field, op: op.text, val: val.text}
+		switch op.text {
+		case "=", "!=":
+		case "=~", "!~":
+			re, err := regexp.Compile(val.text)
+			if err != nil {
+				return nil, p.errorf(val, "%s", err)
+			}
+			n.re = re
+		default:
+			return nil, p.errorf(op, "cannot compare %s with %s", ident.text, op.text)
+		}
+		return n, nil
+	}
+
+	switch val.kind {
+	case tokNumber:
+		switch op.text {
+		case "=~", "!~":
+			return nil, p.errorf(op, "cannot compare %s with %s", ident.text, op.text)
+		}
+		n := numberCmp{field: filterNumberFields[name], metric: ident.text, op: op.text, val: val.num}
+		return n, nil
+	case tokIdent:
+		var b bool
+		switch strings.ToLower(val.text) {
+		case "true", "yes":
+			b = true
+		case "false", "no":
+			b = false
+		default:
+			return nil, p.errorf(val, "expected true or false but got %s", val.text)
+		}
+		if op.text != "=" && op.text != "!=" {
+			return nil, p.errorf(op, "cannot compare %s with %s", ident.text, op.text)
+		}
+		n := boolCmp{metric: ident.text, op: op.text, val: b}
+		if name == "admin" {
+			n.metric = ""
+		}
+		return n, nil
+	case tokString:
+		return nil, p.errorf(val, "%s is not a string field", ident.text)
+	}
+	return nil, p.errorf(val, "expected a value after %s %s but got %s", ident.text, op.text, val.text)
+}
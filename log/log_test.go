@@ -1,12 +1,20 @@
 package log_test
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
 	"github.com/percona/mysql-log-parser/log"
 	"github.com/percona/mysql-log-parser/log/parser"
 	"github.com/percona/mysql-log-parser/test"
 	. "github.com/percona/mysql-log-parser/test"
 	. "launchpad.net/gocheck"
+	"math"
+	"os"
+	"strings"
 	"testing"
+	"time"
 )
 
 // Hook gocheck into the "go test" runner.
@@ -130,6 +138,16 @@ func (s *FingerprintTestSuite) TestFingerprintBasic(t *C) {
 		"select ?, ?, ? from foo where a = ? or b=? or c=?",
 	)
 
+	// Subtraction is not a sign, with or without spaces
+	for q, fp := range map[string]string{
+		"select a -1 from t":  "select a -? from t",
+		"select a - 1 from t": "select a - ? from t",
+		"select a-1 from t":   "select a-? from t",
+		"select -1, a - -1":   "select ?, a - ?",
+	} {
+		t.Check(log.Fingerprint(q), Equals, fp, Commentf(q))
+	}
+
 	// Hex/bit
 	q = "select 0x0, x'123', 0b1010, b'10101' from foo"
 	t.Check(
@@ -237,6 +255,105 @@ func (s *FingerprintTestSuite) TestFingerprintBasic(t *C) {
 	)
 }
 
+// The fingerprints of the queries in the slow logs are the same as with the
+// regexes and PCRE, before Fingerprint tokenized queries, except that
+// INSERT INTO foo VALUES (NULL, 3) in slow011.log was "insert into foo values
+// (?, ?)" because NULL was replaced after value lists were collapsed.
+func (s *FingerprintTestSuite) TestFingerprintLogs(t *C) {
+	for file, expect := range map[string][]string{
+		"slow001.log": {
+			"select sleep(?) from n",
+			"select sleep(?) from test.n",
+		},
+		"slow002.log": {
+			"begin",
+			"update db2.tuningdetail_21_265507 n inner join db1.gonzo a using(gonzo) set n.column1 = a.column1, n.word3 = a.word3",
+			"insert into db3.vendor11gonzo (makef, bizzle) values(?+)",
+			"update db4.vab3concept1upload set vab3concept1id = ? where vab3concept1upload=?",
+			"insert into db1.conch (word3, vid83) values(?+)",
+			"update foo.bar set biz = ?",
+			"update bizzle.bat set boop=? where fillze=?",
+		},
+		"slow003.log": {
+			"begin",
+		},
+		"slow004.log": {
+			"select ?_13_foo from (select ?oo from ?_bar) as ?z",
+		},
+		"slow005.log": {
+			"foo bar ? as counter baz",
+		},
+		"slow006.log": {
+			"select col from foo_tbl",
+			"select col from bar_tbl",
+		},
+		"slow007.log": {
+			"select fruit from trees",
+		},
+		"slow008.log": {
+			"administrator command: Quit",
+			"set names utf8",
+			"select min(id),max(id) from tbl",
+		},
+		"slow009.log": {
+			"administrator command: Refresh",
+			"administrator command: Quit",
+		},
+		"slow010.log": {
+			"select c from t where id=?",
+		},
+		"slow011.log": {
+			"select foo from bar where id=?",
+			"insert into foo values(?+)",
+		},
+		"slow012.log": {
+			"select * from mysql.user",
+			"administrator command: Quit",
+			"select @@max_allowed_packet",
+		},
+		"slow013.log": {
+			"select ?,q.* from qcm q into outfile ?",
+			"select count(*) into @discard from `information_schema`.`partitions`",
+		},
+		"slow014.log": {
+			"select * from cache where `cacheid` in(?+)",
+			"select sourcetable, if(f.lastcontent = ?, f.lastupdate, f.lastcontent) as lastactivity, f.totalcount as activity, type.class as type, (f.nodeoptions & ?) as nounsubscribe from node as f inner join contenttype as type on type.contenttypeid = f.contenttypeid inner join subscribed as sd on sd.did = f.nodeid and sd.userid = ? union all select f.name as title, f.userid as keyval, ? as sourcetable, ifnull(f.lastpost, f.joindate) as lastactivity, f.posts as activity, ? as type, ? as nounsubscribe from user as f inner join userlist as ul on ul.relationid = f.userid and ul.userid = ? where ul.type = ? and ul.aq = ? order by title limit ?",
+			"select count(userfing.keyval) as total from (( select f.nodeid as keyval from node as f inner join subscribed as sd on sd.did = f.nodeid and sd.userid = ?) union all ( select f.userid as keyval from user as f inner join userlist as ul on ul.relationid = f.userid and ul.userid = ? where ul.type = ? and ul.aq = ?) ) as userfing",
+			"select u.userid, u.name as name, u.usergroupid as usergroupid, ifnull(u.lastactivity, u.joindate) as lastactivity, ifnull((select userid from userlist as ul2 where ul2.userid = ? and ul2.relationid = u.userid and ul2.type = ? and ul2.aq = ?), ?) as isfollowing, ifnull((select userid from userlist as ul2 where ul2.userid = ? and ul2.relationid = u.userid and ul2.type = ? and ul2.aq = ?), ?) as ispending from user as u inner join userlist as ul on (u.userid = ul.userid and ul.relationid = ?) where ul.type = ? and ul.aq = ? order by name limit ?",
+		},
+		"slow015.log": {
+			"insert into table values(?+)",
+			"select * from t",
+		},
+		"slow016.log": {
+			"show /*!? global */ status",
+		},
+		"slow017.log": {
+			"show /*!? global */ status",
+		},
+		"slow018.log": {
+			"select ?",
+		},
+		"slow019.log": {
+			"select ?",
+		},
+	} {
+		var got []string
+		seen := make(map[string]bool)
+		for _, e := range *testlog.ParseSlowLog(file, parser.Options{}) {
+			q := e.Query
+			if e.Admin {
+				q = "administrator command: " + q
+			}
+			if f := log.Fingerprint(q); !seen[f] {
+				seen[f] = true
+				got = append(got, f)
+			}
+		}
+		t.Check(got, DeepEquals, expect, Commentf(file))
+	}
+}
+
 func (s *FingerprintTestSuite) TestFingerprintValueList(t *C) {
 	var q string
 
@@ -266,8 +383,8 @@ func (s *FingerprintTestSuite) TestFingerprintValueList(t *C) {
 }
 
 /////////////////////////////////////////////////////////////////////////////
-// Skipped test cases for various reasons, mostly becuase Go re is very
-// limited compared to Perl re.
+// Test cases that Go re could not handle, before Fingerprint tokenized
+// queries.
 /////////////////////////////////////////////////////////////////////////////
 
 func (s *FingerprintTestSuite) TestFingerprintOrderBy(t *C) {
@@ -283,32 +400,26 @@ func (s *FingerprintTestSuite) TestFingerprintOrderBy(t *C) {
 	)
 
 	// Remove only ASC from ORDER BY
-	/*
-		q = "select * from t where i=1 order by a, b ASC, d DESC, e asc"
-		t.Check(
-			log.Fingerprint(q),
-			Equals,
-			"select * from t where i=? order by a, b, d desc, e",
-		)
-	*/
+	q = "select * from t where i=1 order by a, b ASC, d DESC, e asc"
+	t.Check(
+		log.Fingerprint(q),
+		Equals,
+		"select * from t where i=? order by a, b, d desc, e",
+	)
 
 	// Remove ASC from spacey ORDER BY
-	/*
-		q = `select * from t where i=1      order            by
-			  a,  b          ASC, d    DESC,
+	q = `select * from t where i=1      order            by
+		  a,  b          ASC, d    DESC,
 
-									 e asc`
-		t.Check(
-			log.Fingerprint(q),
-			Equals,
-			"select * from t where i=? order by a, b, d desc, e",
-		)
-	*/
+								 e asc`
+	t.Check(
+		log.Fingerprint(q),
+		Equals,
+		"select * from t where i=? order by a, b, d desc, e",
+	)
 }
 
 func (s *FingerprintTestSuite) TestFingerprintUnion(t *C) {
-	t.Skip("Fingerprint UNION doesn't work yet")
-
 	var q string
 
 	// union fingerprints together
@@ -333,41 +444,57 @@ func (s *FingerprintTestSuite) TestFingerprintUnion(t *C) {
 	t.Check(
 		log.Fingerprint(q),
 		Equals,
-		`select * from (select ? /*repeat union all*/) as x 
-		  join (select ? /*repeat union*/) as y`,
+		"select * from (select ? /*repeat union all*/) as x join (select ? /*repeat union*/) as y",
+	)
+
+	// Different selects are not repeats
+	q = "insert into t select 1 union select a from t2 union select a from t2"
+	t.Check(
+		log.Fingerprint(q),
+		Equals,
+		"insert into t select ? union select a from t2 /*repeat union*/",
 	)
 }
 
 func (s *FingerprintTestSuite) TestFingerprintOneLineComments(t *C) {
 	var q string
 
-	/*
-
-		// Removes one-line comments in fingerprints
-		q = "select \n--bar\n foo"
-		t.Check(
-			log.Fingerprint(q),
-			Equals,
-			"select foo",
-		)
-
-		// Removes one-line comments in fingerprint without mushing things together
-		q = "select foo--bar\nfoo"
-		t.Check(
-			log.Fingerprint(q),
-			Equals,
-			"select foo foo",
-		)
-
-		// Removes one-line EOL comments in fingerprints
-		q = "select foo -- bar\n"
-		t.Check(
-			log.Fingerprint(q),
-			Equals,
-			"select foo ",
-		)
-
-	*/
+	// Removes one-line comments in fingerprints
+	q = "select \n--bar\n foo"
+	t.Check(
+		log.Fingerprint(q),
+		Equals,
+		"select foo",
+	)
+
+	// Removes one-line comments in fingerprint without mushing things together
+	q = "select foo--bar\nfoo"
+	t.Check(
+		log.Fingerprint(q),
+		Equals,
+		"select foo foo",
+	)
+
+	// Removes one-line EOL comments in fingerprints
+	q = "select foo -- bar\n"
+	t.Check(
+		log.Fingerprint(q),
+		Equals,
+		"select foo",
+	)
+
+	// Removes comments, but not comments in strings
+	q = "select /* c1 */ a, 'b -- #not a comment' from t # c2\n where /*c3*/id=1"
+	t.Check(
+		log.Fingerprint(q),
+		Equals,
+		"select a, ? from t where id=?",
+	)
+	t.Check(
+		log.StripComments(q),
+		Equals,
+		"select  a, 'b -- #not a comment' from t  where id=1",
+	)
 
 	// Removes one-line # hash comments
 	q = "### Channels ###\n\u0009\u0009\u0009\u0009\u0009SELECT sourcetable, IF(f.lastcontent = 0, f.lastupdate, f.lastcontent) AS lastactivity,\n\u0009\u0009\u0009\u0009\u0009f.totalcount AS activity, type.class AS type,\n\u0009\u0009\u0009\u0009\u0009(f.nodeoptions \u0026 512) AS noUnsubscribe\n\u0009\u0009\u0009\u0009\u0009FROM node AS f\n\u0009\u0009\u0009\u0009\u0009INNER JOIN contenttype AS type ON type.contenttypeid = f.contenttypeid \n\n\u0009\u0009\u0009\u0009\u0009INNER JOIN subscribed AS sd ON sd.did = f.nodeid AND sd.userid = 15965\n UNION  ALL \n\n\u0009\u0009\u0009\u0009\u0009### Users ###\n\u0009\u0009\u0009\u0009\u0009SELECT f.name AS title, f.userid AS keyval, 'user' AS sourcetable, IFNULL(f.lastpost, f.joindate) AS lastactivity,\n\u0009\u0009\u0009\u0009\u0009f.posts as activity, 'Member' AS type,\n\u0009\u0009\u0009\u0009\u00090 AS noUnsubscribe\n\u0009\u0009\u0009\u0009\u0009FROM user AS f\n\u0009\u0009\u0009\u0009\u0009INNER JOIN userlist AS ul ON ul.relationid = f.userid AND ul.userid = 15965\n\u0009\u0009\u0009\u0009\u0009WHERE ul.type = 'f' AND ul.aq = 'yes'\n ORDER BY title ASC LIMIT 100"
@@ -378,6 +505,164 @@ func (s *FingerprintTestSuite) TestFingerprintOneLineComments(t *C) {
 	)
 }
 
+func (s *FingerprintTestSuite) TestFingerprintTokens(t *C) {
+	for q, fp := range map[string]string{
+		// Doubled quotes, and quotes of another kind, in strings
+		`select 'it''s', "say ""hi""", 'a"b', "a'b" from t`: "select ?, ?, ?, ? from t",
+		// Backtick identifiers keep values, including quotes and comments
+		"select `a'b`, `c``d`, `#e` from `t 1`": "select `a'b`, `c``d`, `#e` from `t 1`",
+		// Signs are values only if they are not operators
+		"select a-1, a - 1, -1, (-1), a*-1 from t": "select a-?, a - ?, ?, (?), a*? from t",
+		// Hex, bit, national and introduced strings
+		"select X'4D', B'01', N'abc', _utf8'abc' from t": "select ?, ?, ?, _utf8? from t",
+		// Version comments, but not optimizer hints
+		"select /*+ NO_ICP(t) */ /*!50001 STRAIGHT_JOIN */ a from t": "select /*!? straight_join */ a from t",
+		// Placeholders of prepared statements
+		"select a from t where b in (?, ?) limit ?": "select a from t where b in(?+) limit ?",
+		// Lists of values that are not all values
+		"insert into t values (1, now()), (2, now())":   "insert into t values (?, now()), (?, now())",
+		"select a from t where b in (select b from t2)": "select a from t where b in (select b from t2)",
+		// USE in any case
+		"USE `db`": "use ?",
+	} {
+		t.Check(log.Fingerprint(q), Equals, fp, Commentf(q))
+	}
+}
+
+func (s *FingerprintTestSuite) TestTables(t *C) {
+	t.Check(log.Tables("SELECT c FROM t WHERE id=1"), DeepEquals, []string{"t"})
+	t.Check(log.Tables("select * from db1.t1 a, `t2` as b join t3 on a.id=t3.id left join db2.t4 using (id)"), DeepEquals, []string{"db1.t1", "t2", "t3", "db2.t4"})
+	t.Check(log.Tables("select * from (select id from t1) x where id in (select id from t2)"), DeepEquals, []string{"t1", "t2"})
+	t.Check(log.Tables("INSERT INTO t1 (a) SELECT a FROM t2 ON DUPLICATE KEY UPDATE a=1"), DeepEquals, []string{"t1", "t2"})
+	t.Check(log.Tables("update t1 set a=1"), DeepEquals, []string{"t1"})
+	t.Check(log.Tables("ALTER TABLE t1 ADD COLUMN c INT"), DeepEquals, []string{"t1"})
+	t.Check(log.Tables("select 1 from dual"), HasLen, 0)
+	t.Check(log.Tables("select now()"), HasLen, 0)
+}
+
+func (s *FingerprintTestSuite) TestParseStatement(t *C) {
+	for q, expect := range map[string]log.Statement{
+		// slow002.log
+		"update db2.tuningdetail_21_265507 n\n      inner join db1.gonzo a using(gonzo) \n      set n.column1 = a.column1, n.word3 = a.word3": {
+			Verb: "UPDATE", Read: []string{"db1.gonzo"}, Written: []string{"db2.tuningdetail_21_265507"},
+		},
+		"UPDATE db4.vab3concept1upload\nSET    vab3concept1id = '91848182522'\nWHERE  vab3concept1upload='6994465'": {
+			Verb: "UPDATE", Written: []string{"db4.vab3concept1upload"},
+		},
+		"INSERT INTO db3.vendor11gonzo (makef, bizzle)\nVALUES ('', 'Exact')": {
+			Verb: "INSERT", Written: []string{"db3.vendor11gonzo"},
+		},
+		// Joins and subqueries
+		"select * from db1.t1 a, `t2` as b join t3 on a.id=t3.id left join db2.t4 using (id) where a.id in (select id from t5)": {
+			Verb: "SELECT", Read: []string{"db1.t1", "t2", "t3", "db2.t4", "t5"},
+		},
+		"SELECT a FROM (SELECT a FROM t1 UNION SELECT a FROM t2) x": {
+			Verb: "SELECT", Read: []string{"t1", "t2"},
+		},
+		"(select 1 from t1 force index (a)) union (select 2 from t2)": {
+			Verb: "SELECT", Read: []string{"t1", "t2"},
+		},
+		// INSERT ... SELECT reads the table it writes
+		"INSERT IGNORE INTO t1 (a) SELECT a FROM t1 JOIN t2 USING (id) ON DUPLICATE KEY UPDATE a=1": {
+			Verb: "INSERT", Read: []string{"t1", "t2"}, Written: []string{"t1"},
+		},
+		"replace into t1 set a=1": {
+			Verb: "REPLACE", Written: []string{"t1"},
+		},
+		// Multi-table UPDATE and DELETE
+		"UPDATE t1, t2 SET t1.a = t2.a WHERE t1.id = t2.id": {
+			Verb: "UPDATE", Read: []string{"t2"}, Written: []string{"t1"},
+		},
+		"update t1 join t2 on t1.id=t2.id set a = (select max(b) from t3)": {
+			Verb: "UPDATE", Read: []string{"t2", "t3"}, Written: []string{"t1"},
+		},
+		"DELETE FROM db.t WHERE id IN (SELECT id FROM t2)": {
+			Verb: "DELETE", Read: []string{"t2"}, Written: []string{"db.t"},
+		},
+		"DELETE a, b.* FROM t1 a JOIN t2 b ON a.id=b.id JOIN t3": {
+			Verb: "DELETE", Read: []string{"t3"}, Written: []string{"t1", "t2"},
+		},
+		"delete low_priority from t1 using t1 join t2": {
+			Verb: "DELETE", Read: []string{"t2"}, Written: []string{"t1"},
+		},
+		// DDL and others
+		"CREATE TABLE IF NOT EXISTS t1 AS SELECT * FROM t2": {
+			Verb: "CREATE", Read: []string{"t2"}, Written: []string{"t1"},
+		},
+		"create unique index i on db.t (a)":                                           {Verb: "CREATE", Written: []string{"db.t"}},
+		"ALTER TABLE t1 ADD COLUMN c INT":                                             {Verb: "ALTER", Written: []string{"t1"}},
+		"drop table if exists t1, `db`.`t2`":                                          {Verb: "DROP", Written: []string{"t1", "db.t2"}},
+		"TRUNCATE t1":                                                                 {Verb: "TRUNCATE", Written: []string{"t1"}},
+		"rename table a to b, c to d":                                                 {Verb: "RENAME", Written: []string{"a", "b", "c", "d"}},
+		"LOAD DATA INFILE '/tmp/foo.txt' INTO TABLE db.tbl":                           {Verb: "LOAD", Written: []string{"db.tbl"}},
+		"analyze table t1":                                                            {Verb: "ANALYZE", Read: []string{"t1"}},
+		"create database foo":                                                         {Verb: "CREATE"},
+		"select /*!40001 SQL_NO_CACHE */ * FROM `film`":                               {Verb: "SELECT", Read: []string{"film"}},
+		"select 1 from dual":                                                          {Verb: "SELECT"},
+		"select extract(year from created) from orders":                               {Verb: "SELECT", Read: []string{"orders"}},
+		"SELECT TRIM(LEADING 'x' FROM name) FROM t1":                                  {Verb: "SELECT", Read: []string{"t1"}},
+		"select substring(s from 2) from t1 where id in (select id from t2)":          {Verb: "SELECT", Read: []string{"t1", "t2"}},
+		"select * from (t1 join t2 on t1.id = t2.id) join (select max(id) from t3) x": {Verb: "SELECT", Read: []string{"t1", "t2", "t3"}},
+		"SET NAMES utf8":                                                              {Verb: "SET"},
+		"":                                                                            {},
+	} {
+		t.Check(log.ParseStatement(q), DeepEquals, expect, Commentf(q))
+	}
+}
+
+func (s *FingerprintTestSuite) TestDistill(t *C) {
+	for q, distill := range map[string]string{
+		"SELECT o.id FROM orders o JOIN customers c ON o.cid = c.id WHERE c.id=1":                           "SELECT orders customers",
+		"update db2.tuningdetail_21_265507 n inner join db1.gonzo a using(gonzo) set n.column1 = a.column1": "UPDATE db2.tuningdetail_21_265507 db1.gonzo",
+		"INSERT INTO t1 (a) SELECT a FROM t2":                                                               "INSERT SELECT t1 t2",
+		"insert into t1 values (1)":                                                                         "INSERT t1",
+		"delete from t1 where id in (select id from t2)":                                                    "DELETE t1 t2",
+		"CREATE TABLE t1 AS SELECT * FROM t2":                                                               "CREATE TABLE SELECT t1 t2",
+		"ALTER TABLE db.t1 ADD COLUMN c INT":                                                                "ALTER TABLE db.t1",
+		"create database foo":                                                                               "CREATE DATABASE",
+		"SHOW /*!50002 GLOBAL */ STATUS LIKE 'Threads%'":                                                    "SHOW STATUS",
+		"show slave status":                                                                                 "SHOW SLAVE STATUS",
+		"SET NAMES utf8":                                                                                    "SET",
+		"select 1":                                                                                          "SELECT",
+		"use db1":                                                                                           "USE",
+		"administrator command: Ping":                                                                       "ADMIN PING",
+		"CALL foo(1, 2, 3)":                                                                                 "CALL foo",
+		"":                                                                                                  "",
+	} {
+		t.Check(log.Distill(q), Equals, distill, Commentf(q))
+	}
+}
+
+func (s *FingerprintTestSuite) TestConvertToSelect(t *C) {
+	for q, sel := range map[string]string{
+		"select * from t1 where id=1": "select * from t1 where id=1",
+		"UPDATE t1 SET a = 1, b = (select max(b) from t2) WHERE id = 5 ORDER BY c LIMIT 10;":        "SELECT a = 1, b = (select max(b) from t2) FROM t1 WHERE id = 5 ORDER BY c LIMIT 10",
+		"update low_priority db2.t n inner join db1.gonzo a using(gonzo) set n.column1 = a.column1": "SELECT n.column1 = a.column1 FROM db2.t n inner join db1.gonzo a using(gonzo)",
+		"DELETE FROM t1 WHERE id IN (1, 2) LIMIT 5":                                                 "SELECT * FROM t1 WHERE id IN (1, 2) LIMIT 5",
+		"delete quick t1, t2 from t1 join t2 using (id) where t2.a > 1":                             "SELECT * FROM t1 join t2 using (id) where t2.a > 1",
+		"delete from t1 using t1 join t2 on t1.id = t2.id where t2.a > 1":                           "SELECT * FROM t1 join t2 on t1.id = t2.id where t2.a > 1",
+		"INSERT INTO t1 (a, b) SELECT a, b FROM t2 WHERE c = 1 ON DUPLICATE KEY UPDATE b = 2":       "SELECT a, b FROM t2 WHERE c = 1",
+		"insert ignore into db.t1 partition (p1) (a) select a from t2":                              "select a from t2",
+		"replace into t1 (select * from t2 order by id limit 3)":                                    "select * from t2 order by id limit 3",
+	} {
+		got, err := log.ConvertToSelect(q)
+		t.Check(err, IsNil, Commentf(q))
+		t.Check(got, Equals, sel, Commentf(q))
+	}
+
+	for q, msg := range map[string]string{
+		"insert into t1 values (1, 'select')":                       "cannot convert INSERT without SELECT to SELECT",
+		"INSERT INTO t1 (a, b) VALUES ((SELECT max(a) FROM t2), 1)": "cannot convert INSERT without SELECT to SELECT",
+		"insert into t1 set a = (select 1)":                         "cannot convert INSERT without SELECT to SELECT",
+		"ALTER TABLE t1 ADD COLUMN c INT":                           "cannot convert ALTER to SELECT",
+		"update t1":                                                 "cannot convert UPDATE to SELECT: no SET",
+		"":                                                          "cannot convert query to SELECT: no statement",
+	} {
+		_, err := log.ConvertToSelect(q)
+		t.Check(err, ErrorMatches, msg, Commentf(q))
+	}
+}
+
 /////////////////////////////////////////////////////////////////////////////
 // Checksum() test suite
 // //////////////////////////////////////////////////////////////////////////
@@ -430,7 +715,7 @@ func (s *EventStatsTestSuite) TestSlow001(t *C) {
 				Min:    0,
 				Avg:    0,
 				Pct95:  0,
-				Stddev: 0, // @todo
+				Stddev: 0,
 				Med:    0,
 				Max:    0,
 			},
@@ -440,7 +725,7 @@ func (s *EventStatsTestSuite) TestSlow001(t *C) {
 				Min:    2,
 				Avg:    2,
 				Pct95:  2,
-				Stddev: 0, // @todo
+				Stddev: 0,
 				Med:    2,
 				Max:    2,
 			},
@@ -452,7 +737,7 @@ func (s *EventStatsTestSuite) TestSlow001(t *C) {
 				Min:    0,
 				Avg:    0,
 				Pct95:  0,
-				Stddev: 0, // @todo
+				Stddev: 0,
 				Med:    0,
 				Max:    0,
 			},
@@ -462,7 +747,7 @@ func (s *EventStatsTestSuite) TestSlow001(t *C) {
 				Min:    1,
 				Avg:    1,
 				Pct95:  1,
-				Stddev: 0, // @todo
+				Stddev: 0,
 				Med:    1,
 				Max:    1,
 			},
@@ -474,9 +759,9 @@ func (s *EventStatsTestSuite) TestSlow001(t *C) {
 	}
 }
 
-// Test p95 and median.
+// Test exact p95 and median.
 func (s *EventStatsTestSuite) TestSlow010(t *C) {
-	stats := log.NewEventStats()
+	stats := log.NewEventStatsWithOptions(log.StatsOptions{ExactValues: true})
 	events := testlog.ParseSlowLog("slow010.log", parser.Options{})
 	for _, e := range *events {
 		stats.Add(&e)
@@ -485,14 +770,15 @@ func (s *EventStatsTestSuite) TestSlow010(t *C) {
 	expect := &log.EventStats{
 		TimeMetrics: map[string]*log.TimeStats{
 			"Query_time": &log.TimeStats{
-				Cnt:    36,
-				Sum:    22.703689,
-				Min:    0.000002,
-				Avg:    0.630658,
-				Pct95:  2.034012, // pqd: 1.964363
-				Stddev: 0,        // @todo
-				Med:    0.192812, // pqd: 0.198537
-				Max:    3.034012,
+				Cnt:     36,
+				Sum:     22.703689,
+				Min:     0.000002,
+				Avg:     0.630658,
+				Pct95:   2.034012, // pqd: 1.964363
+				Stddev:  0.767050,
+				VarMean: 0.932940,
+				Med:     0.192812, // pqd: 0.198537
+				Max:     3.034012,
 			},
 			"Lock_time": &log.TimeStats{
 				Cnt:    36,
@@ -500,21 +786,22 @@ func (s *EventStatsTestSuite) TestSlow010(t *C) {
 				Min:    0,
 				Avg:    0,
 				Pct95:  0,
-				Stddev: 0, // @todo
+				Stddev: 0,
 				Med:    0,
 				Max:    0,
 			},
 		},
 		NumberMetrics: map[string]*log.NumberStats{
 			"Rows_sent": &log.NumberStats{
-				Cnt:    36,
-				Sum:    156,
-				Min:    0,
-				Avg:    4,
-				Pct95:  6, // pqd: 4
-				Stddev: 0, // @todo
-				Med:    1, // pqd: 0
-				Max:    99,
+				Cnt:     36,
+				Sum:     156,
+				Min:     0,
+				Avg:     4,
+				Pct95:   6, // pqd: 4
+				Stddev:  16.098654,
+				VarMean: 59.807692,
+				Med:     1, // pqd: 0
+				Max:     99,
 			},
 		},
 	}
@@ -523,3 +810,608 @@ func (s *EventStatsTestSuite) TestSlow010(t *C) {
 		t.Error(diff)
 	}
 }
+
+// Test stddev and variance-to-mean: 2, 4, 4, 4, 5, 5, 7, 9 has mean 5 and
+// population stddev 2.
+func (s *EventStatsTestSuite) TestStddev(t *C) {
+	stats := log.NewEventStats()
+	for _, v := range []uint64{2, 4, 4, 4, 5, 5, 7, 9} {
+		e := log.NewEvent()
+		e.TimeMetrics["Query_time"] = float32(v) / 10
+		e.NumberMetrics["Rows_sent"] = v
+		stats.Add(e)
+	}
+	stats.Current()
+	t.Check(stats.NumberMetrics["Rows_sent"].Stddev, Equals, float64(2))
+	t.Check(stats.NumberMetrics["Rows_sent"].VarMean, Equals, 0.8)
+	t.Check(fmt.Sprintf("%.6f", stats.TimeMetrics["Query_time"].Stddev), Equals, "0.200000")
+	t.Check(fmt.Sprintf("%.6f", stats.TimeMetrics["Query_time"].VarMean), Equals, "0.080000")
+}
+
+// Test that p95 and median estimated by the default sketch are within 1% of
+// the exact values.
+func (s *EventStatsTestSuite) TestSketch(t *C) {
+	exact := log.NewEventStatsWithOptions(log.StatsOptions{ExactValues: true})
+	stats := log.NewEventStats()
+	events := testlog.ParseSlowLog("slow010.log", parser.Options{})
+	for _, e := range *events {
+		exact.Add(&e)
+		stats.Add(&e)
+	}
+	exact.Current()
+	stats.Current()
+
+	got := stats.TimeMetrics["Query_time"]
+	expect := exact.TimeMetrics["Query_time"]
+	t.Check(got.GetVals(), IsNil)
+	t.Check(got.Min, Equals, expect.Min)
+	t.Check(got.Max, Equals, expect.Max)
+	t.Check(math.Abs(got.Pct95-expect.Pct95) <= 0.01*expect.Pct95, Equals, true)
+	t.Check(math.Abs(got.Med-expect.Med) <= 0.01*expect.Med, Equals, true)
+	t.Check(stats.NumberMetrics["Rows_sent"].Pct95, Equals, exact.NumberMetrics["Rows_sent"].Pct95)
+	t.Check(stats.NumberMetrics["Rows_sent"].Med, Equals, exact.NumberMetrics["Rows_sent"].Med)
+}
+
+func (s *EventStatsTestSuite) TestSketchQuantile(t *C) {
+	sketch := log.NewSketch(0.01)
+	t.Check(sketch.Quantile(0.5), Equals, float64(0))
+	for i := 1; i <= 100000; i++ {
+		sketch.Add(float64(i) / 1000)
+	}
+	sketch.Add(0)
+	t.Check(sketch.Cnt(), Equals, uint64(100001))
+	t.Check(sketch.Quantile(0), Equals, float64(0))
+	t.Check(sketch.Quantile(1), Equals, float64(100))
+	for _, q := range []float64{0.01, 0.25, 0.5, 0.9, 0.95, 0.99, 0.999} {
+		// The sorted values are 0, 0.001, ..., 100, so the value at index
+		// q*Cnt is index/1000.
+		expect := float64(uint64(q*100001)) / 1000
+		got := sketch.Quantile(q)
+		if math.Abs(got-expect) > 0.01*expect {
+			t.Errorf("q %f: got %f, expected %f within 1%%", q, got, expect)
+		}
+	}
+}
+
+func (s *EventStatsTestSuite) TestPercentilesHistogram(t *C) {
+	stats := log.NewEventStatsWithOptions(log.StatsOptions{
+		ExactValues: true,
+		Percentiles: []float64{50, 90, 99.9},
+		Histogram:   true,
+	})
+	events := testlog.ParseSlowLog("slow010.log", parser.Options{})
+	for _, e := range *events {
+		stats.Add(&e)
+	}
+	stats.Current()
+
+	queryTime := stats.TimeMetrics["Query_time"]
+	got := map[string]string{}
+	for p, v := range queryTime.Percentiles {
+		got[p] = fmt.Sprintf("%.6f", v)
+	}
+	t.Check(got, DeepEquals, map[string]string{"p50": "0.192812", "p90": "2.000012", "p99.9": "3.034012"})
+	t.Check(queryTime.Histogram, DeepEquals, []log.Bucket{
+		{0.000001, 1}, // 2us
+		{0.00001, 0},
+		{0.0001, 0},
+		{0.001, 5},
+		{0.01, 7},
+		{0.1, 13},
+		{1, 10},
+		{10, 0},
+	})
+
+	rowsSent := stats.NumberMetrics["Rows_sent"]
+	t.Check(rowsSent.Percentiles, DeepEquals, map[string]uint64{"p50": 1, "p90": 5, "p99.9": 99})
+	t.Check(rowsSent.Histogram, DeepEquals, []log.Bucket{
+		{0, 13},
+		{1, 22},
+		{10, 1},
+		{100, 0},
+		{1000, 0},
+		{10000, 0},
+		{100000, 0},
+		{1000000, 0},
+	})
+
+	// Without options, there are none.
+	stats = log.NewEventStats()
+	stats.Add(&(*events)[0])
+	stats.Current()
+	t.Check(stats.TimeMetrics["Query_time"].Percentiles, IsNil)
+	t.Check(stats.TimeMetrics["Query_time"].Histogram, IsNil)
+}
+
+// Test that merging the stats of two halves of a log, directly and from JSON,
+// gives the same stats as the whole log.
+func (s *EventStatsTestSuite) TestMerge(t *C) {
+	events := *testlog.ParseSlowLog("slow010.log", parser.Options{})
+	opt := log.StatsOptions{Percentiles: []float64{50, 99}, Histogram: true}
+	all := log.NewEventStatsWithOptions(opt)
+	half1 := log.NewEventStatsWithOptions(opt)
+	half2 := log.NewEventStatsWithOptions(opt)
+	for i, e := range events {
+		all.Add(&events[i])
+		if i < len(events)/2 {
+			half1.Add(&e)
+		} else {
+			half2.Add(&e)
+		}
+	}
+	all.Current()
+	half1.Current()
+	half2.Current()
+
+	merged := log.NewEventStatsWithOptions(opt)
+	merged.Merge(half1)
+	merged.Merge(half2)
+	merged.Current()
+	t.Check(dumpStats(merged), DeepEquals, dumpStats(all))
+
+	// Stats saved as JSON are merged the same.
+	merged = log.NewEventStatsWithOptions(opt)
+	for _, half := range []*log.EventStats{half1, half2} {
+		data, err := json.Marshal(half)
+		t.Assert(err, IsNil)
+		saved := &log.EventStats{}
+		t.Assert(json.Unmarshal(data, saved), IsNil)
+		merged.Merge(saved)
+	}
+	merged.Current()
+	t.Check(dumpStats(merged), DeepEquals, dumpStats(all))
+
+	// Metrics without values are skipped.
+	empty := &log.EventStats{}
+	t.Assert(json.Unmarshal([]byte(`{"TimeMetrics":{"Foo_time":{"Cnt":0}},"NumberMetrics":{"Foo_rows":{"Cnt":0}},"BoolMetrics":{"Foo":{"Cnt":0}}}`), empty), IsNil)
+	merged.Merge(empty)
+	merged.Current()
+	t.Check(dumpStats(merged), DeepEquals, dumpStats(all))
+	_, err := json.Marshal(merged)
+	t.Check(err, IsNil)
+
+	// So are exact values.
+	opt.ExactValues = true
+	all = log.NewEventStatsWithOptions(opt)
+	half1 = log.NewEventStatsWithOptions(opt)
+	half2 = log.NewEventStatsWithOptions(opt)
+	for i, e := range events {
+		all.Add(&events[i])
+		if i < len(events)/2 {
+			half1.Add(&e)
+		} else {
+			half2.Add(&e)
+		}
+	}
+	all.Current()
+	half1.Merge(half2)
+	half1.Current()
+	t.Check(dumpStats(half1), DeepEquals, dumpStats(all))
+}
+
+func (s *EventStatsTestSuite) TestCurrentNoValues(t *C) {
+	// Metrics without values, e.g. saved as JSON, are not averaged.
+	stats := &log.EventStats{}
+	t.Assert(json.Unmarshal([]byte(`{"TimeMetrics":{"Query_time":{"Cnt":0}},"NumberMetrics":{"Rows_sent":{"Cnt":0}}}`), stats), IsNil)
+	stats.Current()
+	t.Check(stats.TimeMetrics["Query_time"].Avg, Equals, float64(0))
+	t.Check(stats.NumberMetrics["Rows_sent"].Avg, Equals, uint64(0))
+	_, err := json.Marshal(stats)
+	t.Check(err, IsNil)
+}
+
+// dumpStats returns the stats as strings with 6 decimals, so that floats
+// that differ only by rounding errors are equal.
+func dumpStats(s *log.EventStats) map[string]string {
+	dump := map[string]string{}
+	for metric, stats := range s.TimeMetrics {
+		dump[metric] = fmt.Sprintf("%d %.6f %.6f %.6f %.6f %.6f %.6f %.6f %.6f %v %v",
+			stats.Cnt, stats.Sum, stats.Min, stats.Avg, stats.Pct95, stats.Stddev, stats.VarMean, stats.Med, stats.Max, stats.Percentiles, stats.Histogram)
+	}
+	for metric, stats := range s.NumberMetrics {
+		dump[metric] = fmt.Sprintf("%d %d %d %d %d %.6f %.6f %d %d %v %v",
+			stats.Cnt, stats.Sum, stats.Min, stats.Avg, stats.Pct95, stats.Stddev, stats.VarMean, stats.Med, stats.Max, stats.Percentiles, stats.Histogram)
+	}
+	for metric, stats := range s.BoolMetrics {
+		dump[metric] = fmt.Sprintf("%d %d", stats.Cnt, stats.True)
+	}
+	return dump
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Class test suite
+// //////////////////////////////////////////////////////////////////////////
+
+type ClassTestSuite struct {
+}
+
+var _ = Suite(&ClassTestSuite{})
+
+func (s *ClassTestSuite) TestMerge(t *C) {
+	events := *testlog.ParseSlowLog("slow010.log", parser.Options{})
+	fingerprint := log.Fingerprint(events[0].Query)
+	id := log.Checksum(fingerprint)
+
+	all := log.NewQueryClass(id, fingerprint, true)
+	allGlobal := log.NewGlobalClass()
+	half1 := log.NewQueryClass(id, fingerprint, true)
+	half2 := log.NewQueryClass(id, fingerprint, true)
+	global1 := log.NewGlobalClass()
+	global2 := log.NewGlobalClass()
+	for i, e := range events {
+		all.AddEvent(&events[i])
+		allGlobal.AddEvent(&events[i])
+		if i < len(events)/2 {
+			half1.AddEvent(&e)
+			global1.AddEvent(&e)
+		} else {
+			half2.AddEvent(&e)
+			global2.AddEvent(&e)
+		}
+	}
+	all.Finalize()
+	allGlobal.Finalize(1)
+
+	// The example with the max Query_time is in the first half.
+	t.Check(half2.Example, Not(DeepEquals), all.Example)
+	half2.Merge(half1)
+	half2.Finalize()
+	t.Check(half2.TotalQueries, Equals, all.TotalQueries)
+	t.Check(half2.Example, DeepEquals, all.Example)
+	t.Check(dumpStats(half2.Metrics), DeepEquals, dumpStats(all.Metrics))
+
+	t.Check(global1.Merge(global2), IsNil)
+	global1.Finalize(1)
+	t.Check(global1.TotalQueries, Equals, allGlobal.TotalQueries)
+	t.Check(global1.UniqueQueries, Equals, uint64(1))
+	t.Check(dumpStats(global1.Metrics), DeepEquals, dumpStats(allGlobal.Metrics))
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Window test suite
+// //////////////////////////////////////////////////////////////////////////
+
+type WindowTestSuite struct {
+}
+
+var _ = Suite(&WindowTestSuite{})
+
+func (s *WindowTestSuite) TestParseTs(t *C) {
+	expect := time.Date(2007, 10, 15, 1, 43, 52, 0, time.UTC)
+	for _, ts := range []string{"071015  1:43:52", "071015 01:43:52", "2007-10-15T01:43:52Z", "2007-10-15 01:43:52"} {
+		got, err := log.ParseTs(ts, time.UTC)
+		t.Check(err, IsNil)
+		t.Check(got.Equal(expect), Equals, true, Commentf(ts))
+	}
+	_, err := log.ParseTs("yesterday", time.UTC)
+	t.Check(err, NotNil)
+}
+
+// Test that windows are returned as soon as they are complete.
+func (s *WindowTestSuite) TestWindows(t *C) {
+	events := *testlog.ParseSlowLog("slow012.log", parser.Options{})
+	t.Assert(events, HasLen, 3)
+	a := log.NewWindowAggregator(time.Second, log.StatsOptions{}, true)
+	t.Check(a.AddEvent(&events[0]), HasLen, 0)
+	t.Check(a.AddEvent(&events[1]), HasLen, 0)
+	windows := a.AddEvent(&events[2])
+	t.Assert(windows, HasLen, 1)
+	t.Check(windows[0].Start, Equals, time.Unix(1397442852, 0).UTC())
+	t.Check(windows[0].End, Equals, time.Unix(1397442853, 0).UTC())
+	t.Check(windows[0].Global.TotalQueries, Equals, uint64(2))
+	t.Check(windows[0].Global.UniqueQueries, Equals, uint64(2))
+	t.Check(windows[0].Classes, HasLen, 2)
+	t.Check(windows[0].Global.Metrics.TimeMetrics["Query_time"].Max, Equals, float64(float32(0.000214)))
+
+	windows = a.Flush()
+	t.Assert(windows, HasLen, 1)
+	t.Check(windows[0].Start, Equals, time.Unix(1397442853, 0).UTC())
+	t.Check(windows[0].Global.TotalQueries, Equals, uint64(1))
+	t.Check(a.Flush(), HasLen, 0)
+}
+
+// Test the times of events without Timestamp: Ts in Location, else the time
+// of the previous event.
+func (s *WindowTestSuite) TestTime(t *C) {
+	events := *testlog.ParseSlowLog("slow002.log", parser.Options{})
+	a := log.NewWindowAggregator(time.Hour, log.StatsOptions{}, true)
+	var windows []*log.Window
+	for i := range events {
+		windows = append(windows, a.AddEvent(&events[i])...)
+	}
+	windows = append(windows, a.Flush()...)
+	// The Ts of the first event is 071218 11:48:27 in UTC-5, not UTC.
+	t.Assert(windows, HasLen, 2)
+	t.Check(windows[0].Global.TotalQueries, Equals, uint64(1))
+	t.Check(windows[1].Global.TotalQueries, Equals, uint64(len(events)-1))
+
+	a = log.NewWindowAggregator(time.Hour, log.StatsOptions{}, true)
+	a.Location = time.FixedZone("UTC-5", -5*3600)
+	windows = nil
+	for i := range events {
+		windows = append(windows, a.AddEvent(&events[i])...)
+	}
+	windows = append(windows, a.Flush()...)
+	t.Assert(windows, HasLen, 1)
+	t.Check(windows[0].Global.TotalQueries, Equals, uint64(len(events)))
+	t.Check(windows[0].Start.Equal(time.Date(2007, 12, 18, 16, 0, 0, 0, time.UTC)), Equals, true)
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Aggregator test suite
+// //////////////////////////////////////////////////////////////////////////
+
+type AggregatorTestSuite struct {
+}
+
+var _ = Suite(&AggregatorTestSuite{})
+
+func (s *AggregatorTestSuite) TestAggregator(t *C) {
+	var events []log.Event
+	for _, filename := range []string{"slow002.log", "slow006.log", "slow010.log"} {
+		events = append(events, *testlog.ParseSlowLog(filename, parser.Options{})...)
+	}
+
+	var results []*log.Result
+	for _, workers := range []int{1, 4} {
+		a := log.NewAggregator(log.AggregatorOptions{Examples: true, Workers: workers})
+		for i := range events {
+			t.Check(a.AddEvent(&events[i]), IsNil)
+		}
+		results = append(results, a.Finalize())
+	}
+
+	for _, res := range results {
+		t.Check(res.Global.TotalQueries, Equals, uint64(len(events)))
+		t.Check(res.Global.UniqueQueries, Equals, uint64(len(res.Classes)))
+		// Sorted by total Query_time, descending.
+		t.Check(res.Classes[0].Fingerprint, Equals, "select c from t where id=?")
+		t.Check(res.Classes[0].TotalQueries, Equals, uint64(36))
+		t.Check(res.Classes[0].Example.Query, Equals, "SELECT c FROM t WHERE id=1")
+		total := uint64(0)
+		for i, class := range res.Classes {
+			t.Check(class.Id, Equals, log.Checksum(class.Fingerprint))
+			if i > 0 {
+				t.Check(class.Metrics.TimeMetrics["Query_time"].Sum <= res.Classes[i-1].Metrics.TimeMetrics["Query_time"].Sum, Equals, true)
+			}
+			total += class.TotalQueries
+		}
+		t.Check(total, Equals, res.Global.TotalQueries)
+	}
+
+	// Workers only make it faster.
+	t.Assert(results[1].Classes, HasLen, len(results[0].Classes))
+	for i, class := range results[1].Classes {
+		t.Check(class.Id, Equals, results[0].Classes[i].Id)
+		t.Check(class.TotalQueries, Equals, results[0].Classes[i].TotalQueries)
+		t.Check(dumpStats(class.Metrics), DeepEquals, dumpStats(results[0].Classes[i].Metrics))
+	}
+}
+
+func (s *AggregatorTestSuite) TestAggregate(t *C) {
+	file, err := os.Open(testlog.Sample + "slow006.log")
+	t.Assert(err, IsNil)
+	defer file.Close()
+	p := parser.NewSlowLogParser(file, nil, parser.Options{})
+	go p.Start(context.Background())
+
+	a := log.NewAggregator(log.AggregatorOptions{})
+	t.Check(a.Aggregate(p), IsNil)
+	res := a.Finalize()
+	t.Check(res.Global.TotalQueries, Equals, uint64(6))
+	t.Check(res.Global.UniqueQueries, Equals, uint64(2))
+	t.Check(res.Classes[0].Example, DeepEquals, log.Example{})
+}
+
+// WriteJSON and WriteNDJSON decode to the same classes and stats, including
+// the percentiles estimated by the sketches.
+func (s *AggregatorTestSuite) TestWriteJSON(t *C) {
+	events := *testlog.ParseSlowLog("slow010.log", parser.Options{})
+	a := log.NewAggregator(log.AggregatorOptions{
+		Examples: true,
+		Stats:    log.StatsOptions{Percentiles: []float64{50, 99.9}},
+	})
+	for i := range events {
+		a.AddEvent(&events[i])
+	}
+	res := a.Finalize()
+	p50 := res.Global.Metrics.TimeMetrics["Query_time"].Percentiles["p50"]
+	t.Assert(math.Abs(p50-0.192812) < 0.01*0.192812, Equals, true, Commentf("p50 %f", p50))
+
+	checkClass := func(got, expect *log.QueryClass) {
+		t.Check(got.Id, Equals, expect.Id)
+		t.Check(got.Fingerprint, Equals, expect.Fingerprint)
+		t.Check(got.TotalQueries, Equals, expect.TotalQueries)
+		t.Check(got.Example, DeepEquals, expect.Example)
+		t.Check(dumpStats(got.Metrics), DeepEquals, dumpStats(expect.Metrics))
+	}
+
+	var buf bytes.Buffer
+	t.Assert(res.WriteJSON(&buf), IsNil)
+	var got log.Result
+	t.Assert(json.Unmarshal(buf.Bytes(), &got), IsNil)
+	t.Check(got.Global.TotalQueries, Equals, res.Global.TotalQueries)
+	t.Check(got.Global.UniqueQueries, Equals, res.Global.UniqueQueries)
+	t.Check(dumpStats(got.Global.Metrics), DeepEquals, dumpStats(res.Global.Metrics))
+	t.Check(got.Global.Metrics.TimeMetrics["Query_time"].Percentiles["p50"], Equals, p50)
+	t.Assert(got.Classes, HasLen, len(res.Classes))
+	for i, class := range got.Classes {
+		checkClass(class, res.Classes[i])
+	}
+
+	// One class per line.
+	buf.Reset()
+	t.Assert(res.WriteNDJSON(&buf), IsNil)
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	t.Assert(lines, HasLen, len(res.Classes))
+	for i, line := range lines {
+		var class log.QueryClass
+		t.Assert(json.Unmarshal([]byte(line), &class), IsNil)
+		checkClass(&class, res.Classes[i])
+	}
+}
+
+func (s *AggregatorTestSuite) TestGroupBy(t *C) {
+	events := *testlog.ParseSlowLog("slow006.log", parser.Options{})
+	aggregate := func(groupBy ...string) *log.Result {
+		a := log.NewAggregator(log.AggregatorOptions{GroupBy: groupBy})
+		for i := range events {
+			a.AddEvent(&events[i])
+		}
+		return a.Finalize()
+	}
+	classes := func(res *log.Result) map[string]uint64 {
+		n := make(map[string]uint64)
+		for _, class := range res.Classes {
+			t.Check(class.Id, Not(Equals), "")
+			n[fmt.Sprintf("%v", class.Attributes)] = class.TotalQueries
+		}
+		return n
+	}
+
+	// By fingerprint is the default.
+	res := aggregate("fingerprint")
+	t.Check(res.Global.UniqueQueries, Equals, uint64(2))
+	t.Check(res.Classes[0].Attributes, IsNil)
+	t.Check(res.Classes[0].Id, Equals, log.Checksum(res.Classes[0].Fingerprint))
+
+	res = aggregate("db")
+	t.Check(res.Global.TotalQueries, Equals, uint64(6))
+	t.Check(classes(res), DeepEquals, map[string]uint64{
+		"map[db:foo]": 3,
+		"map[db:bar]": 3,
+	})
+	t.Check(res.Classes[0].Fingerprint, Equals, "")
+
+	res = aggregate("user", "tables")
+	t.Check(classes(res), DeepEquals, map[string]uint64{
+		"map[tables:foo_tbl user:[SQL_SLAVE]]": 3,
+		"map[tables:bar_tbl user:[SQL_SLAVE]]": 3,
+	})
+
+	res = aggregate("fingerprint", "db")
+	for _, class := range res.Classes {
+		t.Check(class.Fingerprint, Equals, class.Attributes["fingerprint"])
+	}
+
+	// No event is an admin command, so no event is in a class.
+	res = aggregate("admin")
+	t.Check(res.Global.TotalQueries, Equals, uint64(6))
+	t.Check(res.Classes, HasLen, 0)
+
+	t.Check(log.CheckGroupBy([]string{"user", "db"}), IsNil)
+	t.Check(log.CheckGroupBy([]string{"users"}), NotNil)
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Filter test suite
+// //////////////////////////////////////////////////////////////////////////
+
+type FilterTestSuite struct {
+}
+
+var _ = Suite(&FilterTestSuite{})
+
+func (s *FilterTestSuite) TestMatch(t *C) {
+	e := log.NewEvent()
+	e.User = "app"
+	e.Db = "orders"
+	e.Query = "SELECT * FROM orders WHERE id=1"
+	e.Timestamp = 1400000000
+	e.TimeMetrics["Query_time"] = 1.5
+	e.TimeMetrics["Lock_time"] = 0.1
+	e.NumberMetrics["Rows_examined"] = 1000
+	e.BoolMetrics["Full_scan"] = true
+
+	match := func(expr string) bool {
+		f, err := log.NewFilter(expr)
+		t.Assert(err, IsNil, Commentf(expr))
+		t.Check(f.String(), Equals, expr)
+		return f.Match(e)
+	}
+	for _, expr := range []string{
+		`Query_time > 1 and Db = "orders" and Full_scan = true and User != "replication"`,
+		`Query_time >= 1500ms`,
+		`Lock_time = 0.1`,
+		`Rows_examined <= 1000 and Rows_examined > 999`,
+		`User = 'replication' or (Db == "orders" and not Full_scan = no)`,
+		`Query =~ "^(?i)select" and Query !~ "insert"`,
+		`Timestamp > 1300000000 and Admin = false`,
+		`db = "orders" AND Full_scan = yes`, // fields and keywords in any case
+	} {
+		t.Check(match(expr), Equals, true, Commentf(expr))
+	}
+	for _, expr := range []string{
+		`Query_time < 1`,
+		`Db != "orders"`,
+		`not Full_scan = true`,
+		`Rows_sent > 0 or Rows_sent = 0`, // no such metric
+		`Tmp_table = false`,
+		`Admin = true or User = "root"`,
+	} {
+		t.Check(match(expr), Equals, false, Commentf(expr))
+	}
+}
+
+func (s *FilterTestSuite) TestErrors(t *C) {
+	for _, expr := range []string{
+		``,
+		`Query_time >`,
+		`Query_time > 1 and`,
+		`Query_time 1`,
+		`Query_time > "1"`,
+		`Db > "orders"`,
+		`Db = 1`,
+		`Db = "orders`,
+		`Full_scan = maybe`,
+		`Full_scan < true`,
+		`Query_time > 1h`,
+		`(Query_time > 1`,
+		`Query_time > 1)`,
+		`Query_time ! 1`,
+		`Query =~ "("`,
+	} {
+		_, err := log.NewFilter(expr)
+		t.Check(err, NotNil, Commentf(expr))
+	}
+}
+
+func (s *FilterTestSuite) TestAggregator(t *C) {
+	f, err := log.NewFilter(`Query_time > 1 and Db = "test"`)
+	t.Assert(err, IsNil)
+	events := *testlog.ParseSlowLog("slow001.log", parser.Options{})
+	a := log.NewAggregator(log.AggregatorOptions{Filter: f})
+	for i := range events {
+		a.AddEvent(&events[i])
+	}
+	res := a.Finalize()
+	t.Check(res.Global.TotalQueries, Equals, uint64(1))
+	t.Assert(res.Classes, HasLen, 1)
+	t.Check(res.Classes[0].Fingerprint, Equals, "select sleep(?) from n")
+}
+
+func (s *AggregatorTestSuite) TestStatement(t *C) {
+	events := *testlog.ParseSlowLog("slow002.log", parser.Options{})
+	a := log.NewAggregator(log.AggregatorOptions{})
+	for i := range events {
+		a.AddEvent(&events[i])
+	}
+	res := a.Finalize()
+	class := res.Classes[0]
+	t.Check(class.Distill, Equals, "UPDATE db2.tuningdetail_21_265507 db1.gonzo")
+	t.Check(class.Statement, DeepEquals, &log.Statement{
+		Verb:    "UPDATE",
+		Read:    []string{"db1.gonzo"},
+		Written: []string{"db2.tuningdetail_21_265507"},
+	})
+
+	// Classes not grouped by fingerprint have queries of many statements.
+	a = log.NewAggregator(log.AggregatorOptions{GroupBy: []string{"db"}})
+	for i := range events {
+		a.AddEvent(&events[i])
+	}
+	for _, class := range a.Finalize().Classes {
+		t.Check(class.Distill, Equals, "")
+		t.Check(class.Statement, IsNil)
+	}
+}
@@ -1,4 +1,34 @@
 package log
 
+import (
+	"context"
+)
+
+// A MySQLLogParser parses events from a MySQL log.  Callers depend on this
+// interface rather than a concrete parser so that log sources can be swapped
+// (e.g. a fake parser in tests).
 type MySQLLogParser interface {
+	// Start parses the log and sends each event on the Events channel.
+	// It blocks until the log is exhausted, ctx is done, or Stop is called,
+	// then closes the Events channel and returns the error that stopped
+	// parsing, if any.
+	Start(ctx context.Context) error
+
+	// Events returns the channel on which parsed events are sent.
+	Events() <-chan *Event
+
+	// Err returns the error that stopped parsing, if any.  It is only
+	// valid after the Events channel is closed.
+	Err() error
+
+	// Offset returns the byte offset of the end of the last event sent on
+	// the Events channel: a checkpoint.  Parsing again from this offset
+	// does not send any event twice or skip one.  It is only exact after
+	// the Events channel is closed; while parsing, it can lag the event
+	// just received, so checkpoint an event with its EndOffset instead.
+	Offset() uint64
+
+	// Stop stops the parser.  It can be called more than once and from
+	// any goroutine.
+	Stop()
 }
@@ -0,0 +1,303 @@
+package parser
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"github.com/vadimtk/mysql-log-parser/log"
+	"io"
+	l "log"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Regular expressions to match important lines in mysqlbinlog output, like:
+//
+//	# at 219
+//	#190108 11:43:40 server id 1  end_log_pos 298 CRC32 0x6a5b3a8c 	Query	thread_id=5	exec_time=0	error_code=0
+//	use `test`/*!*/;
+//	SET TIMESTAMP=1546947820/*!*/;
+//	insert into t values (1)
+//	/*!*/;
+var binlogAtRe = regexp.MustCompile(`^# at (\d+)$`)
+var binlogHeaderRe = regexp.MustCompile(`^#(\d{6}\s{1,2}\d{1,2}:\d\d:\d\d) server id (\d+)\s+end_log_pos (\d+)(?: CRC32 0x[0-9a-fA-F]+)?\s+(\w+)(.*)$`)
+var binlogQueryRe = regexp.MustCompile(`thread_id=(\d+)\s+exec_time=(\d+)\s+error_code=(\d+)`)
+var binlogTimestampRe = regexp.MustCompile(`(?i)^SET TIMESTAMP=(\d+)`)
+var binlogSessionRe = regexp.MustCompile(`(?i)^SET (?:TIMESTAMP|INSERT_ID|LAST_INSERT_ID|@@session\.)|^/\*!\\C`)
+
+// mysqlbinlog ends every statement with this delimiter.
+const BINLOG_DELIMITER = "/*!*/;"
+
+var _ log.MySQLLogParser = (*BinlogParser)(nil)
+
+// A BinlogParser parses the text output of mysqlbinlog.  Every Query event
+// and every Xid (COMMIT) event becomes a log.Event.  Query exec_time is the
+// Query_time metric so binlog events can be aggregated like slow log events;
+// an Xid event has no exec_time, so its Query_time is 0.  The server id,
+// binlog positions and thread id are not metrics but the Server_id, Pos,
+// End_log_pos and Thread_id Meta ids.
+type BinlogParser struct {
+	file     *os.File
+	stopChan <-chan bool
+	opt      Options
+	// --
+	EventChan  chan *log.Event
+	bytesRead  uint64
+	lineOffset uint64
+	stopped    bool
+	pos        uint64 // from last "# at" line
+	posOffset  uint64 // byte offset of last "# at" line
+	db         string
+	timestamp  int64 // from last SET TIMESTAMP
+	stmt       string
+	event      *log.Event
+	done       <-chan struct{}
+	stop       chan struct{}
+	stopOnce   sync.Once
+	offset     uint64 // atomic end of the last event sent, for Offset()
+	err        error
+}
+
+func NewBinlogParser(file *os.File, stopChan <-chan bool, opt Options) *BinlogParser {
+	// Seek to the offset, if any.
+	if opt.StartOffset > 0 {
+		file.Seek(int64(opt.StartOffset), os.SEEK_SET)
+	}
+
+	if opt.Debug {
+		l.SetFlags(l.Ltime | l.Lmicroseconds)
+		fmt.Println()
+		l.Println("parsing " + file.Name())
+	}
+
+	p := &BinlogParser{
+		stopChan:  stopChan,
+		opt:       opt,
+		file:      file,
+		EventChan: make(chan *log.Event),
+		bytesRead: opt.StartOffset,
+		stop:      make(chan struct{}),
+		offset:    opt.StartOffset,
+	}
+	return p
+}
+
+// Run parses the log like Start but without a context.  Events are sent on
+// EventChan.
+func (p *BinlogParser) Run() {
+	p.Start(context.Background())
+}
+
+// Start parses the log, sending events on EventChan, until EOF, ctx is done,
+// Stop is called, or the stop channel given to NewBinlogParser receives.
+func (p *BinlogParser) Start(ctx context.Context) error {
+	defer close(p.EventChan)
+
+	p.done = ctx.Done()
+	r := bufio.NewReader(p.file)
+
+SCANNER_LOOP:
+	for !p.stopped {
+		select {
+		case <-p.stopChan:
+			p.stopped = true
+			break SCANNER_LOOP
+		case <-p.stop:
+			p.stopped = true
+			break SCANNER_LOOP
+		case <-p.done:
+			p.stopped = true
+			break SCANNER_LOOP
+		default:
+		}
+
+		line, err := r.ReadString('\n')
+		if err != nil {
+			if err != io.EOF {
+				p.err = err
+				break SCANNER_LOOP
+			}
+			if line == "" {
+				break SCANNER_LOOP
+			}
+			// Last line without a newline; parse it, then the loop
+			// stops on the next ReadString.
+		}
+
+		lineLen := uint64(len(line))
+		p.bytesRead += lineLen
+		p.lineOffset = p.bytesRead - lineLen
+
+		if p.opt.Debug {
+			fmt.Println()
+			l.Printf("+%d line: %s", p.lineOffset, line)
+		}
+
+		line = strings.TrimSuffix(line, "\n")
+		line = strings.TrimSuffix(line, "\r")
+
+		if m := binlogAtRe.FindStringSubmatch(line); m != nil {
+			if p.opt.Debug {
+				l.Println("at")
+			}
+			p.sendEvent(p.lineOffset)
+			p.pos, _ = strconv.ParseUint(m[1], 10, 64)
+			p.posOffset = p.lineOffset
+		} else if m := binlogHeaderRe.FindStringSubmatch(line); m != nil {
+			p.sendEvent(p.lineOffset)
+			p.parseHeader(m)
+		} else if p.event != nil {
+			p.parseStatement(line)
+		}
+	}
+
+	if !p.stopped {
+		p.sendEvent(p.bytesRead)
+	}
+
+	if p.opt.Debug {
+		l.Printf("\ndone")
+	}
+
+	return p.err
+}
+
+// Events returns EventChan.
+func (p *BinlogParser) Events() <-chan *log.Event {
+	return p.EventChan
+}
+
+// Err returns the error that stopped Start, if any.
+func (p *BinlogParser) Err() error {
+	return p.err
+}
+
+// Offset returns the offset of the end of the last event sent (or skipped).
+// Parsing again with this StartOffset does not send any event twice or skip
+// one.
+// But session state from before the offset, like the db and the timestamp, is
+// not known then.
+func (p *BinlogParser) Offset() uint64 {
+	return atomic.LoadUint64(&p.offset)
+}
+
+// Stop stops Start.  It is safe to call more than once.
+func (p *BinlogParser) Stop() {
+	p.stopOnce.Do(func() { close(p.stop) })
+}
+
+// parseHeader starts a new event from the submatches of binlogHeaderRe:
+// [line, ts, server id, end_log_pos, event type, rest].  Only Query and Xid
+// (its statement is COMMIT) events start an event; the statements of other
+// binlog events are ignored.
+func (p *BinlogParser) parseHeader(m []string) {
+	if p.opt.Debug {
+		l.Println("header " + m[4])
+	}
+
+	p.stmt = ""
+	if m[4] != "Query" && m[4] != "Xid" {
+		return
+	}
+
+	e := log.NewEvent()
+	e.Offset = p.posOffset
+	e.Ts = m[1]
+	e.Db = p.db
+	e.Timestamp = p.timestamp
+	e.Meta = map[string]uint64{"Pos": p.pos}
+	e.Meta["Server_id"], _ = strconv.ParseUint(m[2], 10, 64)
+	e.Meta["End_log_pos"], _ = strconv.ParseUint(m[3], 10, 64)
+	e.TimeMetrics["Query_time"] = 0
+	if q := binlogQueryRe.FindStringSubmatch(m[5]); q != nil {
+		e.Meta["Thread_id"], _ = strconv.ParseUint(q[1], 10, 64)
+		execTime, _ := strconv.ParseUint(q[2], 10, 64)
+		e.TimeMetrics["Query_time"] = float32(execTime)
+		e.NumberMetrics["Error_code"], _ = strconv.ParseUint(q[3], 10, 64)
+	}
+	p.event = e
+}
+
+// parseStatement accumulates lines until the delimiter, then handles the
+// statement: use sets the db, SET TIMESTAMP sets the Timestamp, other session
+// SET statements are ignored, and anything else is the query.
+func (p *BinlogParser) parseStatement(line string) {
+	if p.stmt == "" && strings.HasPrefix(line, "#") {
+		// Comment, e.g. "### INSERT INTO" from mysqlbinlog --verbose.
+		return
+	}
+
+	if !strings.HasSuffix(line, BINLOG_DELIMITER) {
+		if p.stmt != "" {
+			p.stmt += "\n"
+		}
+		p.stmt += line
+		return
+	}
+
+	line = strings.TrimSuffix(line, BINLOG_DELIMITER)
+	if p.stmt != "" && line != "" {
+		p.stmt += "\n"
+	}
+	stmt := strings.TrimSpace(p.stmt + line)
+	p.stmt = ""
+
+	if p.opt.Debug {
+		l.Println("statement: " + stmt)
+	}
+
+	switch {
+	case stmt == "":
+	case strings.HasPrefix(stmt, "use "):
+		p.db = strings.Trim(strings.TrimPrefix(stmt, "use "), "`")
+		p.event.Db = p.db
+	case binlogSessionRe.MatchString(stmt):
+		// Session state: SET TIMESTAMP, SET @@session.sql_mode, etc.
+		if m := binlogTimestampRe.FindStringSubmatch(stmt); m != nil {
+			p.timestamp, _ = strconv.ParseInt(m[1], 10, 64)
+			p.event.Timestamp = p.timestamp
+		}
+	default:
+		if p.event.Query != "" {
+			p.event.Query += "\n"
+		}
+		p.event.Query += stmt
+	}
+}
+
+// sendEvent sends the current event, if any, which ends at offset end.
+func (p *BinlogParser) sendEvent(end uint64) {
+	if p.event == nil {
+		return
+	}
+
+	if p.opt.Debug {
+		l.Println("send event")
+	}
+
+	e := p.event
+	p.event = nil
+	p.stmt = ""
+
+	if e.Query == "" {
+		atomic.StoreUint64(&p.offset, end)
+		return
+	}
+	e.EndOffset = end
+
+	// Send the event.  This will block.
+	select {
+	case p.EventChan <- e:
+		atomic.StoreUint64(&p.offset, end)
+	case <-p.stopChan:
+		p.stopped = true
+	case <-p.stop:
+		p.stopped = true
+	case <-p.done:
+		p.stopped = true
+	}
+}
@@ -0,0 +1,26 @@
+package parser
+
+import (
+	"fmt"
+)
+
+// An ErrorPolicy determines what a parser does when it cannot parse an event.
+// Every ParseError is sent to Options.ErrorChan, if set, regardless of policy.
+type ErrorPolicy int
+
+const (
+	ERROR_SKIP ErrorPolicy = iota // skip the bad event and keep parsing
+	ERROR_STOP                    // stop parsing, Start returns nil
+	ERROR_FAIL                    // stop parsing, Start returns the ParseError
+)
+
+// A ParseError is a malformed line or event in a log.
+type ParseError struct {
+	Offset uint64 // byte offset of Line in the log
+	Line   string
+	Reason string
+}
+
+func (e ParseError) Error() string {
+	return fmt.Sprintf("%s at offset %d: %s", e.Reason, e.Offset, e.Line)
+}
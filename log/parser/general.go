@@ -0,0 +1,294 @@
+package parser
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"github.com/vadimtk/mysql-log-parser/log"
+	"io"
+	l "log"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Regular expressions to match important lines in general log.  A command
+// line is, with or without the leading timestamp:
+//
+//	140224 16:53:09	    1 Query	SELECT 1
+//			    1 Query	SELECT 2
+//	2014-02-24T16:53:09.123456Z	    1 Query	SELECT 3
+//
+// Any other line continues the argument (e.g. a multi-line query) of the
+// previous command line.
+var generalCmdRe = regexp.MustCompile(`^(\d{6}\s{1,2}\d{1,2}:\d\d:\d\d|\d{4}-\d\d-\d\dT\d\d:\d\d:\d\d(?:\.\d+)?(?:Z|[+-]\d\d:\d\d)?)?\s+(\d+) (` +
+	`Sleep|Quit|Init DB|Query|Field List|Create DB|Drop DB|Refresh|Shutdown|Statistics|Processlist|` +
+	`Connect|Kill|Debug|Ping|Time|Delayed insert|Change user|Binlog Dump|Binlog Dump GTID|Table Dump|` +
+	`Connect Out|Register Slave|Prepare|Execute|Long Data|Close stmt|Reset stmt|Set option|Fetch|` +
+	`Daemon|Reset Connection|Error)(?:\t(.*))?$`)
+var connectRe = regexp.MustCompile(`^(\S*)@(\S*)(?: (?:as \S+ )?on (\S*))?`)
+
+// General log commands whose argument is SQL.  All other commands are
+// admin commands, like administrator commands in the slow log.
+var sqlCommands = map[string]bool{
+	"Query":   true,
+	"Prepare": true,
+	"Execute": true,
+}
+
+type session struct {
+	user string
+	host string
+	db   string
+}
+
+var _ log.MySQLLogParser = (*GeneralLogParser)(nil)
+
+type GeneralLogParser struct {
+	file     *os.File
+	stopChan <-chan bool
+	opt      Options
+	// --
+	EventChan  chan *log.Event
+	bytesRead  uint64
+	lineOffset uint64
+	stopped    bool
+	ts         string
+	sessions   map[uint64]*session
+	event      *log.Event
+	done       <-chan struct{}
+	stop       chan struct{}
+	stopOnce   sync.Once
+	offset     uint64 // atomic end of the last event sent, for Offset()
+	err        error
+}
+
+func NewGeneralLogParser(file *os.File, stopChan <-chan bool, opt Options) *GeneralLogParser {
+	// Seek to the offset, if any.
+	if opt.StartOffset > 0 {
+		file.Seek(int64(opt.StartOffset), os.SEEK_SET)
+	}
+
+	if opt.Debug {
+		l.SetFlags(l.Ltime | l.Lmicroseconds)
+		fmt.Println()
+		l.Println("parsing " + file.Name())
+	}
+
+	p := &GeneralLogParser{
+		stopChan:  stopChan,
+		opt:       opt,
+		file:      file,
+		EventChan: make(chan *log.Event),
+		bytesRead: opt.StartOffset,
+		sessions:  make(map[uint64]*session),
+		stop:      make(chan struct{}),
+		offset:    opt.StartOffset,
+	}
+	return p
+}
+
+// Run parses the log like Start but without a context.  Events are sent on
+// EventChan.
+func (p *GeneralLogParser) Run() {
+	p.Start(context.Background())
+}
+
+// Start parses the log, sending events on EventChan, until EOF, ctx is done,
+// Stop is called, or the stop channel given to NewGeneralLogParser receives.
+func (p *GeneralLogParser) Start(ctx context.Context) error {
+	defer close(p.EventChan)
+
+	p.done = ctx.Done()
+	r := bufio.NewReader(p.file)
+
+SCANNER_LOOP:
+	for !p.stopped {
+		select {
+		case <-p.stopChan:
+			p.stopped = true
+			break SCANNER_LOOP
+		case <-p.stop:
+			p.stopped = true
+			break SCANNER_LOOP
+		case <-p.done:
+			p.stopped = true
+			break SCANNER_LOOP
+		default:
+		}
+
+		line, err := r.ReadString('\n')
+		if err != nil {
+			if err != io.EOF {
+				p.err = err
+				break SCANNER_LOOP
+			}
+			if line == "" {
+				break SCANNER_LOOP
+			}
+			// Last line without a newline; parse it, then the loop
+			// stops on the next ReadString.
+		}
+
+		lineLen := uint64(len(line))
+		p.bytesRead += lineLen
+		p.lineOffset = p.bytesRead - lineLen
+
+		if p.opt.Debug {
+			fmt.Println()
+			l.Printf("+%d line: %s", p.lineOffset, line)
+		}
+
+		// mysqld writes the meta lines again every time it (re)opens the log,
+		// so they also end the previous command.
+		if isMetaLine(line) {
+			if p.opt.Debug {
+				l.Println("meta")
+			}
+			p.sendEvent(p.lineOffset)
+			continue
+		}
+
+		line = strings.TrimSuffix(line, "\n")
+		line = strings.TrimSuffix(line, "\r")
+
+		if m := generalCmdRe.FindStringSubmatch(line); m != nil {
+			p.sendEvent(p.lineOffset)
+			p.parseCommand(m)
+		} else if p.event != nil {
+			if p.opt.Debug {
+				l.Println("query")
+			}
+			p.event.Query += "\n" + line
+		}
+	}
+
+	if !p.stopped {
+		p.sendEvent(p.bytesRead)
+	}
+
+	if p.opt.Debug {
+		l.Printf("\ndone")
+	}
+
+	return p.err
+}
+
+// Events returns EventChan.
+func (p *GeneralLogParser) Events() <-chan *log.Event {
+	return p.EventChan
+}
+
+// Err returns the error that stopped Start, if any.
+func (p *GeneralLogParser) Err() error {
+	return p.err
+}
+
+// Offset returns the offset of the end of the last event sent (or skipped).
+// Parsing again with this StartOffset does not send any event twice or skip
+// one.
+// But session state from before the offset, like the user and db of a
+// thread, is not known then.
+func (p *GeneralLogParser) Offset() uint64 {
+	return atomic.LoadUint64(&p.offset)
+}
+
+// Stop stops Start.  It is safe to call more than once.
+func (p *GeneralLogParser) Stop() {
+	p.stopOnce.Do(func() { close(p.stop) })
+}
+
+// parseCommand starts a new event from the submatches of generalCmdRe:
+// [line, ts, thread id, command, argument].
+func (p *GeneralLogParser) parseCommand(m []string) {
+	if p.opt.Debug {
+		l.Println("command")
+	}
+
+	// Like the slow log, mysqld only writes the time when it changes.
+	if m[1] != "" {
+		p.ts = m[1]
+	}
+	threadId, _ := strconv.ParseUint(m[2], 10, 64)
+	cmd := m[3]
+	arg := m[4]
+
+	s, ok := p.sessions[threadId]
+	if !ok {
+		s = &session{}
+		p.sessions[threadId] = s
+	}
+
+	switch cmd {
+	case "Connect":
+		if c := connectRe.FindStringSubmatch(arg); c != nil {
+			s.user = c[1]
+			s.host = c[2]
+			s.db = c[3]
+		}
+	case "Init DB":
+		s.db = arg
+	case "Query":
+		if strings.HasPrefix(arg, "use ") {
+			s.db = strings.Trim(strings.TrimRight(strings.TrimPrefix(arg, "use "), "; "), "`")
+		}
+	}
+
+	e := log.NewEvent()
+	e.Offset = p.lineOffset
+	e.Ts = p.ts
+	e.Command = cmd
+	e.User = s.user
+	e.Host = s.host
+	e.Db = s.db
+	e.Meta = map[string]uint64{"Thread_id": threadId}
+	if sqlCommands[cmd] {
+		e.Query = arg
+	} else {
+		e.Admin = true
+		e.Query = cmd
+	}
+	p.event = e
+
+	if cmd == "Quit" {
+		delete(p.sessions, threadId)
+	}
+}
+
+// sendEvent sends the current event, if any, which ends at offset end.
+func (p *GeneralLogParser) sendEvent(end uint64) {
+	if p.event == nil {
+		return
+	}
+
+	if p.opt.Debug {
+		l.Println("send event")
+	}
+
+	e := p.event
+	p.event = nil
+
+	if e.Admin && p.opt.FilterAdminCommand[e.Query] {
+		if p.opt.Debug {
+			l.Println("filtered")
+		}
+		atomic.StoreUint64(&p.offset, end)
+		return
+	}
+	e.EndOffset = end
+
+	// Send the event.  This will block.
+	select {
+	case p.EventChan <- e:
+		atomic.StoreUint64(&p.offset, end)
+	case <-p.stopChan:
+		p.stopped = true
+	case <-p.stop:
+		p.stopped = true
+	case <-p.done:
+		p.stopped = true
+	}
+}
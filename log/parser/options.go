@@ -1,8 +1,17 @@
 package parser
 
+import (
+	"time"
+)
+
 type Options struct {
 	StartOffset        uint64
+	EndOffset          uint64 // slow log: stop before the first event that begins at or after it (0: EOF)
 	ExampleQueries     bool
 	FilterAdminCommand map[string]bool
 	Debug              bool
+	ErrorPolicy        ErrorPolicy   // what to do on a ParseError (default: ERROR_SKIP)
+	ErrorChan          chan<- error  // if set, receives every ParseError
+	Follow             bool          // keep reading at EOF, like tail -F
+	FollowInterval     time.Duration // how often to check for new data (default: 1s)
 }
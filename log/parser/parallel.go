@@ -0,0 +1,305 @@
+package parser
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"github.com/vadimtk/mysql-log-parser/log"
+	"io"
+	l "log"
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+// Default size of the chunks that a ParallelSlowLogParser parses concurrently.
+const PARALLEL_CHUNK_SIZE = 32 * 1024 * 1024
+
+var _ log.MySQLLogParser = (*ParallelSlowLogParser)(nil)
+
+// A ParallelSlowLogParser parses a large slow log file faster by splitting it
+// into chunks of about ChunkSize bytes, each aligned to the start of an event,
+// and parsing several chunks at once with SlowLogParsers.  Events are sent in
+// the same order as SlowLogParser sends them, so aggregating them gives the
+// same GlobalClass and QueryClasses.  At most workers chunks are parsed and
+// buffered ahead of the chunk being sent.  ParseErrors are sent to ErrorChan
+// as the chunks are parsed, so they are not in order, and with ERROR_STOP or
+// ERROR_FAIL, errors after the first one can be sent too.
+type ParallelSlowLogParser struct {
+	file     *os.File
+	stopChan <-chan bool
+	opt      Options
+	workers  int
+	// --
+	ChunkSize uint64
+	EventChan chan *log.Event
+	size      uint64 // of the file
+	stopped   bool
+	done      <-chan struct{}
+	stop      chan struct{}
+	stopOnce  sync.Once
+	offset    uint64 // atomic end of the last event sent, for Offset()
+	err       error
+}
+
+// A chunk is a range of the log parsed by one SlowLogParser.
+type chunk struct {
+	start      uint64
+	end        uint64
+	events     []*log.Event
+	checkpoint uint64 // Offset of the parser after the last event
+	last       bool
+	stopped    bool // by ErrorPolicy
+	err        error
+	parsed     chan struct{}
+}
+
+func NewParallelSlowLogParser(file *os.File, stopChan <-chan bool, opt Options, workers int) *ParallelSlowLogParser {
+	if workers < 1 {
+		workers = 1
+	}
+
+	if opt.Debug {
+		l.SetFlags(l.Ltime | l.Lmicroseconds)
+		fmt.Println()
+		l.Printf("parsing %s with %d workers", file.Name(), workers)
+	}
+
+	p := &ParallelSlowLogParser{
+		file:      file,
+		stopChan:  stopChan,
+		opt:       opt,
+		workers:   workers,
+		ChunkSize: PARALLEL_CHUNK_SIZE,
+		EventChan: make(chan *log.Event),
+		stop:      make(chan struct{}),
+		offset:    opt.StartOffset,
+	}
+	return p
+}
+
+// Run parses the log like Start but without a context.  Events are sent on
+// EventChan.
+func (p *ParallelSlowLogParser) Run() {
+	p.Start(context.Background())
+}
+
+// Start parses the log, sending events on EventChan, until EOF or EndOffset,
+// ctx is done, Stop is called, or the stop channel given to
+// NewParallelSlowLogParser receives.  StartOffset must be the start of an
+// event, like an Offset from a previous parse.  Follow is not supported.
+func (p *ParallelSlowLogParser) Start(ctx context.Context) error {
+	defer close(p.EventChan)
+
+	p.done = ctx.Done()
+	ctx, cancel := context.WithCancel(ctx)
+
+	info, err := p.file.Stat()
+	if err != nil {
+		cancel()
+		p.err = err
+		return p.err
+	}
+	p.size = uint64(info.Size())
+	size := p.size
+	if p.opt.EndOffset > 0 && p.opt.EndOffset < size {
+		size = p.opt.EndOffset
+	}
+
+	// Chunks are split in order and queued to be sent in that order, and
+	// queued to be parsed by the workers.  Splitting blocks when workers
+	// chunks are waiting to be sent, which limits memory use.
+	jobs := make(chan *chunk, p.workers)
+	chunks := make(chan *chunk, p.workers)
+	var wg sync.WaitGroup
+	wg.Add(p.workers + 1)
+	go func() {
+		defer wg.Done()
+		p.split(ctx, size, jobs, chunks)
+	}()
+	for i := 0; i < p.workers; i++ {
+		go func() {
+			defer wg.Done()
+			for c := range jobs {
+				p.parseChunk(ctx, c)
+			}
+		}()
+	}
+
+CHUNK_LOOP:
+	for c := range chunks {
+		select {
+		case <-c.parsed:
+		case <-p.stopChan:
+			p.stopped = true
+			break CHUNK_LOOP
+		case <-p.stop:
+			p.stopped = true
+			break CHUNK_LOOP
+		case <-p.done:
+			p.stopped = true
+			break CHUNK_LOOP
+		}
+
+		if p.opt.Debug {
+			l.Printf("chunk %d-%d: %d events", c.start, c.end, len(c.events))
+		}
+
+		for _, e := range c.events {
+			// Send the event.  This will block.
+			select {
+			case p.EventChan <- e:
+				atomic.StoreUint64(&p.offset, e.EndOffset)
+			case <-p.stopChan:
+				p.stopped = true
+				break CHUNK_LOOP
+			case <-p.stop:
+				p.stopped = true
+				break CHUNK_LOOP
+			case <-p.done:
+				p.stopped = true
+				break CHUNK_LOOP
+			}
+		}
+
+		if c.err != nil {
+			p.err = c.err
+			break CHUNK_LOOP
+		}
+		if c.stopped {
+			break CHUNK_LOOP
+		}
+		atomic.StoreUint64(&p.offset, c.checkpoint)
+	}
+
+	// Stop the workers, and wait so they are done with the file.
+	cancel()
+	wg.Wait()
+
+	if p.opt.Debug {
+		l.Printf("\ndone")
+	}
+
+	return p.err
+}
+
+// Events returns EventChan.
+func (p *ParallelSlowLogParser) Events() <-chan *log.Event {
+	return p.EventChan
+}
+
+// Err returns the error that stopped Start, if any.
+func (p *ParallelSlowLogParser) Err() error {
+	return p.err
+}
+
+// Offset returns the offset of the end of the last event sent (or skipped).
+// Parsing again with this StartOffset, with a ParallelSlowLogParser or a
+// SlowLogParser, does not send any event twice or skip one.
+func (p *ParallelSlowLogParser) Offset() uint64 {
+	return atomic.LoadUint64(&p.offset)
+}
+
+// Stop stops Start.  It is safe to call more than once.
+func (p *ParallelSlowLogParser) Stop() {
+	p.stopOnce.Do(func() { close(p.stop) })
+}
+
+// split splits the log from StartOffset to size into chunks.  It closes jobs
+// and chunks when done.
+func (p *ParallelSlowLogParser) split(ctx context.Context, size uint64, jobs chan<- *chunk, chunks chan<- *chunk) {
+	defer close(jobs)
+	defer close(chunks)
+
+	for start := p.opt.StartOffset; start < size; {
+		c := &chunk{
+			start:  start,
+			parsed: make(chan struct{}),
+		}
+		c.end, c.err = alignOffset(p.file, start+p.ChunkSize, size)
+		c.last = c.end >= size
+		if c.err != nil {
+			close(c.parsed)
+			select {
+			case chunks <- c:
+			case <-ctx.Done():
+			}
+			return
+		}
+
+		select {
+		case chunks <- c:
+		case <-ctx.Done():
+			return
+		}
+		select {
+		case jobs <- c:
+		case <-ctx.Done():
+			return
+		}
+		start = c.end
+	}
+}
+
+// parseChunk parses the events of the chunk into c.events.
+func (p *ParallelSlowLogParser) parseChunk(ctx context.Context, c *chunk) {
+	defer close(c.parsed)
+
+	// The chunk ends at the start of an event, except the last one, which
+	// ends at EOF or EndOffset like a SlowLogParser.
+	opt := p.opt
+	opt.StartOffset = c.start
+	if !c.last {
+		opt.EndOffset = c.end
+	}
+	opt.Follow = false
+	r := io.NewSectionReader(p.file, int64(c.start), int64(p.size-c.start))
+	sp := newSlowLogParser(r, nil, nil, opt)
+	// Only the first chunk can start in the middle of an event.
+	sp.firstEvent = c.start == p.opt.StartOffset
+
+	go sp.Start(ctx)
+	for e := range sp.EventChan {
+		c.events = append(c.events, e)
+	}
+	c.checkpoint = sp.Offset()
+	c.stopped = sp.stopped
+	c.err = sp.err
+}
+
+// alignOffset returns the offset of the first event that begins at or after
+// off: the first header line after a line that is not a header line, as the
+// SlowLogParser sees it.  It returns size if there is none.
+func alignOffset(file io.ReaderAt, off uint64, size uint64) (uint64, error) {
+	if off >= size {
+		return size, nil
+	}
+
+	// Start reading at the byte before off so the first line read is the end
+	// of the line that off is in, or just "\n" if off is the start of a line.
+	// Either way, the line before the next one is not known.
+	off--
+	r := bufio.NewReader(io.NewSectionReader(file, int64(off), int64(size-off)))
+	first := true
+	afterNonHeader := false
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return 0, err
+		}
+		if line == "" {
+			return size, nil
+		}
+		if first {
+			first = false
+		} else if headerRe.MatchString(line) {
+			if afterNonHeader {
+				return off, nil
+			}
+		} else if !isMetaLine(line) {
+			// Meta lines are skipped, so they do not end the header.
+			afterNonHeader = true
+		}
+		off += uint64(len(line))
+	}
+}
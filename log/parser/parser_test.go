@@ -1,11 +1,20 @@
 package parser_test
 
 import (
+	"bytes"
+	"context"
+	"fmt"
 	"github.com/percona/mysql-log-parser/log"
 	"github.com/percona/mysql-log-parser/log/parser"
 	. "github.com/percona/mysql-log-parser/test"
+	"io"
+	"io/ioutil"
 	. "launchpad.net/gocheck"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 )
 
 // Hook gocheck into the "go test" runner.
@@ -35,13 +44,14 @@ func (s *SlowLogTestSuite) TestParserSlowLog001(t *C) {
 	got := ParseSlowLog("slow001.log", s.opt)
 	expect := []log.Event{
 		{
-			Ts:     "071015 21:43:52",
-			Admin:  false,
-			Query:  `select sleep(2) from n`,
-			User:   "root",
-			Host:   "localhost",
-			Db:     "test",
-			Offset: 200,
+			Ts:        "071015 21:43:52",
+			Admin:     false,
+			Query:     `select sleep(2) from n`,
+			User:      "root",
+			Host:      "localhost",
+			Db:        "test",
+			Offset:    199,
+			EndOffset: 358,
 			TimeMetrics: map[string]float32{
 				"Query_time": 2,
 				"Lock_time":  0,
@@ -53,13 +63,14 @@ func (s *SlowLogTestSuite) TestParserSlowLog001(t *C) {
 			BoolMetrics: map[string]bool{},
 		},
 		{
-			Ts:     "071015 21:45:10",
-			Admin:  false,
-			Query:  `select sleep(2) from test.n`,
-			User:   "root",
-			Host:   "localhost",
-			Db:     "sakila",
-			Offset: 359,
+			Ts:        "071015 21:45:10",
+			Admin:     false,
+			Query:     `select sleep(2) from test.n`,
+			User:      "root",
+			Host:      "localhost",
+			Db:        "sakila",
+			Offset:    358,
+			EndOffset: 524,
 			TimeMetrics: map[string]float32{
 				"Query_time": 2,
 				"Lock_time":  0,
@@ -82,12 +93,13 @@ func (s *SlowLogTestSuite) TestParseSlowLog002(t *C) {
 	got := ParseSlowLog("slow002.log", s.opt)
 	expect := []log.Event{
 		{
-			Query:  "BEGIN",
-			Ts:     "071218 11:48:27",
-			Admin:  false,
-			User:   "[SQL_SLAVE]",
-			Host:   "",
-			Offset: 0,
+			Query:     "BEGIN",
+			Ts:        "071218 11:48:27",
+			Admin:     false,
+			User:      "[SQL_SLAVE]",
+			Host:      "",
+			Offset:    0,
+			EndOffset: 337,
 			TimeMetrics: map[string]float32{
 				"Query_time": 0.000012,
 				"Lock_time":  0.000000,
@@ -113,10 +125,12 @@ func (s *SlowLogTestSuite) TestParseSlowLog002(t *C) {
 			Query: `update db2.tuningdetail_21_265507 n
       inner join db1.gonzo a using(gonzo) 
       set n.column1 = a.column1, n.word3 = a.word3`,
-			Admin:  false,
-			User:   "[SQL_SLAVE]",
-			Host:   "",
-			Offset: 338,
+			Admin:     false,
+			User:      "[SQL_SLAVE]",
+			Host:      "",
+			Offset:    337,
+			EndOffset: 814,
+			Timestamp: 1197996507,
 			TimeMetrics: map[string]float32{
 				"Query_time": 0.726052,
 				"Lock_time":  0.000091,
@@ -140,10 +154,12 @@ func (s *SlowLogTestSuite) TestParseSlowLog002(t *C) {
 		{
 			Query: `INSERT INTO db3.vendor11gonzo (makef, bizzle)
 VALUES ('', 'Exact')`,
-			Admin:  false,
-			User:   "[SQL_SLAVE]",
-			Host:   "",
-			Offset: 815,
+			Admin:     false,
+			User:      "[SQL_SLAVE]",
+			Host:      "",
+			Offset:    814,
+			EndOffset: 1333,
+			Timestamp: 1197996507,
 			TimeMetrics: map[string]float32{
 				"InnoDB_queue_wait":    0.000000,
 				"Lock_time":            0.000077,
@@ -174,10 +190,11 @@ VALUES ('', 'Exact')`,
 			Query: `UPDATE db4.vab3concept1upload
 SET    vab3concept1id = '91848182522'
 WHERE  vab3concept1upload='6994465'`,
-			Admin:  false,
-			User:   "[SQL_SLAVE]",
-			Host:   "",
-			Offset: 1334,
+			Admin:     false,
+			User:      "[SQL_SLAVE]",
+			Host:      "",
+			Offset:    1333,
+			EndOffset: 1863,
 			TimeMetrics: map[string]float32{
 				"Query_time":           0.033384,
 				"InnoDB_IO_r_wait":     0.000000,
@@ -207,10 +224,12 @@ WHERE  vab3concept1upload='6994465'`,
 		{
 			Query: `INSERT INTO db1.conch (word3, vid83)
 VALUES ('211', '18')`,
-			Admin:  false,
-			User:   "[SQL_SLAVE]",
-			Host:   "",
-			Offset: 1864,
+			Admin:     false,
+			User:      "[SQL_SLAVE]",
+			Host:      "",
+			Offset:    1863,
+			EndOffset: 2392,
+			Timestamp: 1197996507,
 			TimeMetrics: map[string]float32{
 				"InnoDB_queue_wait":    0.000000,
 				"Query_time":           0.000530,
@@ -240,10 +259,11 @@ VALUES ('211', '18')`,
 		{
 			Query: `UPDATE foo.bar
 SET    biz = '91848182522'`,
-			Admin:  false,
-			User:   "[SQL_SLAVE]",
-			Host:   "",
-			Offset: 2393,
+			Admin:     false,
+			User:      "[SQL_SLAVE]",
+			Host:      "",
+			Offset:    2392,
+			EndOffset: 2860,
 			TimeMetrics: map[string]float32{
 				"Lock_time":            0.000027,
 				"InnoDB_rec_lock_wait": 0.000000,
@@ -274,10 +294,12 @@ SET    biz = '91848182522'`,
 			Query: `UPDATE bizzle.bat
 SET    boop='bop: 899'
 WHERE  fillze='899'`,
-			Admin:  false,
-			User:   "[SQL_SLAVE]",
-			Host:   "",
-			Offset: 2861,
+			Admin:     false,
+			User:      "[SQL_SLAVE]",
+			Host:      "",
+			Offset:    2860,
+			EndOffset: 3373,
+			Timestamp: 1197996508,
 			TimeMetrics: map[string]float32{
 				"Query_time":           0.000530,
 				"InnoDB_IO_r_wait":     0.000000,
@@ -307,10 +329,11 @@ WHERE  fillze='899'`,
 		{
 			Query: `UPDATE foo.bar
 SET    biz = '91848182522'`,
-			Admin:  false,
-			User:   "[SQL_SLAVE]",
-			Host:   "",
-			Offset: 3374,
+			Admin:     false,
+			User:      "[SQL_SLAVE]",
+			Host:      "",
+			Offset:    3373,
+			EndOffset: 3841,
 			TimeMetrics: map[string]float32{
 				"Query_time":           0.000530,
 				"Lock_time":            0.000027,
@@ -349,12 +372,13 @@ func (s *SlowLogTestSuite) TestParserSlowLog003(t *C) {
 	got := ParseSlowLog("slow003.log", s.opt)
 	expect := []log.Event{
 		{
-			Query:  "BEGIN",
-			Admin:  false,
-			Host:   "",
-			Ts:     "071218 11:48:27",
-			User:   "[SQL_SLAVE]",
-			Offset: 2,
+			Query:     "BEGIN",
+			Admin:     false,
+			Host:      "",
+			Ts:        "071218 11:48:27",
+			User:      "[SQL_SLAVE]",
+			Offset:    1,
+			EndOffset: 338,
 			BoolMetrics: map[string]bool{
 				"Filesort_on_disk":  false,
 				"Tmp_table_on_disk": false,
@@ -392,7 +416,8 @@ func (s *SlowLogTestSuite) TestParserSlowLog004(t *C) {
 			Host:        "localhost",
 			Ts:          "071015 21:43:52",
 			User:        "root",
-			Offset:      200,
+			Offset:      199,
+			EndOffset:   385,
 			BoolMetrics: map[string]bool{},
 			TimeMetrics: map[string]float32{
 				"Lock_time":  0.000000,
@@ -412,21 +437,24 @@ func (s *SlowLogTestSuite) TestParserSlowLog004(t *C) {
 
 // slow005 has a multi-line query with tabs in it.  A pathological case that
 // would probably break the parser is a query like:
-//   SELECT * FROM foo WHERE col = "Hello
-//   # Query_time: 10
-//   " LIMIT 1;
+//
+//	SELECT * FROM foo WHERE col = "Hello
+//	# Query_time: 10
+//	" LIMIT 1;
+//
 // There's no easy way to detect that "# Query_time" is part of the query and
 // not part of the next event's header.
 func (s *SlowLogTestSuite) TestParserSlowLog005(t *C) {
 	got := ParseSlowLog("slow005.log", s.opt)
 	expect := []log.Event{
 		{
-			Query:  "foo\nbar\n\t\t\t0 AS counter\nbaz",
-			Admin:  false,
-			Host:   "",
-			Ts:     "071218 11:48:27",
-			User:   "[SQL_SLAVE]",
-			Offset: 0,
+			Query:     "foo\nbar\n\t\t\t0 AS counter\nbaz",
+			Admin:     false,
+			Host:      "",
+			Ts:        "071218 11:48:27",
+			User:      "[SQL_SLAVE]",
+			Offset:    0,
+			EndOffset: 359,
 			BoolMetrics: map[string]bool{
 				"Filesort_on_disk":  false,
 				"Tmp_table_on_disk": false,
@@ -460,13 +488,14 @@ func (s *SlowLogTestSuite) TestParserSlowLog006(t *C) {
 	got := ParseSlowLog("slow006.log", s.opt)
 	expect := []log.Event{
 		{
-			Query:  "SELECT col FROM foo_tbl",
-			Db:     "foo",
-			Admin:  false,
-			Host:   "",
-			Ts:     "071218 11:48:27",
-			User:   "[SQL_SLAVE]",
-			Offset: 0,
+			Query:     "SELECT col FROM foo_tbl",
+			Db:        "foo",
+			Admin:     false,
+			Host:      "",
+			Ts:        "071218 11:48:27",
+			User:      "[SQL_SLAVE]",
+			Offset:    0,
+			EndOffset: 368,
 			BoolMetrics: map[string]bool{
 				"Filesort_on_disk":  false,
 				"Tmp_table_on_disk": false,
@@ -488,13 +517,14 @@ func (s *SlowLogTestSuite) TestParserSlowLog006(t *C) {
 			},
 		},
 		{
-			Query:  "SELECT col FROM foo_tbl",
-			Db:     "foo",
-			Admin:  false,
-			Host:   "",
-			Ts:     "071218 11:48:57",
-			User:   "[SQL_SLAVE]",
-			Offset: 369,
+			Query:     "SELECT col FROM foo_tbl",
+			Db:        "foo",
+			Admin:     false,
+			Host:      "",
+			Ts:        "071218 11:48:57",
+			User:      "[SQL_SLAVE]",
+			Offset:    368,
+			EndOffset: 736,
 			BoolMetrics: map[string]bool{
 				"Filesort_on_disk":  false,
 				"Tmp_table_on_disk": false,
@@ -516,13 +546,14 @@ func (s *SlowLogTestSuite) TestParserSlowLog006(t *C) {
 			},
 		},
 		{
-			Query:  "SELECT col FROM bar_tbl",
-			Db:     "bar",
-			Admin:  false,
-			Host:   "",
-			Ts:     "071218 11:48:57",
-			User:   "[SQL_SLAVE]",
-			Offset: 737,
+			Query:     "SELECT col FROM bar_tbl",
+			Db:        "bar",
+			Admin:     false,
+			Host:      "",
+			Ts:        "071218 11:48:57",
+			User:      "[SQL_SLAVE]",
+			Offset:    736,
+			EndOffset: 1100,
 			BoolMetrics: map[string]bool{
 				"Filesort_on_disk":  false,
 				"Tmp_table_on_disk": false,
@@ -544,13 +575,14 @@ func (s *SlowLogTestSuite) TestParserSlowLog006(t *C) {
 			},
 		},
 		{
-			Query:  "SELECT col FROM bar_tbl",
-			Db:     "bar",
-			Admin:  false,
-			Host:   "",
-			Ts:     "071218 11:49:05",
-			User:   "[SQL_SLAVE]",
-			Offset: 1101,
+			Query:     "SELECT col FROM bar_tbl",
+			Db:        "bar",
+			Admin:     false,
+			Host:      "",
+			Ts:        "071218 11:49:05",
+			User:      "[SQL_SLAVE]",
+			Offset:    1100,
+			EndOffset: 1468,
 			BoolMetrics: map[string]bool{
 				"Filesort_on_disk":  false,
 				"Tmp_table_on_disk": false,
@@ -572,13 +604,14 @@ func (s *SlowLogTestSuite) TestParserSlowLog006(t *C) {
 			},
 		},
 		{
-			Query:  "SELECT col FROM bar_tbl",
-			Db:     "bar",
-			Admin:  false,
-			Host:   "",
-			Ts:     "071218 11:49:07",
-			User:   "[SQL_SLAVE]",
-			Offset: 1469,
+			Query:     "SELECT col FROM bar_tbl",
+			Db:        "bar",
+			Admin:     false,
+			Host:      "",
+			Ts:        "071218 11:49:07",
+			User:      "[SQL_SLAVE]",
+			Offset:    1468,
+			EndOffset: 1832,
 			BoolMetrics: map[string]bool{
 				"Filesort_on_disk":  false,
 				"Tmp_table_on_disk": false,
@@ -600,13 +633,14 @@ func (s *SlowLogTestSuite) TestParserSlowLog006(t *C) {
 			},
 		},
 		{
-			Query:  "SELECT col FROM foo_tbl",
-			Db:     "foo",
-			Admin:  false,
-			Host:   "",
-			Ts:     "071218 11:49:30",
-			User:   "[SQL_SLAVE]",
-			Offset: 1833,
+			Query:     "SELECT col FROM foo_tbl",
+			Db:        "foo",
+			Admin:     false,
+			Host:      "",
+			Ts:        "071218 11:49:30",
+			User:      "[SQL_SLAVE]",
+			Offset:    1832,
+			EndOffset: 2200,
 			BoolMetrics: map[string]bool{
 				"Filesort_on_disk":  false,
 				"Tmp_table_on_disk": false,
@@ -646,6 +680,7 @@ func (s *SlowLogTestSuite) TestParserSlowLog007(t *C) {
 			Ts:          "071218 11:48:27",
 			User:        "[SQL_SLAVE]",
 			Offset:      0,
+			EndOffset:   193,
 			BoolMetrics: map[string]bool{},
 			TimeMetrics: map[string]float32{
 				"Query_time": 0.000012,
@@ -666,10 +701,10 @@ func (s *SlowLogTestSuite) TestParserSlowLog007(t *C) {
 
 // slow008 has 4 interesting things (which makes it a poor test case since we're
 // testing many things at once):
-//   1) an admin command, e.g.: # administrator command: Quit;
-//   2) a SET NAMES query; SET <certain vars> are ignored
-//   3) No Time metrics
-//   4) IPs in the host metric, but we don't currently support these
+//  1. an admin command, e.g.: # administrator command: Quit;
+//  2. a SET NAMES query; SET <certain vars> are ignored
+//  3. No Time metrics
+//  4. IPs in the host metric, but we don't currently support these
 func (s *SlowLogTestSuite) TestParserSlowLog008(t *C) {
 	got := ParseSlowLog("slow008.log", s.opt)
 	expect := []log.Event{
@@ -680,6 +715,7 @@ func (s *SlowLogTestSuite) TestParserSlowLog008(t *C) {
 			Host:        "",
 			User:        "meow",
 			Offset:      0,
+			EndOffset:   220,
 			BoolMetrics: map[string]bool{},
 			TimeMetrics: map[string]float32{
 				"Query_time": 0.000002,
@@ -697,7 +733,8 @@ func (s *SlowLogTestSuite) TestParserSlowLog008(t *C) {
 			Admin:       false,
 			Host:        "",
 			User:        "meow",
-			Offset:      221,
+			Offset:      220,
+			EndOffset:   434,
 			BoolMetrics: map[string]bool{},
 			TimeMetrics: map[string]float32{
 				"Query_time": 0.000899,
@@ -715,7 +752,8 @@ func (s *SlowLogTestSuite) TestParserSlowLog008(t *C) {
 			Admin:       false,
 			Host:        "",
 			User:        "meow",
-			Offset:      435,
+			Offset:      434,
+			EndOffset:   656,
 			BoolMetrics: map[string]bool{},
 			TimeMetrics: map[string]float32{
 				"Query_time": 0.018799,
@@ -744,13 +782,14 @@ func (s *SlowLogTestSuite) TestParserSlowLog009(t *C) {
 	got := ParseSlowLog("slow009.log", opt)
 	expect := []log.Event{
 		{
-			Query:  "Refresh",
-			Db:     "",
-			Admin:  true,
-			Host:   "localhost",
-			User:   "root",
-			Offset: 197,
-			Ts:     "090311 18:11:50",
+			Query:     "Refresh",
+			Db:        "",
+			Admin:     true,
+			Host:      "localhost",
+			User:      "root",
+			Offset:    196,
+			EndOffset: 562,
+			Ts:        "090311 18:11:50",
 			TimeMetrics: map[string]float32{
 				"Query_time": 0.017850,
 				"Lock_time":  0.000000,
@@ -783,6 +822,8 @@ func (s *SlowLogTestSuite) TestParserSlowLog011(t *C) {
 	expect := []log.Event{
 		{
 			Offset:    0,
+			EndOffset: 732,
+			Timestamp: 1385600731,
 			Query:     "SELECT foo FROM bar WHERE id=1",
 			Db:        "maindb",
 			Host:      "localhost",
@@ -821,7 +862,9 @@ func (s *SlowLogTestSuite) TestParserSlowLog011(t *C) {
 			},
 		},
 		{
-			Offset:    733,
+			Offset:    732,
+			EndOffset: 1440,
+			Timestamp: 1385600731,
 			Query:     "SELECT foo FROM bar WHERE id=2",
 			Db:        "maindb",
 			Host:      "localhost",
@@ -859,7 +902,9 @@ func (s *SlowLogTestSuite) TestParserSlowLog011(t *C) {
 			},
 		},
 		{
-			Offset:    1441,
+			Offset:    1440,
+			EndOffset: 2152,
+			Timestamp: 1385600731,
 			Query:     "INSERT INTO foo VALUES (NULL, 3)",
 			Db:        "maindb",
 			Host:      "localhost",
@@ -907,11 +952,13 @@ func (s *SlowLogTestSuite) TestParserSlowLog012(t *C) {
 	got := ParseSlowLog("slow012.log", s.opt)
 	expect := []log.Event{
 		{
-			Query:  "select * from mysql.user",
-			Db:     "",
-			Host:   "localhost",
-			User:   "msandbox",
-			Offset: 0,
+			Query:     "select * from mysql.user",
+			Db:        "",
+			Host:      "localhost",
+			User:      "msandbox",
+			Offset:    0,
+			EndOffset: 185,
+			Timestamp: 1397442852,
 			TimeMetrics: map[string]float32{
 				"Query_time": 0.000214,
 				"Lock_time":  0.000086,
@@ -922,12 +969,14 @@ func (s *SlowLogTestSuite) TestParserSlowLog012(t *C) {
 			},
 		},
 		{
-			Query:  "Quit",
-			Admin:  true,
-			Db:     "",
-			Host:   "localhost",
-			User:   "msandbox",
-			Offset: 186,
+			Query:     "Quit",
+			Admin:     true,
+			Db:        "",
+			Host:      "localhost",
+			User:      "msandbox",
+			Offset:    185,
+			EndOffset: 375,
+			Timestamp: 1397442852,
 			TimeMetrics: map[string]float32{
 				"Query_time": 0.000016,
 				"Lock_time":  0.000000,
@@ -938,12 +987,14 @@ func (s *SlowLogTestSuite) TestParserSlowLog012(t *C) {
 			},
 		},
 		{
-			Query:  "SELECT @@max_allowed_packet",
-			Db:     "dev_pct",
-			Host:   "localhost",
-			User:   "msandbox",
-			Offset: 376,
-			Ts:     "140413 19:34:13",
+			Query:     "SELECT @@max_allowed_packet",
+			Db:        "dev_pct",
+			Host:      "localhost",
+			User:      "msandbox",
+			Offset:    375,
+			EndOffset: 609,
+			Timestamp: 1397442853,
+			Ts:        "140413 19:34:13",
 			TimeMetrics: map[string]float32{
 				"Query_time": 0.000127,
 				"Lock_time":  0.000000,
@@ -965,12 +1016,14 @@ func (s *SlowLogTestSuite) TestParserSlowLog013(t *C) {
 	got := ParseSlowLog("slow013.log", parser.Options{Debug: false})
 	expect := []log.Event{
 		{
-			Offset: 0,
-			Ts:     "140224 22:39:34",
-			Query:  "select 950,q.* from qcm q INTO OUTFILE '/mnt/pct/exp/qcm_db950.txt'",
-			User:   "root",
-			Host:   "localhost",
-			Db:     "db950",
+			Offset:    0,
+			EndOffset: 353,
+			Timestamp: 1393281574,
+			Ts:        "140224 22:39:34",
+			Query:     "select 950,q.* from qcm q INTO OUTFILE '/mnt/pct/exp/qcm_db950.txt'",
+			User:      "root",
+			Host:      "localhost",
+			Db:        "db950",
 			TimeMetrics: map[string]float32{
 				"Query_time": 21.876617,
 				"Lock_time":  0.002991,
@@ -985,12 +1038,14 @@ func (s *SlowLogTestSuite) TestParserSlowLog013(t *C) {
 			},
 		},
 		{
-			Offset: 354,
-			Ts:     "140224 22:39:59",
-			Query:  "select 961,q.* from qcm q INTO OUTFILE '/mnt/pct/exp/qcm_db961.txt'",
-			User:   "root",
-			Host:   "localhost",
-			Db:     "db961",
+			Offset:    353,
+			EndOffset: 6138,
+			Timestamp: 1393281599,
+			Ts:        "140224 22:39:59",
+			Query:     "select 961,q.* from qcm q INTO OUTFILE '/mnt/pct/exp/qcm_db961.txt'",
+			User:      "root",
+			Host:      "localhost",
+			Db:        "db961",
 			TimeMetrics: map[string]float32{
 				"Query_time": 20.304537,
 				"Lock_time":  0.103324,
@@ -1005,12 +1060,14 @@ func (s *SlowLogTestSuite) TestParserSlowLog013(t *C) {
 			},
 		},
 		{
-			Offset: 6139,
-			Ts:     "140311 16:07:40",
-			Query:  "select count(*) into @discard from `information_schema`.`PARTITIONS`",
-			User:   "debian-sys-maint",
-			Host:   "localhost",
-			Db:     "",
+			Offset:    6138,
+			EndOffset: 6666,
+			Timestamp: 1394554060,
+			Ts:        "140311 16:07:40",
+			Query:     "select count(*) into @discard from `information_schema`.`PARTITIONS`",
+			User:      "debian-sys-maint",
+			Host:      "localhost",
+			Db:        "",
 			TimeMetrics: map[string]float32{
 				"Query_time": 94.38144,
 				"Lock_time":  0.000174,
@@ -1025,12 +1082,14 @@ func (s *SlowLogTestSuite) TestParserSlowLog013(t *C) {
 			},
 		},
 		{
-			Offset: 6667,
-			Ts:     "140312 20:28:40",
-			Query:  "select 1,q.* from qcm q INTO OUTFILE '/mnt/pct/exp/qcm_db1.txt'",
-			User:   "root",
-			Host:   "localhost",
-			Db:     "db1",
+			Offset:    6666,
+			EndOffset: 7014,
+			Timestamp: 1394656120,
+			Ts:        "140312 20:28:40",
+			Query:     "select 1,q.* from qcm q INTO OUTFILE '/mnt/pct/exp/qcm_db1.txt'",
+			User:      "root",
+			Host:      "localhost",
+			Db:        "db1",
 			TimeMetrics: map[string]float32{
 				"Query_time": 407.54025,
 				"Lock_time":  0.122377,
@@ -1045,12 +1104,14 @@ func (s *SlowLogTestSuite) TestParserSlowLog013(t *C) {
 			},
 		},
 		{
-			Offset: 7015,
-			Ts:     "140312 20:29:40",
-			Query:  "select 1006,q.* from qcm q INTO OUTFILE '/mnt/pct/exp/qcm_db1006.txt'",
-			User:   "root",
-			Host:   "localhost",
-			Db:     "db1006",
+			Offset:    7014,
+			EndOffset: 7370,
+			Timestamp: 1394656180,
+			Ts:        "140312 20:29:40",
+			Query:     "select 1006,q.* from qcm q INTO OUTFILE '/mnt/pct/exp/qcm_db1006.txt'",
+			User:      "root",
+			Host:      "localhost",
+			Db:        "db1006",
 			TimeMetrics: map[string]float32{
 				"Query_time": 60.507698,
 				"Lock_time":  0.002719,
@@ -1076,12 +1137,14 @@ func (s *SlowLogTestSuite) TestParserSlowLog014(t *C) {
 	got := ParseSlowLog("slow014.log", s.opt)
 	expect := []log.Event{
 		{
-			Offset: 0,
-			Admin:  false,
-			Query:  "SELECT * FROM cache\n WHERE `cacheid` IN ('id15965')",
-			User:   "root",
-			Host:   "localhost",
-			Db:     "db1",
+			Offset:    0,
+			EndOffset: 690,
+			Timestamp: 1398555955,
+			Admin:     false,
+			Query:     "SELECT * FROM cache\n WHERE `cacheid` IN ('id15965')",
+			User:      "root",
+			Host:      "localhost",
+			Db:        "db1",
 			TimeMetrics: map[string]float32{
 				"InnoDB_IO_r_wait":     0,
 				"InnoDB_queue_wait":    0,
@@ -1121,12 +1184,14 @@ func (s *SlowLogTestSuite) TestParserSlowLog014(t *C) {
 			/**
 			 * Here it is:
 			 */
-			Offset: 691,
-			Admin:  false,
-			Query:  "### Channels ###\n\u0009\u0009\u0009\u0009\u0009SELECT sourcetable, IF(f.lastcontent = 0, f.lastupdate, f.lastcontent) AS lastactivity,\n\u0009\u0009\u0009\u0009\u0009f.totalcount AS activity, type.class AS type,\n\u0009\u0009\u0009\u0009\u0009(f.nodeoptions \u0026 512) AS noUnsubscribe\n\u0009\u0009\u0009\u0009\u0009FROM node AS f\n\u0009\u0009\u0009\u0009\u0009INNER JOIN contenttype AS type ON type.contenttypeid = f.contenttypeid \n\n\u0009\u0009\u0009\u0009\u0009INNER JOIN subscribed AS sd ON sd.did = f.nodeid AND sd.userid = 15965\n UNION  ALL \n\n\u0009\u0009\u0009\u0009\u0009### Users ###\n\u0009\u0009\u0009\u0009\u0009SELECT f.name AS title, f.userid AS keyval, 'user' AS sourcetable, IFNULL(f.lastpost, f.joindate) AS lastactivity,\n\u0009\u0009\u0009\u0009\u0009f.posts as activity, 'Member' AS type,\n\u0009\u0009\u0009\u0009\u00090 AS noUnsubscribe\n\u0009\u0009\u0009\u0009\u0009FROM user AS f\n\u0009\u0009\u0009\u0009\u0009INNER JOIN userlist AS ul ON ul.relationid = f.userid AND ul.userid = 15965\n\u0009\u0009\u0009\u0009\u0009WHERE ul.type = 'f' AND ul.aq = 'yes'\n ORDER BY title ASC LIMIT 100",
-			User:   "root",
-			Host:   "localhost",
-			Db:     "db1",
+			Offset:    690,
+			EndOffset: 2104,
+			Timestamp: 1398555955,
+			Admin:     false,
+			Query:     "### Channels ###\n\u0009\u0009\u0009\u0009\u0009SELECT sourcetable, IF(f.lastcontent = 0, f.lastupdate, f.lastcontent) AS lastactivity,\n\u0009\u0009\u0009\u0009\u0009f.totalcount AS activity, type.class AS type,\n\u0009\u0009\u0009\u0009\u0009(f.nodeoptions \u0026 512) AS noUnsubscribe\n\u0009\u0009\u0009\u0009\u0009FROM node AS f\n\u0009\u0009\u0009\u0009\u0009INNER JOIN contenttype AS type ON type.contenttypeid = f.contenttypeid \n\n\u0009\u0009\u0009\u0009\u0009INNER JOIN subscribed AS sd ON sd.did = f.nodeid AND sd.userid = 15965\n UNION  ALL \n\n\u0009\u0009\u0009\u0009\u0009### Users ###\n\u0009\u0009\u0009\u0009\u0009SELECT f.name AS title, f.userid AS keyval, 'user' AS sourcetable, IFNULL(f.lastpost, f.joindate) AS lastactivity,\n\u0009\u0009\u0009\u0009\u0009f.posts as activity, 'Member' AS type,\n\u0009\u0009\u0009\u0009\u00090 AS noUnsubscribe\n\u0009\u0009\u0009\u0009\u0009FROM user AS f\n\u0009\u0009\u0009\u0009\u0009INNER JOIN userlist AS ul ON ul.relationid = f.userid AND ul.userid = 15965\n\u0009\u0009\u0009\u0009\u0009WHERE ul.type = 'f' AND ul.aq = 'yes'\n ORDER BY title ASC LIMIT 100",
+			User:      "root",
+			Host:      "localhost",
+			Db:        "db1",
 			TimeMetrics: map[string]float32{
 				"InnoDB_IO_r_wait":     0,
 				"InnoDB_queue_wait":    0,
@@ -1163,11 +1228,13 @@ func (s *SlowLogTestSuite) TestParserSlowLog014(t *C) {
 			},
 		},
 		{
-			Offset: 2105,
-			Query:  "SELECT COUNT(userfing.keyval) AS total\n\u0009\u0009\u0009FROM\n\u0009\u0009\u0009((### All Content ###\n\u0009\u0009\u0009\u0009\u0009SELECT f.nodeid AS keyval\n\u0009\u0009\u0009\u0009\u0009FROM node AS f\n\u0009\u0009\u0009\u0009\u0009INNER JOIN subscribed AS sd ON sd.did = f.nodeid AND sd.userid = 15965) UNION ALL (\n\u0009\u0009\u0009\u0009\u0009### Users ###\n\u0009\u0009\u0009\u0009\u0009SELECT f.userid AS keyval\n\u0009\u0009\u0009\u0009\u0009FROM user AS f\n\u0009\u0009\u0009\u0009\u0009INNER JOIN userlist AS ul ON ul.relationid = f.userid AND ul.userid = 15965\n\u0009\u0009\u0009\u0009\u0009WHERE ul.type = 'f' AND ul.aq = 'yes')\n) AS userfing",
-			User:   "root",
-			Host:   "localhost",
-			Db:     "db1",
+			Offset:    2104,
+			EndOffset: 3163,
+			Timestamp: 1398555955,
+			Query:     "SELECT COUNT(userfing.keyval) AS total\n\u0009\u0009\u0009FROM\n\u0009\u0009\u0009((### All Content ###\n\u0009\u0009\u0009\u0009\u0009SELECT f.nodeid AS keyval\n\u0009\u0009\u0009\u0009\u0009FROM node AS f\n\u0009\u0009\u0009\u0009\u0009INNER JOIN subscribed AS sd ON sd.did = f.nodeid AND sd.userid = 15965) UNION ALL (\n\u0009\u0009\u0009\u0009\u0009### Users ###\n\u0009\u0009\u0009\u0009\u0009SELECT f.userid AS keyval\n\u0009\u0009\u0009\u0009\u0009FROM user AS f\n\u0009\u0009\u0009\u0009\u0009INNER JOIN userlist AS ul ON ul.relationid = f.userid AND ul.userid = 15965\n\u0009\u0009\u0009\u0009\u0009WHERE ul.type = 'f' AND ul.aq = 'yes')\n) AS userfing",
+			User:      "root",
+			Host:      "localhost",
+			Db:        "db1",
 			TimeMetrics: map[string]float32{
 				"InnoDB_IO_r_wait":     0,
 				"InnoDB_queue_wait":    0,
@@ -1204,11 +1271,13 @@ func (s *SlowLogTestSuite) TestParserSlowLog014(t *C) {
 			},
 		},
 		{
-			Offset: 3164,
-			Query:  "SELECT u.userid, u.name AS name, u.usergroupid AS usergroupid, IFNULL(u.lastactivity, u.joindate) as lastactivity,\n\u0009\u0009\u0009\u0009IFNULL((SELECT userid FROM userlist AS ul2 WHERE ul2.userid = 15965 AND ul2.relationid = u.userid AND ul2.type = 'f' AND ul2.aq = 'yes'), 0) as isFollowing,\n\u0009\u0009\u0009\u0009IFNULL((SELECT userid FROM userlist AS ul2 WHERE ul2.userid = 15965 AND ul2.relationid = u.userid AND ul2.type = 'f' AND ul2.aq = 'pending'), 0) as isPending\nFROM user AS u\n\u0009\u0009\u0009\u0009INNER JOIN userlist AS ul ON (u.userid = ul.userid AND ul.relationid = 15965)\n\n\u0009\u0009\u0009WHERE ul.type = 'f' AND ul.aq = 'yes'\nORDER BY name ASC\nLIMIT 0, 100",
-			User:   "root",
-			Host:   "localhost",
-			Db:     "db1",
+			Offset:    3163,
+			EndOffset: 4410,
+			Timestamp: 1398555955,
+			Query:     "SELECT u.userid, u.name AS name, u.usergroupid AS usergroupid, IFNULL(u.lastactivity, u.joindate) as lastactivity,\n\u0009\u0009\u0009\u0009IFNULL((SELECT userid FROM userlist AS ul2 WHERE ul2.userid = 15965 AND ul2.relationid = u.userid AND ul2.type = 'f' AND ul2.aq = 'yes'), 0) as isFollowing,\n\u0009\u0009\u0009\u0009IFNULL((SELECT userid FROM userlist AS ul2 WHERE ul2.userid = 15965 AND ul2.relationid = u.userid AND ul2.type = 'f' AND ul2.aq = 'pending'), 0) as isPending\nFROM user AS u\n\u0009\u0009\u0009\u0009INNER JOIN userlist AS ul ON (u.userid = ul.userid AND ul.relationid = 15965)\n\n\u0009\u0009\u0009WHERE ul.type = 'f' AND ul.aq = 'yes'\nORDER BY name ASC\nLIMIT 0, 100",
+			User:      "root",
+			Host:      "localhost",
+			Db:        "db1",
 			TimeMetrics: map[string]float32{
 				"InnoDB_IO_r_wait":     0,
 				"InnoDB_queue_wait":    0,
@@ -1253,15 +1322,17 @@ func (s *SlowLogTestSuite) TestParserSlowLog014(t *C) {
 
 // Correct event offsets when parsing starts/resumes at an offset.
 func (s *SlowLogTestSuite) TestParserSlowLog001StartOffset(t *C) {
-	// 359 is the first byte of the second (of 2) events.
-	got := ParseSlowLog("slow001.log", parser.Options{StartOffset: 359})
+	// 358 is the first byte of the second (of 2) events.
+	got := ParseSlowLog("slow001.log", parser.Options{StartOffset: 358})
 	expect := []log.Event{
 		{
-			Query:  `select sleep(2) from test.n`,
-			User:   "root",
-			Host:   "localhost",
-			Db:     "sakila",
-			Offset: 383,
+			Ts:        "071015 21:45:10",
+			Query:     `select sleep(2) from test.n`,
+			User:      "root",
+			Host:      "localhost",
+			Db:        "sakila",
+			Offset:    358,
+			EndOffset: 524,
 			TimeMetrics: map[string]float32{
 				"Query_time": 2,
 				"Lock_time":  0,
@@ -1279,6 +1350,68 @@ func (s *SlowLogTestSuite) TestParserSlowLog001StartOffset(t *C) {
 	}
 }
 
+// Parse a log from any io.Reader, decompressing it if needed.
+func (s *SlowLogTestSuite) TestParserSlowLogFromReader(t *C) {
+	parse := func(r io.Reader, opt parser.Options) []log.Event {
+		p, err := parser.NewSlowLogParserFromReader(r, nil, opt)
+		t.Assert(err, IsNil)
+		go p.Run()
+		var got []log.Event
+		for e := range p.EventChan {
+			got = append(got, *e)
+		}
+		t.Check(p.Err(), IsNil)
+		return got
+	}
+
+	data, err := ioutil.ReadFile(Sample + "slow001.log")
+	t.Assert(err, IsNil)
+	expect := *ParseSlowLog("slow001.log", parser.Options{})
+	t.Assert(expect, HasLen, 2)
+	expectOffset := *ParseSlowLog("slow001.log", parser.Options{StartOffset: 358})
+	t.Assert(expectOffset, HasLen, 1)
+
+	// Not a file, not seekable.
+	got := parse(struct{ io.Reader }{bytes.NewReader(data)}, parser.Options{})
+	t.Check(got, DeepEquals, expect)
+	got = parse(struct{ io.Reader }{bytes.NewReader(data)}, parser.Options{StartOffset: 358})
+	t.Check(got, DeepEquals, expectOffset)
+
+	// Seekable.
+	got = parse(bytes.NewReader(data), parser.Options{StartOffset: 358})
+	t.Check(got, DeepEquals, expectOffset)
+
+	for _, ext := range []string{".gz", ".bz2", ".zst", ".xz"} {
+		file, err := os.Open(Sample + "slow001.log" + ext)
+		t.Assert(err, IsNil)
+		got = parse(file, parser.Options{})
+		t.Check(got, DeepEquals, expect, Commentf(ext))
+
+		// StartOffset is an offset in the decompressed log.
+		file.Seek(0, os.SEEK_SET)
+		got = parse(file, parser.Options{StartOffset: 358})
+		t.Check(got, DeepEquals, expectOffset, Commentf(ext))
+		file.Close()
+	}
+
+	// Closing the decompressor releases it, but not the file.
+	file, err := os.Open(Sample + "slow001.log.zst")
+	t.Assert(err, IsNil)
+	dr, compressed, err := parser.Decompress(file)
+	t.Assert(err, IsNil)
+	t.Check(compressed, Equals, true)
+	t.Check(dr.Close(), IsNil)
+	_, err = dr.Read(make([]byte, 1))
+	t.Check(err, NotNil)
+	_, err = file.Seek(0, os.SEEK_SET)
+	t.Check(err, IsNil)
+	file.Close()
+
+	// Compressed but corrupt.
+	_, err = parser.NewSlowLogParserFromReader(bytes.NewReader([]byte{0x1f, 0x8b, 0, 0}), nil, parser.Options{})
+	t.Check(err, NotNil)
+}
+
 // Line > bufio.MaxScanTokenSize = 64KiB
 // https://jira.percona.com/browse/PCT-552
 func (s *SlowLogTestSuite) TestParserSlowLog015(t *C) {
@@ -1288,13 +1421,15 @@ func (s *SlowLogTestSuite) TestParserSlowLog015(t *C) {
 
 // Start in header
 func (s *SlowLogTestSuite) TestParseSlow016(t *C) {
-	got := ParseSlowLog("slow016.log", parser.Options{Debug:false})
+	got := ParseSlowLog("slow016.log", parser.Options{Debug: false})
 	expect := []log.Event{
 		{
-			Query:  `SHOW /*!50002 GLOBAL */ STATUS`,
-			User:   "pt_agent",
-			Host:   "localhost",
-			Offset: 160,
+			Query:     `SHOW /*!50002 GLOBAL */ STATUS`,
+			User:      "pt_agent",
+			Host:      "localhost",
+			Offset:    159,
+			EndOffset: 413,
+			Timestamp: 1400193480,
 			TimeMetrics: map[string]float32{
 				"Query_time": 0.003953,
 				"Lock_time":  0.000059,
@@ -1315,13 +1450,15 @@ func (s *SlowLogTestSuite) TestParseSlow016(t *C) {
 
 // Start in query
 func (s *SlowLogTestSuite) TestParseSlow017(t *C) {
-	got := ParseSlowLog("slow017.log", parser.Options{Debug:false})
+	got := ParseSlowLog("slow017.log", parser.Options{Debug: false})
 	expect := []log.Event{
 		{
-			Query:  `SHOW /*!50002 GLOBAL */ STATUS`,
-			User:   "pt_agent",
-			Host:   "localhost",
-			Offset: 27,
+			Query:     `SHOW /*!50002 GLOBAL */ STATUS`,
+			User:      "pt_agent",
+			Host:      "localhost",
+			Offset:    26,
+			EndOffset: 280,
+			Timestamp: 1400193480,
 			TimeMetrics: map[string]float32{
 				"Query_time": 0.003953,
 				"Lock_time":  0.000059,
@@ -1339,3 +1476,916 @@ func (s *SlowLogTestSuite) TestParseSlow017(t *C) {
 		t.Error(diff)
 	}
 }
+
+// SlowLogParser used through the log.MySQLLogParser interface.
+func (s *SlowLogTestSuite) TestParserInterface(t *C) {
+	file, err := os.Open(Sample + "slow001.log")
+	t.Assert(err, IsNil)
+	defer file.Close()
+
+	var p log.MySQLLogParser = parser.NewSlowLogParser(file, nil, parser.Options{})
+	errChan := make(chan error, 1)
+	go func() { errChan <- p.Start(context.Background()) }()
+	var got []log.Event
+	for e := range p.Events() {
+		got = append(got, *e)
+	}
+	t.Check(<-errChan, IsNil)
+	t.Check(p.Err(), IsNil)
+	t.Check(got, HasLen, 2)
+	t.Check(p.Offset(), Equals, uint64(524))
+
+	// Stop before any event is received: Start returns and closes the channel.
+	file.Seek(0, os.SEEK_SET)
+	p = parser.NewSlowLogParser(file, nil, parser.Options{})
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() { errChan <- p.Start(ctx) }()
+	cancel()
+	p.Stop()
+	p.Stop()
+	for range p.Events() {
+	}
+	t.Check(<-errChan, IsNil)
+}
+
+// Stop after every event, then resume from Offset: no event is sent twice
+// or skipped.  Events are compared by offset and query because session state
+// (e.g. the db of a general log thread) before the offset is not known when
+// resuming.
+func checkResume(t *C, filename string, newParser func(*os.File, parser.Options) log.MySQLLogParser) {
+	parse := func(opt parser.Options, n int) ([]string, []uint64, uint64) {
+		file, err := os.Open(Sample + filename)
+		t.Assert(err, IsNil)
+		defer file.Close()
+		p := newParser(file, opt)
+		go p.Start(context.Background())
+		var got []string
+		var ends []uint64
+		for e := range p.Events() {
+			got = append(got, fmt.Sprintf("%d %s", e.Offset, e.Query))
+			ends = append(ends, e.EndOffset)
+			if len(got) == n {
+				p.Stop()
+			}
+		}
+		t.Assert(p.Err(), IsNil)
+		return got, ends, p.Offset()
+	}
+
+	all, ends, end := parse(parser.Options{}, -1)
+	t.Assert(len(all) > 1, Equals, true, Commentf(filename))
+	for n := 1; n < len(all); n++ {
+		// The event after the nth can be sent before the parser stops.
+		first, _, offset := parse(parser.Options{}, n)
+		if len(first) < len(all) {
+			t.Check(offset < end, Equals, true, Commentf("%s stop after %d events", filename, n))
+		}
+		rest, _, _ := parse(parser.Options{StartOffset: offset}, -1)
+		t.Check(append(first, rest...), DeepEquals, all, Commentf("%s stop after %d events, resume at %d", filename, n, offset))
+
+		// A checkpoint taken as each event is received, not after the
+		// parser stops.
+		rest, _, _ = parse(parser.Options{StartOffset: ends[n-1]}, -1)
+		t.Check(append(all[:n:n], rest...), DeepEquals, all, Commentf("%s resume after event %d at %d", filename, n, ends[n-1]))
+	}
+}
+
+func (s *SlowLogTestSuite) TestParserSlowLogResume(t *C) {
+	newParser := func(file *os.File, opt parser.Options) log.MySQLLogParser {
+		return parser.NewSlowLogParser(file, nil, opt)
+	}
+	for _, filename := range []string{"slow001.log", "slow002.log", "slow006.log", "slow011.log", "slow018.log"} {
+		checkResume(t, filename, newParser)
+	}
+}
+
+// Stop before the first event that begins at or after EndOffset.
+func (s *SlowLogTestSuite) TestParserSlowLogEndOffset(t *C) {
+	all := *ParseSlowLog("slow002.log", parser.Options{})
+	got := *ParseSlowLog("slow002.log", parser.Options{EndOffset: 337})
+	t.Check(got, DeepEquals, all[0:1])
+	got = *ParseSlowLog("slow002.log", parser.Options{EndOffset: 338})
+	t.Check(got, DeepEquals, all[0:2])
+	got = *ParseSlowLog("slow002.log", parser.Options{StartOffset: 337, EndOffset: 1333})
+	t.Check(got, DeepEquals, all[1:3])
+}
+
+// ParallelSlowLogParser sends the same events as SlowLogParser however the
+// log is split.
+func (s *SlowLogTestSuite) TestParserParallelSlowLog(t *C) {
+	parse := func(filename string, opt parser.Options, chunkSize uint64, workers int) []log.Event {
+		file, err := os.Open(Sample + filename)
+		t.Assert(err, IsNil)
+		defer file.Close()
+		p := parser.NewParallelSlowLogParser(file, nil, opt, workers)
+		p.ChunkSize = chunkSize
+		go p.Run()
+		var got []log.Event
+		for e := range p.EventChan {
+			got = append(got, *e)
+		}
+		t.Check(p.Err(), IsNil)
+		return got
+	}
+
+	files, err := filepath.Glob(Sample + "slow0*.log")
+	t.Assert(err, IsNil)
+	t.Assert(len(files) > 10, Equals, true)
+	for _, file := range files {
+		filename := filepath.Base(file)
+		expect := *ParseSlowLog(filename, parser.Options{})
+		for _, chunkSize := range []uint64{1, 100, 500, parser.PARALLEL_CHUNK_SIZE} {
+			for _, workers := range []int{1, 4} {
+				got := parse(filename, parser.Options{}, chunkSize, workers)
+				t.Check(got, DeepEquals, expect, Commentf("%s chunk size %d, %d workers", filename, chunkSize, workers))
+			}
+		}
+	}
+
+	expect := *ParseSlowLog("slow002.log", parser.Options{StartOffset: 337, EndOffset: 1500})
+	got := parse("slow002.log", parser.Options{StartOffset: 337, EndOffset: 1500}, 100, 2)
+	t.Check(got, DeepEquals, expect)
+
+	checkResume(t, "slow002.log", func(file *os.File, opt parser.Options) log.MySQLLogParser {
+		p := parser.NewParallelSlowLogParser(file, nil, opt, 2)
+		p.ChunkSize = 500
+		return p
+	})
+}
+
+// slow018 has a bad User@Host line in event 2 and no Query_time in event 3.
+func (s *SlowLogTestSuite) TestParserSlowLog018(t *C) {
+	badUser := parser.ParseError{Offset: 135, Line: "# User@Host: bad line", Reason: "invalid User@Host"}
+	noQueryTime := parser.ParseError{Offset: 229, Line: "select 3;", Reason: "no Query_time"}
+
+	parse := func(policy parser.ErrorPolicy) ([]string, []error, error) {
+		file, err := os.Open(Sample + "slow018.log")
+		t.Assert(err, IsNil)
+		defer file.Close()
+		errChan := make(chan error, 10)
+		p := parser.NewSlowLogParser(file, nil, parser.Options{ErrorPolicy: policy, ErrorChan: errChan})
+		go p.Run()
+		var queries []string
+		for e := range p.EventChan {
+			queries = append(queries, e.Query)
+		}
+		close(errChan)
+		var errs []error
+		for err := range errChan {
+			errs = append(errs, err)
+		}
+		return queries, errs, p.Err()
+	}
+
+	// Skip the bad events, keep parsing.
+	queries, errs, err := parse(parser.ERROR_SKIP)
+	t.Check(queries, DeepEquals, []string{"select 1", "select 4"})
+	t.Check(errs, DeepEquals, []error{badUser, noQueryTime})
+	t.Check(err, IsNil)
+
+	// Stop at the first bad event.
+	queries, errs, err = parse(parser.ERROR_STOP)
+	t.Check(queries, DeepEquals, []string{"select 1"})
+	t.Check(errs, DeepEquals, []error{badUser})
+	t.Check(err, IsNil)
+
+	// Stop at the first bad event and return its error.
+	queries, errs, err = parse(parser.ERROR_FAIL)
+	t.Check(queries, DeepEquals, []string{"select 1"})
+	t.Check(errs, DeepEquals, []error{badUser})
+	t.Check(err, DeepEquals, badUser)
+}
+
+// A first event without Query_time is an error if parsing started at the
+// start of the log, else it is the end of an event before StartOffset.
+func (s *SlowLogTestSuite) TestParserSlowLogFirstEventNoQueryTime(t *C) {
+	data := "# User@Host: root[root] @ localhost []\n" +
+		"# Lock_time: 0  Rows_sent: 1  Rows_examined: 0\n" +
+		"select 1;\n" +
+		"# User@Host: root[root] @ localhost []\n" +
+		"# Query_time: 2  Lock_time: 0  Rows_sent: 1  Rows_examined: 0\n" +
+		"select 2;\n"
+	parse := func(offset uint64) ([]string, []error) {
+		errChan := make(chan error, 10)
+		p, err := parser.NewSlowLogParserFromReader(strings.NewReader(data), nil, parser.Options{StartOffset: offset, ErrorChan: errChan})
+		t.Assert(err, IsNil)
+		go p.Run()
+		var queries []string
+		for e := range p.EventChan {
+			queries = append(queries, e.Query)
+		}
+		close(errChan)
+		var errs []error
+		for err := range errChan {
+			errs = append(errs, err)
+		}
+		return queries, errs
+	}
+
+	queries, errs := parse(0)
+	t.Check(queries, DeepEquals, []string{"select 2"})
+	t.Check(errs, DeepEquals, []error{parser.ParseError{Offset: 0, Line: "select 1;", Reason: "no Query_time"}})
+
+	// Start in the header of the first event, after its User@Host line.
+	queries, errs = parse(39)
+	t.Check(queries, DeepEquals, []string{"select 2"})
+	t.Check(errs, HasLen, 0)
+}
+
+// slow019 is a MySQL 5.7 slow log (ISO 8601 Time) without a newline at the end.
+func (s *SlowLogTestSuite) TestParserSlowLog019(t *C) {
+	got := ParseSlowLog("slow019.log", parser.Options{ErrorPolicy: parser.ERROR_FAIL})
+	expect := []log.Event{
+		{
+			Ts:        "2019-01-08T11:43:27.123456Z",
+			Query:     "select 1",
+			User:      "root",
+			Host:      "localhost",
+			Offset:    0,
+			EndOffset: 196,
+			Timestamp: 1546947807,
+			TimeMetrics: map[string]float32{
+				"Query_time": 0.000125,
+				"Lock_time":  0,
+			},
+			NumberMetrics: map[string]uint64{
+				"Rows_sent":     1,
+				"Rows_examined": 0,
+			},
+			BoolMetrics: map[string]bool{},
+		},
+	}
+	if same, diff := IsDeeply(got, &expect); !same {
+		Dump(got)
+		t.Error(diff)
+	}
+}
+
+// Follow a slow log as it grows, is rotated, and is truncated.
+func (s *SlowLogTestSuite) TestParserSlowLogFollow(t *C) {
+	dir, err := ioutil.TempDir("", "mysql-log-parser")
+	t.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+	logFile := filepath.Join(dir, "slow.log")
+
+	event := func(query string) string {
+		return "# Query_time: 1  Lock_time: 0  Rows_sent: 1  Rows_examined: 0\n" + query + ";\n"
+	}
+	write := func(flag int, data string) {
+		f, err := os.OpenFile(logFile, flag|os.O_WRONLY, 0644)
+		t.Assert(err, IsNil)
+		_, err = f.WriteString(data)
+		t.Assert(err, IsNil)
+		f.Close()
+	}
+
+	write(os.O_CREATE, event("select 1"))
+	file, err := os.Open(logFile)
+	t.Assert(err, IsNil)
+	defer file.Close()
+
+	p := parser.NewSlowLogParser(file, nil, parser.Options{Follow: true, FollowInterval: 10 * time.Millisecond})
+	errChan := make(chan error, 1)
+	go func() { errChan <- p.Start(context.Background()) }()
+	next := func() string {
+		select {
+		case e := <-p.EventChan:
+			if e == nil {
+				return ""
+			}
+			return e.Query
+		case <-time.After(10 * time.Second):
+			return "timeout"
+		}
+	}
+	// read waits until the parser has read all of file, so what is written
+	// next is read separately.
+	read := func() {
+		fi, err := file.Stat()
+		t.Assert(err, IsNil)
+		for timeout := time.After(10 * time.Second); ; {
+			off, err := file.Seek(0, os.SEEK_CUR)
+			t.Assert(err, IsNil)
+			if off == fi.Size() {
+				return
+			}
+			select {
+			case <-timeout:
+				t.Fatalf("parser read %d of %d bytes", off, fi.Size())
+			case <-time.After(time.Millisecond):
+			}
+		}
+	}
+
+	// The last event is sent when the next one begins, even if its header
+	// is written in pieces.
+	read()
+	write(os.O_APPEND, "# Query_time: 2")
+	read()
+	write(os.O_APPEND, "  Lock_time: 0  Rows_sent: 1  Rows_examined: 0\nselect 2;\n")
+	t.Check(next(), Equals, "select 1")
+
+	// Rotated: the last event of the old log is sent, then the new log is read.
+	t.Assert(os.Rename(logFile, logFile+".1"), IsNil)
+	write(os.O_CREATE, event("select 3 from a_long_table_name"))
+	t.Check(next(), Equals, "select 2")
+
+	// Truncated: the last event is sent, then the log is read from the start.
+	write(os.O_APPEND, event("select 4"))
+	t.Check(next(), Equals, "select 3 from a_long_table_name")
+	write(os.O_TRUNC, "")
+	t.Check(next(), Equals, "select 4")
+	write(os.O_APPEND, event("select 5")+event("select 6"))
+	t.Check(next(), Equals, "select 5")
+
+	p.Stop()
+	t.Check(next(), Equals, "")
+	t.Check(<-errChan, IsNil)
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// General log test suite
+// //////////////////////////////////////////////////////////////////////////
+
+type GeneralLogTestSuite struct {
+}
+
+var _ = Suite(&GeneralLogTestSuite{})
+
+// No input, no events.
+func (s *GeneralLogTestSuite) TestParserEmptyGeneralLog(t *C) {
+	got := ParseGeneralLog("empty.log", parser.Options{})
+	expect := []log.Event{}
+	t.Check(got, EventsEqual, &expect)
+}
+
+// general001 is a MySQL 5.6 general log: the time is only written when it
+// changes, there's a multi-line query, and sessions change db.
+func (s *GeneralLogTestSuite) TestParserGeneralLog001(t *C) {
+	got := ParseGeneralLog("general001.log", parser.Options{})
+	expect := []log.Event{
+		{
+			Offset:        173,
+			EndOffset:     226,
+			Ts:            "140224 16:53:09",
+			Admin:         true,
+			Query:         "Connect",
+			Command:       "Connect",
+			User:          "root",
+			Host:          "localhost",
+			Db:            "test",
+			TimeMetrics:   map[string]float32{},
+			NumberMetrics: map[string]uint64{},
+			Meta:          map[string]uint64{"Thread_id": 1},
+			BoolMetrics:   map[string]bool{},
+		},
+		{
+			Offset:        226,
+			EndOffset:     273,
+			Ts:            "140224 16:53:09",
+			Query:         "select @@version_comment limit 1",
+			Command:       "Query",
+			User:          "root",
+			Host:          "localhost",
+			Db:            "test",
+			TimeMetrics:   map[string]float32{},
+			NumberMetrics: map[string]uint64{},
+			Meta:          map[string]uint64{"Thread_id": 1},
+			BoolMetrics:   map[string]bool{},
+		},
+		{
+			Offset:        273,
+			EndOffset:     310,
+			Ts:            "140224 16:53:15",
+			Admin:         true,
+			Query:         "Init DB",
+			Command:       "Init DB",
+			User:          "root",
+			Host:          "localhost",
+			Db:            "sakila",
+			TimeMetrics:   map[string]float32{},
+			NumberMetrics: map[string]uint64{},
+			Meta:          map[string]uint64{"Thread_id": 1},
+			BoolMetrics:   map[string]bool{},
+		},
+		{
+			Offset:        310,
+			EndOffset:     361,
+			Ts:            "140224 16:53:15",
+			Query:         "SELECT *\nFROM film\nWHERE film_id = 5",
+			Command:       "Query",
+			User:          "root",
+			Host:          "localhost",
+			Db:            "sakila",
+			TimeMetrics:   map[string]float32{},
+			NumberMetrics: map[string]uint64{},
+			Meta:          map[string]uint64{"Thread_id": 1},
+			BoolMetrics:   map[string]bool{},
+		},
+		{
+			Offset:        361,
+			EndOffset:     408,
+			Ts:            "140224 16:53:20",
+			Admin:         true,
+			Query:         "Connect",
+			Command:       "Connect",
+			User:          "app",
+			Host:          "10.0.0.1",
+			Db:            "",
+			TimeMetrics:   map[string]float32{},
+			NumberMetrics: map[string]uint64{},
+			Meta:          map[string]uint64{"Thread_id": 2},
+			BoolMetrics:   map[string]bool{},
+		},
+		{
+			Offset:        408,
+			EndOffset:     433,
+			Ts:            "140224 16:53:20",
+			Query:         "use orders",
+			Command:       "Query",
+			User:          "app",
+			Host:          "10.0.0.1",
+			Db:            "orders",
+			TimeMetrics:   map[string]float32{},
+			NumberMetrics: map[string]uint64{},
+			Meta:          map[string]uint64{"Thread_id": 2},
+			BoolMetrics:   map[string]bool{},
+		},
+		{
+			Offset:        433,
+			EndOffset:     479,
+			Ts:            "140224 16:53:20",
+			Query:         "UPDATE t SET a = 1 WHERE id = 2",
+			Command:       "Query",
+			User:          "app",
+			Host:          "10.0.0.1",
+			Db:            "orders",
+			TimeMetrics:   map[string]float32{},
+			NumberMetrics: map[string]uint64{},
+			Meta:          map[string]uint64{"Thread_id": 2},
+			BoolMetrics:   map[string]bool{},
+		},
+		{
+			Offset:        479,
+			EndOffset:     493,
+			Ts:            "140224 16:53:20",
+			Admin:         true,
+			Query:         "Quit",
+			Command:       "Quit",
+			User:          "root",
+			Host:          "localhost",
+			Db:            "sakila",
+			TimeMetrics:   map[string]float32{},
+			NumberMetrics: map[string]uint64{},
+			Meta:          map[string]uint64{"Thread_id": 1},
+			BoolMetrics:   map[string]bool{},
+		},
+		{
+			Offset:        493,
+			EndOffset:     521,
+			Ts:            "140224  9:53:21",
+			Admin:         true,
+			Query:         "Quit",
+			Command:       "Quit",
+			User:          "app",
+			Host:          "10.0.0.1",
+			Db:            "orders",
+			TimeMetrics:   map[string]float32{},
+			NumberMetrics: map[string]uint64{},
+			Meta:          map[string]uint64{"Thread_id": 2},
+			BoolMetrics:   map[string]bool{},
+		},
+	}
+	if same, diff := IsDeeply(got, &expect); !same {
+		Dump(got)
+		t.Error(diff)
+	}
+}
+
+// general002 is a MySQL 5.7 general log with ISO 8601 timestamps.  Quit is
+// filtered.
+func (s *GeneralLogTestSuite) TestParserGeneralLog002(t *C) {
+	opt := parser.Options{
+		FilterAdminCommand: map[string]bool{"Quit": true},
+	}
+	got := ParseGeneralLog("general002.log", opt)
+	expect := []log.Event{
+		{
+			Offset:        0,
+			EndOffset:     78,
+			Ts:            "2019-01-08T11:43:27.123456Z",
+			Admin:         true,
+			Query:         "Connect",
+			Command:       "Connect",
+			User:          "root",
+			Host:          "localhost",
+			Db:            "test",
+			TimeMetrics:   map[string]float32{},
+			NumberMetrics: map[string]uint64{},
+			Meta:          map[string]uint64{"Thread_id": 8},
+			BoolMetrics:   map[string]bool{},
+		},
+		{
+			Offset:        78,
+			EndOffset:     127,
+			Ts:            "2019-01-08T11:43:27.123999Z",
+			Query:         "SELECT 1",
+			Command:       "Query",
+			User:          "root",
+			Host:          "localhost",
+			Db:            "test",
+			TimeMetrics:   map[string]float32{},
+			NumberMetrics: map[string]uint64{},
+			Meta:          map[string]uint64{"Thread_id": 8},
+			BoolMetrics:   map[string]bool{},
+		},
+		{
+			Offset:        127,
+			EndOffset:     196,
+			Ts:            "2019-01-08T11:43:28.000001Z",
+			Query:         "INSERT INTO t (a)\nVALUES (1)",
+			Command:       "Query",
+			User:          "root",
+			Host:          "localhost",
+			Db:            "test",
+			TimeMetrics:   map[string]float32{},
+			NumberMetrics: map[string]uint64{},
+			Meta:          map[string]uint64{"Thread_id": 8},
+			BoolMetrics:   map[string]bool{},
+		},
+	}
+	if same, diff := IsDeeply(got, &expect); !same {
+		Dump(got)
+		t.Error(diff)
+	}
+}
+
+// general003 does not end with a newline, so the last command is the last
+// line.
+func (s *GeneralLogTestSuite) TestParserGeneralLog003(t *C) {
+	got := ParseGeneralLog("general003.log", parser.Options{})
+	expect := []log.Event{
+		{
+			Offset:        0,
+			EndOffset:     49,
+			Ts:            "2019-01-08T11:43:27.123999Z",
+			Query:         "SELECT 1",
+			Command:       "Query",
+			TimeMetrics:   map[string]float32{},
+			NumberMetrics: map[string]uint64{},
+			Meta:          map[string]uint64{"Thread_id": 8},
+			BoolMetrics:   map[string]bool{},
+		},
+		{
+			Offset:        49,
+			EndOffset:     97,
+			Ts:            "2019-01-08T11:43:28.000001Z",
+			Query:         "SELECT 2",
+			Command:       "Query",
+			TimeMetrics:   map[string]float32{},
+			NumberMetrics: map[string]uint64{},
+			Meta:          map[string]uint64{"Thread_id": 8},
+			BoolMetrics:   map[string]bool{},
+		},
+	}
+	if same, diff := IsDeeply(got, &expect); !same {
+		Dump(got)
+		t.Error(diff)
+	}
+}
+
+func (s *GeneralLogTestSuite) TestParserGeneralLogResume(t *C) {
+	checkResume(t, "general002.log", func(file *os.File, opt parser.Options) log.MySQLLogParser {
+		return parser.NewGeneralLogParser(file, nil, opt)
+	})
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Binlog test suite
+// //////////////////////////////////////////////////////////////////////////
+
+type BinlogTestSuite struct {
+}
+
+var _ = Suite(&BinlogTestSuite{})
+
+// binlog001 is mysqlbinlog output of a MySQL 5.7 binlog with statement-based
+// events: a transaction (BEGIN, INSERT, COMMIT) and DDL.
+func (s *BinlogTestSuite) TestParserBinlog001(t *C) {
+	got := ParseBinlog("binlog001.log", parser.Options{})
+	expect := []log.Event{
+		{
+			Offset:    666,
+			EndOffset: 1319,
+			Timestamp: 1546947820,
+			Ts:        "190108 11:43:40",
+			Query:     "BEGIN",
+			TimeMetrics: map[string]float32{
+				"Query_time": 0,
+			},
+			NumberMetrics: map[string]uint64{
+				"Error_code": 0,
+			},
+			Meta: map[string]uint64{
+				"Pos":         219,
+				"End_log_pos": 298,
+				"Server_id":   1,
+				"Thread_id":   5,
+			},
+			BoolMetrics: map[string]bool{},
+		},
+		{
+			Offset:    1319,
+			EndOffset: 1520,
+			Timestamp: 1546947822,
+			Ts:        "190108 11:43:42",
+			Db:        "test",
+			Query:     "insert into t values (1),\n(2)",
+			TimeMetrics: map[string]float32{
+				"Query_time": 2,
+			},
+			NumberMetrics: map[string]uint64{
+				"Error_code": 0,
+			},
+			Meta: map[string]uint64{
+				"Pos":         298,
+				"End_log_pos": 412,
+				"Server_id":   1,
+				"Thread_id":   5,
+			},
+			BoolMetrics: map[string]bool{},
+		},
+		{
+			Offset:    1520,
+			EndOffset: 1615,
+			Timestamp: 1546947822,
+			Ts:        "190108 11:43:42",
+			Db:        "test",
+			Query:     "COMMIT",
+			TimeMetrics: map[string]float32{
+				"Query_time": 0,
+			},
+			NumberMetrics: map[string]uint64{},
+			Meta: map[string]uint64{
+				"Pos":         412,
+				"End_log_pos": 443,
+				"Server_id":   1,
+			},
+			BoolMetrics: map[string]bool{},
+		},
+		{
+			Offset:    1793,
+			EndOffset: 1978,
+			Timestamp: 1546947830,
+			Ts:        "190108 11:43:50",
+			Db:        "test",
+			Query:     "ALTER TABLE t ADD COLUMN b INT",
+			TimeMetrics: map[string]float32{
+				"Query_time": 1,
+			},
+			NumberMetrics: map[string]uint64{
+				"Error_code": 0,
+			},
+			Meta: map[string]uint64{
+				"Pos":         508,
+				"End_log_pos": 611,
+				"Server_id":   1,
+				"Thread_id":   6,
+			},
+			BoolMetrics: map[string]bool{},
+		},
+	}
+	if same, diff := IsDeeply(got, &expect); !same {
+		Dump(got)
+		t.Error(diff)
+	}
+}
+
+// binlog002 is a truncated mysqlbinlog output that does not end with a
+// newline, so the last statement is the last line.
+func (s *BinlogTestSuite) TestParserBinlog002(t *C) {
+	got := ParseBinlog("binlog002.log", parser.Options{})
+	expect := []log.Event{
+		{
+			Offset:    0,
+			EndOffset: 178,
+			Timestamp: 1546947820,
+			Ts:        "190108 11:43:40",
+			Db:        "test",
+			Query:     "select 1",
+			TimeMetrics: map[string]float32{
+				"Query_time": 1,
+			},
+			NumberMetrics: map[string]uint64{
+				"Error_code": 0,
+			},
+			Meta: map[string]uint64{
+				"Pos":         219,
+				"End_log_pos": 298,
+				"Server_id":   1,
+				"Thread_id":   5,
+			},
+			BoolMetrics: map[string]bool{},
+		},
+	}
+	if same, diff := IsDeeply(got, &expect); !same {
+		Dump(got)
+		t.Error(diff)
+	}
+}
+
+func (s *BinlogTestSuite) TestParserBinlogResume(t *C) {
+	checkResume(t, "binlog001.log", func(file *os.File, opt parser.Options) log.MySQLLogParser {
+		return parser.NewBinlogParser(file, nil, opt)
+	})
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// mysql.slow_log table test suite
+// //////////////////////////////////////////////////////////////////////////
+
+type SlowLogTableTestSuite struct {
+}
+
+var _ = Suite(&SlowLogTableTestSuite{})
+
+// slow_log001 is the CSV engine file of a MySQL 5.6 mysql.slow_log table.
+func (s *SlowLogTableTestSuite) TestParserSlowLogTable001(t *C) {
+	got := ParseSlowLogTable("slow_log001.csv", parser.Options{}, parser.CSV_DELIMITER)
+	expect := []log.Event{
+		{
+			Offset:    0,
+			EndOffset: 137,
+			Ts:        "190108 11:43:27",
+			Query:     "select sleep(2) from n",
+			User:      "root",
+			Host:      "localhost",
+			Db:        "test",
+			TimeMetrics: map[string]float32{
+				"Query_time": 2.000123,
+				"Lock_time":  0.0001,
+			},
+			NumberMetrics: map[string]uint64{
+				"Rows_sent":     1,
+				"Rows_examined": 0,
+				"Thread_id":     8,
+			},
+			BoolMetrics: map[string]bool{},
+		},
+		{
+			Offset:    137,
+			EndOffset: 303,
+			Ts:        "190108 11:45:10",
+			Query:     "update t set\nmsg = \"say hi\" where a = 'x\\y'",
+			User:      "app",
+			Host:      "",
+			Db:        "db1",
+			TimeMetrics: map[string]float32{
+				"Query_time": 0.531,
+				"Lock_time":  0.000027,
+			},
+			NumberMetrics: map[string]uint64{
+				"Rows_sent":     0,
+				"Rows_examined": 62951,
+				"Thread_id":     9,
+			},
+			BoolMetrics: map[string]bool{},
+		},
+		{
+			Offset:    303,
+			EndOffset: 414,
+			Ts:        "190108 11:46:00",
+			Query:     "BEGIN",
+			User:      "[SQL_SLAVE]",
+			Host:      "",
+			Db:        "",
+			TimeMetrics: map[string]float32{
+				"Query_time": 3020399, // 838:59:59
+				"Lock_time":  0,
+			},
+			NumberMetrics: map[string]uint64{
+				"Rows_sent":     0,
+				"Rows_examined": 0,
+				"Thread_id":     10,
+			},
+			BoolMetrics: map[string]bool{},
+		},
+	}
+	if same, diff := IsDeeply(got, &expect); !same {
+		Dump(got)
+		t.Error(diff)
+	}
+}
+
+// slow_log002 is a MySQL 5.5 (no thread_id) SELECT ... INTO OUTFILE dump with
+// a header row, an escaped newline, and a NULL.
+func (s *SlowLogTableTestSuite) TestParserSlowLogTable002(t *C) {
+	got := ParseSlowLogTable("slow_log002.tsv", parser.Options{}, parser.TSV_DELIMITER)
+	expect := []log.Event{
+		{
+			Offset:    113,
+			EndOffset: 240,
+			Ts:        "190108 11:43:27",
+			Query:     "select *\nfrom t\twhere c = 'a\\b'",
+			User:      "root",
+			Host:      "localhost",
+			Db:        "",
+			TimeMetrics: map[string]float32{
+				"Query_time": 1.5,
+				"Lock_time":  0,
+			},
+			NumberMetrics: map[string]uint64{
+				"Rows_sent":     3,
+				"Rows_examined": 10,
+			},
+			BoolMetrics: map[string]bool{},
+		},
+	}
+	if same, diff := IsDeeply(got, &expect); !same {
+		Dump(got)
+		t.Error(diff)
+	}
+}
+
+// slow_log003 is a SELECT ... INTO OUTFILE dump with a header row of the
+// columns in another order than the table's.
+func (s *SlowLogTableTestSuite) TestParserSlowLogTable003(t *C) {
+	got := ParseSlowLogTable("slow_log003.tsv", parser.Options{}, parser.TSV_DELIMITER)
+	expect := []log.Event{
+		{
+			Offset:    88,
+			EndOffset: 186,
+			Ts:        "190108 11:43:27",
+			Query:     "select 1",
+			User:      "root",
+			Host:      "localhost",
+			Db:        "test",
+			TimeMetrics: map[string]float32{
+				"Query_time": 1.5,
+				"Lock_time":  0,
+			},
+			NumberMetrics: map[string]uint64{
+				"Rows_sent":     1,
+				"Rows_examined": 0,
+				"Thread_id":     5,
+			},
+			BoolMetrics: map[string]bool{},
+		},
+		{
+			Offset:    186,
+			EndOffset: 284,
+			Ts:        "190108 11:43:28",
+			Query:     "select 2",
+			User:      "root",
+			Host:      "localhost",
+			Db:        "test",
+			TimeMetrics: map[string]float32{
+				"Query_time": 2,
+				"Lock_time":  0.0001,
+			},
+			NumberMetrics: map[string]uint64{
+				"Rows_sent":     1,
+				"Rows_examined": 0,
+				"Thread_id":     5,
+			},
+			BoolMetrics: map[string]bool{},
+		},
+		{
+			Offset:    284,
+			EndOffset: 377,
+			Ts:        "190108 11:43:29",
+			Query:     "select 3",
+			User:      "app",
+			Host:      "10.0.0.1",
+			Db:        "",
+			TimeMetrics: map[string]float32{
+				"Query_time": 0.25,
+				"Lock_time":  0,
+			},
+			NumberMetrics: map[string]uint64{
+				"Rows_sent":     1,
+				"Rows_examined": 1,
+				"Thread_id":     6,
+			},
+			BoolMetrics: map[string]bool{},
+		},
+	}
+	if same, diff := IsDeeply(got, &expect); !same {
+		Dump(got)
+		t.Error(diff)
+	}
+}
+
+func (s *SlowLogTableTestSuite) TestParserSlowLogTableResume(t *C) {
+	checkResume(t, "slow_log001.csv", func(file *os.File, opt parser.Options) log.MySQLLogParser {
+		return parser.NewSlowLogTableParser(file, nil, opt, parser.CSV_DELIMITER)
+	})
+}
+
+// A resume does not start at the header row, but the columns are still in
+// its order.
+func (s *SlowLogTableTestSuite) TestParserSlowLogTableResumeHeader(t *C) {
+	checkResume(t, "slow_log003.tsv", func(file *os.File, opt parser.Options) log.MySQLLogParser {
+		return parser.NewSlowLogTableParser(file, nil, opt, parser.TSV_DELIMITER)
+	})
+}
@@ -0,0 +1,52 @@
+package parser
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+	"io"
+	"io/ioutil"
+)
+
+// Magic bytes at the start of compressed logs.
+var (
+	gzipMagic  = []byte{0x1f, 0x8b}
+	bzip2Magic = []byte("BZh")
+	zstdMagic  = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	xzMagic    = []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}
+)
+
+// Decompress returns a reader of the decompressed log if r is gzip, bzip2,
+// zstd or xz compressed, detected by its magic bytes, else a reader of r
+// as-is.  compressed is true if r is compressed.  r must be at the start of
+// the log.  Close dr to release the decompressor, e.g. the goroutines and
+// buffers of zstd; it does not close r.
+func Decompress(r io.Reader) (dr io.ReadCloser, compressed bool, err error) {
+	br := bufio.NewReader(r)
+	magic, _ := br.Peek(len(xzMagic)) // longest magic; a short log is not compressed
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		dr, err = gzip.NewReader(br)
+	case bytes.HasPrefix(magic, bzip2Magic):
+		dr = ioutil.NopCloser(bzip2.NewReader(br))
+	case bytes.HasPrefix(magic, zstdMagic):
+		var d *zstd.Decoder
+		if d, err = zstd.NewReader(br, zstd.WithDecoderConcurrency(1)); err == nil {
+			dr = d.IOReadCloser()
+		}
+	case bytes.HasPrefix(magic, xzMagic):
+		var xr *xz.Reader
+		if xr, err = xz.NewReader(br); err == nil {
+			dr = ioutil.NopCloser(xr)
+		}
+	default:
+		return ioutil.NopCloser(br), false, nil
+	}
+	if err != nil {
+		return nil, true, err
+	}
+	return dr, true, nil
+}
@@ -2,30 +2,42 @@ package parser
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	"github.com/vadimtk/mysql-log-parser/log"
+	"io"
+	"io/ioutil"
 	l "log"
 	"os"
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 // Regular expressions to match important lines in slow log.
-var timeRe = regexp.MustCompile(`Time: (\S+\s{1,2}\S+)`)
+var timeRe = regexp.MustCompile(`Time: (\S+\s{1,2}\S+|\S+)`)
 var userRe = regexp.MustCompile(`User@Host: ([^\[]+|\[[^[]+\]).*?@ (\S*) \[(.*)\]`)
 var headerRe = regexp.MustCompile(`^#\s+[A-Z]`)
 var metricsRe = regexp.MustCompile(`(\w+): (\S+|\z)`)
 var adminRe = regexp.MustCompile(`command: (.+)`)
 var setRe = regexp.MustCompile(`SET (?:last_insert_id|insert_id|timestamp)`)
+var timestampRe = regexp.MustCompile(`timestamp=(\d+)`)
 
 const (
 	FORWARD_SLASH = 0x2F
 )
 
+const DEFAULT_FOLLOW_INTERVAL = time.Second
+
+var _ log.MySQLLogParser = (*SlowLogParser)(nil)
+
 type SlowLogParser struct {
-	file     *os.File
+	reader   io.Reader
+	closer   io.Closer // of the decompressor, if any
+	file     *os.File  // nil if not reading a file
 	stopChan <-chan bool
 	opt      Options
 	// --
@@ -38,6 +50,16 @@ type SlowLogParser struct {
 	lineOffset  uint64
 	stopped     bool
 	event       *log.Event
+	firstEvent  bool   // may be partial if parsing started in the middle of it
+	badEvent    bool   // had a ParseError, skip it
+	partial     string // incomplete last line when following
+	rotated     bool   // log was rotated; finish reading the old file
+	reopened    bool   // file was opened by us when following
+	done        <-chan struct{}
+	stop        chan struct{}
+	stopOnce    sync.Once
+	offset      uint64 // atomic end of the last event sent, for Offset()
+	err         error
 }
 
 func NewSlowLogParser(file *os.File, stopChan <-chan bool, opt Options) *SlowLogParser {
@@ -48,13 +70,56 @@ func NewSlowLogParser(file *os.File, stopChan <-chan bool, opt Options) *SlowLog
 		file.Seek(int64(opt.StartOffset), os.SEEK_SET)
 	}
 
+	return newSlowLogParser(file, file, stopChan, opt)
+}
+
+// NewSlowLogParserFromReader returns a parser of the slow log read from r,
+// e.g. stdin or an HTTP response body.  A gzip, bzip2, zstd or xz compressed
+// log is decompressed.  StartOffset is an offset in the decompressed log: if
+// the log is not compressed and r is an io.Seeker, r is seeked to it, else
+// StartOffset bytes are read and discarded.  Follow only works if r is the
+// *os.File of an uncompressed log.  The decompressor is released when Start
+// returns, e.g. after Stop.
+func NewSlowLogParserFromReader(r io.Reader, stopChan <-chan bool, opt Options) (*SlowLogParser, error) {
+	dr, compressed, err := Decompress(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if opt.StartOffset > 0 {
+		if s, ok := r.(io.Seeker); ok && !compressed {
+			if _, err := s.Seek(int64(opt.StartOffset), os.SEEK_SET); err != nil {
+				return nil, err
+			}
+			dr = ioutil.NopCloser(r)
+		} else if _, err := io.CopyN(ioutil.Discard, dr, int64(opt.StartOffset)); err != nil {
+			dr.Close()
+			return nil, err
+		}
+	}
+
+	file, _ := r.(*os.File)
+	if compressed {
+		file = nil
+	}
+	p := newSlowLogParser(dr, file, stopChan, opt)
+	p.closer = dr
+	return p, nil
+}
+
+func newSlowLogParser(r io.Reader, file *os.File, stopChan <-chan bool, opt Options) *SlowLogParser {
 	if opt.Debug {
 		l.SetFlags(l.Ltime | l.Lmicroseconds)
 		fmt.Println()
-		l.Println("parsing " + file.Name())
+		if file != nil {
+			l.Println("parsing " + file.Name())
+		} else {
+			l.Println("parsing reader")
+		}
 	}
 
 	p := &SlowLogParser{
+		reader:      r,
 		stopChan:    stopChan,
 		opt:         opt,
 		file:        file,
@@ -66,14 +131,36 @@ func NewSlowLogParser(file *os.File, stopChan <-chan bool, opt Options) *SlowLog
 		bytesRead:   opt.StartOffset,
 		lineOffset:  0,
 		event:       log.NewEvent(),
+		firstEvent:  true,
+		stop:        make(chan struct{}),
+		offset:      opt.StartOffset,
 	}
 	return p
 }
 
+// Run parses the log like Start but without a context.  Events are sent on
+// EventChan.
 func (p *SlowLogParser) Run() {
+	p.Start(context.Background())
+}
+
+// Start parses the log, sending events on EventChan, until EOF, ctx is done,
+// Stop is called, or the stop channel given to NewSlowLogParser receives.
+// If Options.Follow is true and the log is a file, it does not stop at EOF but
+// waits for more events, like tail -F.
+func (p *SlowLogParser) Start(ctx context.Context) error {
 	defer close(p.EventChan)
 
-	r := bufio.NewReader(p.file)
+	p.done = ctx.Done()
+	r := bufio.NewReader(p.reader)
+	defer func() {
+		if p.reopened {
+			p.file.Close()
+		}
+		if p.closer != nil {
+			p.closer.Close()
+		}
+	}()
 
 SCANNER_LOOP:
 	for !p.stopped {
@@ -81,37 +168,58 @@ SCANNER_LOOP:
 		case <-p.stopChan:
 			p.stopped = true
 			break SCANNER_LOOP
+		case <-p.stop:
+			p.stopped = true
+			break SCANNER_LOOP
+		case <-p.done:
+			p.stopped = true
+			break SCANNER_LOOP
 		default:
 		}
 
 		line, err := r.ReadString('\n')
 		if err != nil {
-			// todo: log or return error
+			if err != io.EOF {
+				p.err = err
+				break SCANNER_LOOP
+			}
+			if p.opt.Follow && p.file != nil {
+				// Keep the incomplete line until the rest of it is written.
+				p.partial += line
+				if p.follow() {
+					r = bufio.NewReader(p.reader)
+				}
+				continue
+			}
+			if line == "" {
+				break SCANNER_LOOP
+			}
+			// Last line without a newline; parse it, then the loop
+			// stops on the next ReadString.
+		}
+		if p.partial != "" {
+			line = p.partial + line
+			p.partial = ""
+		}
+
+		// Stop at the first event that begins at or after EndOffset.
+		if p.opt.EndOffset > 0 && p.bytesRead >= p.opt.EndOffset && !p.inHeader && headerRe.MatchString(line) {
+			if p.opt.Debug {
+				l.Printf("+%d end offset", p.bytesRead)
+			}
 			break SCANNER_LOOP
 		}
 
 		lineLen := uint64(len(line))
 		p.bytesRead += lineLen
 		p.lineOffset = p.bytesRead - lineLen
-		if p.lineOffset != 0 {
-			// @todo Need to get clear on why this is needed;
-			// it does make the value correct; an off-by-one issue
-			p.lineOffset += 1
-		}
 
 		if p.opt.Debug {
 			fmt.Println()
 			l.Printf("+%d line: %s", p.lineOffset, line)
 		}
 
-		// Filter out meta lines:
-		//   /usr/local/bin/mysqld, Version: 5.6.15-62.0-tokudb-7.1.0-tokudb-log (binary). started with:
-		//   Tcp port: 3306  Unix socket: /var/lib/mysql/mysql.sock
-		//   Time                 Id Command    Argument
-		if lineLen >= 20 && ((line[0] == FORWARD_SLASH && line[lineLen-6:lineLen] == "with:\n") ||
-			(line[0:5] == "Time ") ||
-			(line[0:4] == "Tcp ") ||
-			(line[0:4] == "TCP ")) {
+		if isMetaLine(line) {
 			if p.opt.Debug {
 				l.Println("meta")
 			}
@@ -119,7 +227,7 @@ SCANNER_LOOP:
 		}
 
 		// Remove \n.
-		line = line[0 : lineLen-1]
+		line = strings.TrimSuffix(line, "\n")
 
 		if p.inHeader {
 			p.parseHeader(line)
@@ -139,6 +247,137 @@ SCANNER_LOOP:
 	if p.opt.Debug {
 		l.Printf("\ndone")
 	}
+
+	return p.err
+}
+
+// Events returns EventChan.
+func (p *SlowLogParser) Events() <-chan *log.Event {
+	return p.EventChan
+}
+
+// Err returns the error that stopped Start, if any.
+func (p *SlowLogParser) Err() error {
+	return p.err
+}
+
+// Offset returns the offset of the end of the last event sent (or skipped).
+// Parsing again with this StartOffset does not send any event twice or skip
+// one.  The last event is sent only when the next one begins or at EOF, so
+// when following a log the last event is not included until then.
+func (p *SlowLogParser) Offset() uint64 {
+	return atomic.LoadUint64(&p.offset)
+}
+
+// Stop stops Start.  It is safe to call more than once.
+func (p *SlowLogParser) Stop() {
+	p.stopOnce.Do(func() { close(p.stop) })
+}
+
+// follow waits for mysqld to write more to the log.  If the log was rotated
+// (the file name is a new file, e.g. after mv and FLUSH SLOW LOGS), it first
+// returns so the rest of the old file is read, then opens the new file on the
+// next call.  If the log was truncated, it reads the file from the start.
+// It returns true if p.file was opened or rewound, so the caller must make a
+// new reader of p.reader.
+func (p *SlowLogParser) follow() bool {
+	if !p.rotated {
+		interval := p.opt.FollowInterval
+		if interval == 0 {
+			interval = DEFAULT_FOLLOW_INTERVAL
+		}
+		select {
+		case <-time.After(interval):
+		case <-p.stopChan:
+			p.stopped = true
+			return false
+		case <-p.stop:
+			p.stopped = true
+			return false
+		case <-p.done:
+			p.stopped = true
+			return false
+		}
+
+		cur, err := p.file.Stat()
+		if err != nil {
+			return false
+		}
+		latest, err := os.Stat(p.file.Name())
+		if err == nil && !os.SameFile(cur, latest) {
+			if p.opt.Debug {
+				l.Println("rotated")
+			}
+			p.rotated = true
+			return false
+		}
+		if cur.Size() >= int64(p.bytesRead)+int64(len(p.partial)) {
+			return false // no new data, or new data to read
+		}
+
+		if p.opt.Debug {
+			l.Println("truncated")
+		}
+		if !p.flushEvent() {
+			return false
+		}
+		if _, err := p.file.Seek(0, os.SEEK_SET); err != nil {
+			p.err = err
+			p.stopped = true
+			return false
+		}
+	} else {
+		p.rotated = false
+		file, err := os.Open(p.file.Name())
+		if err != nil {
+			// Gone again; keep reading the old file.
+			return false
+		}
+		if !p.flushEvent() {
+			file.Close()
+			return false
+		}
+		if p.opt.Debug {
+			l.Println("reopened " + file.Name())
+		}
+		if p.reopened {
+			p.file.Close()
+		}
+		p.file = file
+		p.reopened = true
+	}
+
+	p.reader = p.file
+	p.partial = ""
+	p.bytesRead = 0
+	atomic.StoreUint64(&p.offset, 0)
+	return true
+}
+
+// flushEvent sends the last event of a log that was rotated or truncated
+// because it cannot be continued.  It returns false if the parser was stopped
+// while sending it.
+func (p *SlowLogParser) flushEvent() bool {
+	if p.queryLines > 0 {
+		p.sendEvent(false, false)
+	} else {
+		p.resetEvent(false, false)
+	}
+	return !p.stopped
+}
+
+// isMetaLine returns true for the lines that mysqld writes at the start of
+// the slow and general logs:
+//
+//	/usr/local/bin/mysqld, Version: 5.6.15-62.0-tokudb-7.1.0-tokudb-log (binary). started with:
+//	Tcp port: 3306  Unix socket: /var/lib/mysql/mysql.sock
+//	Time                 Id Command    Argument
+func isMetaLine(line string) bool {
+	lineLen := len(line)
+	return lineLen >= 20 && ((line[0] == FORWARD_SLASH && line[lineLen-6:lineLen] == "with:\n") ||
+		(line[0:5] == "Time ") ||
+		(line[0:4] == "Tcp ") ||
+		(line[0:4] == "TCP "))
 }
 
 func ConvertSlowLogTs(ts string) *time.Time {
@@ -171,6 +410,10 @@ func (p *SlowLogParser) parseHeader(line string) {
 			l.Println("time")
 		}
 		m := timeRe.FindStringSubmatch(line)
+		if m == nil {
+			p.parseError(p.lineOffset, line, "invalid Time")
+			return
+		}
 		p.event.Ts = m[1]
 		if userRe.MatchString(line) {
 			if p.opt.Debug {
@@ -185,6 +428,10 @@ func (p *SlowLogParser) parseHeader(line string) {
 			l.Println("user")
 		}
 		m := userRe.FindStringSubmatch(line)
+		if m == nil {
+			p.parseError(p.lineOffset, line, "invalid User@Host")
+			return
+		}
 		p.event.User = m[1]
 		p.event.Host = m[2]
 	} else if strings.HasPrefix(line, "# admin") {
@@ -253,7 +500,9 @@ func (p *SlowLogParser) parseQuery(line string) {
 		if p.opt.Debug {
 			l.Println("set var")
 		}
-		// @todo ignore or use these lines?
+		if m := timestampRe.FindStringSubmatch(line); m != nil {
+			p.event.Timestamp, _ = strconv.ParseInt(m[1], 10, 64)
+		}
 	} else {
 		if p.opt.Debug {
 			l.Println("query")
@@ -273,6 +522,14 @@ func (p *SlowLogParser) parseAdmin(line string) {
 	}
 	p.event.Admin = true
 	m := adminRe.FindStringSubmatch(line)
+	if m == nil {
+		p.parseError(p.lineOffset, line, "invalid administrator command")
+		p.resetEvent(false, false)
+		if !p.stopped {
+			atomic.StoreUint64(&p.offset, p.bytesRead)
+		}
+		return
+	}
 	p.event.Query = m[1]
 	p.event.Query = strings.TrimSuffix(p.event.Query, ";") // makes FilterAdminCommand work
 
@@ -283,8 +540,8 @@ func (p *SlowLogParser) parseAdmin(line string) {
 		}
 		p.sendEvent(false, false)
 	} else {
-		p.inHeader = false
-		p.inQuery = false
+		p.resetEvent(false, false)
+		atomic.StoreUint64(&p.offset, p.bytesRead)
 	}
 }
 
@@ -294,30 +551,94 @@ func (p *SlowLogParser) sendEvent(inHeader bool, inQuery bool) {
 	}
 
 	// Make a new event and reset our metadata.
-	defer func() {
-		p.event = log.NewEvent()
-		p.headerLines = 0
-		p.queryLines = 0
-		p.inHeader = inHeader
-		p.inQuery = inQuery
-	}()
+	defer p.resetEvent(inHeader, inQuery)
+
+	// The event ends where the next one begins, else at the last line read.
+	end := p.bytesRead
+	if inHeader {
+		end = p.lineOffset
+	}
+
+	if p.badEvent {
+		if p.opt.Debug {
+			l.Println("skip bad event")
+		}
+		atomic.StoreUint64(&p.offset, end)
+		return
+	}
 
 	if _, ok := p.event.TimeMetrics["Query_time"]; !ok {
-		if p.headerLines == 0 {
-			l.Panicf("No Query_time in event at %d: %#v", p.lineOffset, p.event)
+		if !p.firstEvent || p.opt.StartOffset == 0 {
+			p.parseError(p.event.Offset, p.event.Query, "no Query_time")
+		}
+		// Else started parsing in the middle of the log, in a header after
+		// Query_time.  Throw away event.
+		if !p.stopped {
+			atomic.StoreUint64(&p.offset, end)
 		}
-		// Started parsing in header after Query_time.  Throw away event.
 		return
 	}
 
 	// Clean up the event.
 	p.event.Db = strings.TrimSuffix(p.event.Db, ";\n")
 	p.event.Query = strings.TrimSuffix(p.event.Query, ";")
+	p.event.EndOffset = end
 
 	// Send the event.  This will block.
 	select {
 	case p.EventChan <- p.event:
+		atomic.StoreUint64(&p.offset, end)
 	case <-p.stopChan:
 		p.stopped = true
+	case <-p.stop:
+		p.stopped = true
+	case <-p.done:
+		p.stopped = true
+	}
+}
+
+// resetEvent makes a new event and resets our metadata.
+func (p *SlowLogParser) resetEvent(inHeader bool, inQuery bool) {
+	p.event = log.NewEvent()
+	p.headerLines = 0
+	p.queryLines = 0
+	p.inHeader = inHeader
+	p.inQuery = inQuery
+	p.firstEvent = false
+	p.badEvent = false
+}
+
+// parseError handles a malformed line in the current event according to
+// the ErrorPolicy.
+func (p *SlowLogParser) parseError(offset uint64, line string, reason string) {
+	err := ParseError{
+		Offset: offset,
+		Line:   line,
+		Reason: reason,
+	}
+	if p.opt.Debug {
+		l.Println(err)
+	}
+
+	if p.opt.ErrorChan != nil {
+		select {
+		case p.opt.ErrorChan <- err:
+		case <-p.stopChan:
+			p.stopped = true
+		case <-p.stop:
+			p.stopped = true
+		case <-p.done:
+			p.stopped = true
+		}
+	}
+
+	switch p.opt.ErrorPolicy {
+	case ERROR_SKIP:
+		p.badEvent = true
+	case ERROR_STOP:
+		p.stopped = true
+	case ERROR_FAIL:
+		p.stopped = true
+		p.err = err
 	}
 }
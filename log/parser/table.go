@@ -0,0 +1,422 @@
+package parser
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"github.com/vadimtk/mysql-log-parser/log"
+	"io"
+	l "log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Field delimiters of mysql.slow_log dumps.
+const (
+	CSV_DELIMITER = ','  // CSV engine slow_log.CSV file
+	TSV_DELIMITER = '\t' // SELECT ... INTO OUTFILE default
+)
+
+const (
+	ENCLOSURE = '"'
+	ESCAPE    = '\\'
+)
+
+// Columns of the mysql.slow_log table.  MySQL 5.1 and 5.5 don't have
+// thread_id.  A dump can also start with a header row of column names, in
+// any order.
+var slowLogTableColumns = []string{
+	"start_time",
+	"user_host",
+	"query_time",
+	"lock_time",
+	"rows_sent",
+	"rows_examined",
+	"db",
+	"last_insert_id",
+	"insert_id",
+	"server_id",
+	"sql_text",
+	"thread_id",
+}
+
+var _ log.MySQLLogParser = (*SlowLogTableParser)(nil)
+
+// A SlowLogTableParser parses rows of the mysql.slow_log table (log_output=TABLE)
+// dumped by the CSV storage engine or SELECT ... INTO OUTFILE.  It sends the
+// same events as SlowLogParser.
+type SlowLogTableParser struct {
+	file      *os.File
+	stopChan  <-chan bool
+	opt       Options
+	delimiter byte
+	// --
+	EventChan chan *log.Event
+	bytesRead uint64
+	columns   []string
+	stopped   bool
+	done      <-chan struct{}
+	stop      chan struct{}
+	stopOnce  sync.Once
+	offset    uint64 // atomic end of the last event sent, for Offset()
+	err       error
+}
+
+func NewSlowLogTableParser(file *os.File, stopChan <-chan bool, opt Options, delimiter byte) *SlowLogTableParser {
+	// Seek to the offset, if any.  The header row, if any, is before it, so
+	// read it first: its columns can be in any order.
+	var columns []string
+	if opt.StartOffset > 0 {
+		r := bufio.NewReader(io.NewSectionReader(file, 0, int64(opt.StartOffset)))
+		if fields, _, _ := readRow(r, delimiter); isHeaderRow(fields) {
+			columns = fields
+		}
+		file.Seek(int64(opt.StartOffset), os.SEEK_SET)
+	}
+
+	if opt.Debug {
+		l.SetFlags(l.Ltime | l.Lmicroseconds)
+		fmt.Println()
+		l.Println("parsing " + file.Name())
+	}
+
+	p := &SlowLogTableParser{
+		stopChan:  stopChan,
+		opt:       opt,
+		file:      file,
+		delimiter: delimiter,
+		EventChan: make(chan *log.Event),
+		columns:   columns,
+		bytesRead: opt.StartOffset,
+		stop:      make(chan struct{}),
+		offset:    opt.StartOffset,
+	}
+	return p
+}
+
+// Run parses the log like Start but without a context.  Events are sent on
+// EventChan.
+func (p *SlowLogTableParser) Run() {
+	p.Start(context.Background())
+}
+
+// Start parses the log, sending events on EventChan, until EOF, ctx is done,
+// Stop is called, or the stop channel given to NewSlowLogTableParser receives.
+func (p *SlowLogTableParser) Start(ctx context.Context) error {
+	defer close(p.EventChan)
+
+	p.done = ctx.Done()
+	r := bufio.NewReader(p.file)
+
+SCANNER_LOOP:
+	for !p.stopped {
+		select {
+		case <-p.stopChan:
+			p.stopped = true
+			break SCANNER_LOOP
+		case <-p.stop:
+			p.stopped = true
+			break SCANNER_LOOP
+		case <-p.done:
+			p.stopped = true
+			break SCANNER_LOOP
+		default:
+		}
+
+		rowOffset := p.bytesRead
+		fields, n, err := readRow(r, p.delimiter)
+		p.bytesRead += n
+		if err != nil && err != io.EOF {
+			p.err = err
+			break SCANNER_LOOP
+		}
+		if len(fields) > 0 {
+			if p.opt.Debug {
+				fmt.Println()
+				l.Printf("+%d row: %q", rowOffset, fields)
+			}
+			p.parseRow(fields, rowOffset)
+		}
+		if !p.stopped {
+			// Row sent or skipped.
+			atomic.StoreUint64(&p.offset, p.bytesRead)
+		}
+		if err == io.EOF {
+			break SCANNER_LOOP
+		}
+	}
+
+	if p.opt.Debug {
+		l.Printf("\ndone")
+	}
+
+	return p.err
+}
+
+// Events returns EventChan.
+func (p *SlowLogTableParser) Events() <-chan *log.Event {
+	return p.EventChan
+}
+
+// Err returns the error that stopped Start, if any.
+func (p *SlowLogTableParser) Err() error {
+	return p.err
+}
+
+// Offset returns the offset of the end of the last event sent (or skipped).
+// Parsing again with this StartOffset does not send any event twice or skip
+// one.
+func (p *SlowLogTableParser) Offset() uint64 {
+	return atomic.LoadUint64(&p.offset)
+}
+
+// Stop stops Start.  It is safe to call more than once.
+func (p *SlowLogTableParser) Stop() {
+	p.stopOnce.Do(func() { close(p.stop) })
+}
+
+func (p *SlowLogTableParser) parseRow(fields []string, offset uint64) {
+	if p.columns == nil {
+		if isHeaderRow(fields) {
+			if p.opt.Debug {
+				l.Println("header")
+			}
+			p.columns = fields
+			return
+		}
+		p.columns = slowLogTableColumns
+		if len(fields) == len(slowLogTableColumns)-1 {
+			p.columns = slowLogTableColumns[0 : len(slowLogTableColumns)-1] // no thread_id
+		}
+	}
+
+	if len(fields) != len(p.columns) {
+		p.parseError(offset, fields, fmt.Sprintf("expected %d columns, got %d", len(p.columns), len(fields)))
+		return
+	}
+
+	event := log.NewEvent()
+	event.Offset = offset
+	event.EndOffset = p.bytesRead
+	for i, col := range p.columns {
+		val := fields[i]
+		var err error
+		switch col {
+		case "start_time":
+			var ts time.Time
+			ts, err = time.Parse("2006-01-02 15:04:05", val)
+			if err == nil {
+				event.Ts = ts.Format("060102 15:04:05")
+			}
+		case "user_host":
+			if m := userRe.FindStringSubmatch("User@Host: " + val); m != nil {
+				event.User = m[1]
+				event.Host = m[2]
+			}
+		case "query_time":
+			var secs float64
+			secs, err = timeToSeconds(val)
+			event.TimeMetrics["Query_time"] = float32(secs)
+		case "lock_time":
+			var secs float64
+			secs, err = timeToSeconds(val)
+			event.TimeMetrics["Lock_time"] = float32(secs)
+		case "rows_sent":
+			event.NumberMetrics["Rows_sent"], err = strconv.ParseUint(val, 10, 64)
+		case "rows_examined":
+			event.NumberMetrics["Rows_examined"], err = strconv.ParseUint(val, 10, 64)
+		case "thread_id":
+			event.NumberMetrics["Thread_id"], err = strconv.ParseUint(val, 10, 64)
+		case "db":
+			event.Db = val
+		case "sql_text":
+			event.Query = strings.TrimSuffix(val, ";")
+		}
+		if err != nil {
+			p.parseError(offset, fields, fmt.Sprintf("invalid %s: %s", col, err))
+			return
+		}
+	}
+
+	// Send the event.  This will block.
+	select {
+	case p.EventChan <- event:
+	case <-p.stopChan:
+		p.stopped = true
+	case <-p.stop:
+		p.stopped = true
+	case <-p.done:
+		p.stopped = true
+	}
+}
+
+// parseError handles a malformed row according to the ErrorPolicy.  The row
+// is skipped in any case.
+func (p *SlowLogTableParser) parseError(offset uint64, fields []string, reason string) {
+	err := ParseError{
+		Offset: offset,
+		Line:   strings.Join(fields, string(p.delimiter)),
+		Reason: reason,
+	}
+	if p.opt.Debug {
+		l.Println(err)
+	}
+
+	if p.opt.ErrorChan != nil {
+		select {
+		case p.opt.ErrorChan <- err:
+		case <-p.stopChan:
+			p.stopped = true
+		case <-p.stop:
+			p.stopped = true
+		case <-p.done:
+			p.stopped = true
+		}
+	}
+
+	switch p.opt.ErrorPolicy {
+	case ERROR_STOP:
+		p.stopped = true
+	case ERROR_FAIL:
+		p.stopped = true
+		p.err = err
+	}
+}
+
+// timeToSeconds converts a MySQL TIME value like 00:00:02.000123 (or
+// 838:59:59) to seconds.
+func timeToSeconds(val string) (float64, error) {
+	neg := strings.HasPrefix(val, "-")
+	hms := strings.Split(strings.TrimPrefix(val, "-"), ":")
+	if len(hms) != 3 {
+		return 0, fmt.Errorf("invalid TIME value: %s", val)
+	}
+	h, err := strconv.ParseUint(hms[0], 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	m, err := strconv.ParseUint(hms[1], 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	s, err := strconv.ParseFloat(hms[2], 64)
+	if err != nil {
+		return 0, err
+	}
+	secs := float64(h*3600+m*60) + s
+	if neg {
+		secs = -secs
+	}
+	return secs, nil
+}
+
+// isHeaderRow returns true if the row is column names, in any order, not
+// values.
+func isHeaderRow(fields []string) bool {
+	if len(fields) == 0 {
+		return false
+	}
+FIELDS:
+	for _, field := range fields {
+		for _, col := range slowLogTableColumns {
+			if field == col {
+				continue FIELDS
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// readRow reads one row of fields separated by delimiter.  Fields may be
+// enclosed by double quotes, and special characters are escaped by a
+// backslash as MySQL writes them (\n, \t, \0, \N for NULL, etc.).  A row ends
+// at a newline that is neither enclosed nor escaped.  It returns the fields,
+// the number of bytes read, and io.EOF after the last row.
+func readRow(r *bufio.Reader, delimiter byte) ([]string, uint64, error) {
+	var fields []string
+	var field []byte
+	var n uint64
+	enclosed := false // in an enclosed field
+	quoted := false   // current field was enclosed
+
+	endField := func() {
+		fields = append(fields, string(field))
+		field = field[:0]
+		quoted = false
+	}
+
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			if len(fields) > 0 || len(field) > 0 || quoted {
+				endField()
+			}
+			return fields, n, err
+		}
+		n++
+
+		switch {
+		case b == ESCAPE:
+			e, err := r.ReadByte()
+			if err != nil {
+				field = append(field, b)
+				continue
+			}
+			n++
+			switch e {
+			case '0':
+				field = append(field, 0)
+			case 'b':
+				field = append(field, '\b')
+			case 'n':
+				field = append(field, '\n')
+			case 'r':
+				field = append(field, '\r')
+			case 't':
+				field = append(field, '\t')
+			case 'Z':
+				field = append(field, 0x1A)
+			case 'N':
+				if enclosed || len(field) > 0 {
+					field = append(field, e)
+				}
+				// else NULL, which is an empty value
+			default:
+				field = append(field, e)
+			}
+		case enclosed:
+			if b == ENCLOSURE {
+				if next, err := r.Peek(1); err == nil && next[0] == ENCLOSURE {
+					r.ReadByte() // "" is an escaped "
+					n++
+					field = append(field, b)
+				} else {
+					enclosed = false
+				}
+			} else {
+				field = append(field, b)
+			}
+		case b == ENCLOSURE && len(field) == 0 && !quoted:
+			enclosed = true
+			quoted = true
+		case b == delimiter:
+			endField()
+		case b == '\n':
+			if len(fields) == 0 && len(field) == 0 && !quoted {
+				return nil, n, nil // blank line
+			}
+			if last := len(field) - 1; last >= 0 && field[last] == '\r' {
+				field = field[:last]
+			}
+			endField()
+			return fields, n, nil
+		default:
+			field = append(field, b)
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package log
+
+import (
+	"encoding/json"
+	"math"
+	"sort"
+)
+
+// Default relative accuracy of a Sketch: quantiles are within 1% of the true value.
+const DEFAULT_RELATIVE_ACCURACY = 0.01
+
+// A Sketch estimates quantiles of non-negative values in bounded memory (it is
+// a DDSketch).  Values are counted in buckets with bounds that grow by a factor
+// of gamma = (1+a)/(1-a), where a is the relative accuracy, so a quantile is
+// within a relative error a of the true value.  The number of buckets grows
+// with the log of the range of the values, not the number of values: at 1%,
+// values from 1us to 1 day need at most 1,260 buckets.
+type Sketch struct {
+	relativeAccuracy float64
+	gamma            float64
+	logGamma         float64
+	bins             map[int]uint64 // bucket index => count
+	zeros            uint64         // values <= 0, which have no bucket
+	cnt              uint64
+	min              float64
+	max              float64
+}
+
+// NewSketch returns a Sketch with the given relative accuracy, which must be
+// between 0 and 1, else DEFAULT_RELATIVE_ACCURACY is used.
+func NewSketch(relativeAccuracy float64) *Sketch {
+	if relativeAccuracy <= 0 || relativeAccuracy >= 1 {
+		relativeAccuracy = DEFAULT_RELATIVE_ACCURACY
+	}
+	gamma := (1 + relativeAccuracy) / (1 - relativeAccuracy)
+	s := &Sketch{
+		relativeAccuracy: relativeAccuracy,
+		gamma:            gamma,
+		logGamma:         math.Log(gamma),
+		bins:             make(map[int]uint64),
+	}
+	return s
+}
+
+// Add adds a value to the sketch.
+func (s *Sketch) Add(v float64) {
+	if s.cnt == 0 || v < s.min {
+		s.min = v
+	}
+	if s.cnt == 0 || v > s.max {
+		s.max = v
+	}
+	s.cnt++
+	if v <= 0 {
+		s.zeros++
+		return
+	}
+	s.bins[s.index(v)]++
+}
+
+// Cnt returns the number of values added.
+func (s *Sketch) Cnt() uint64 {
+	return s.cnt
+}
+
+// Quantile returns an estimate of the q quantile (0 <= q <= 1) of the values:
+// the value at index q*Cnt of the sorted values, like vals[(95*Cnt)/100] for
+// the 95th percentile.  The estimate is never less than the min value or
+// greater than the max value.
+func (s *Sketch) Quantile(q float64) float64 {
+	if s.cnt == 0 {
+		return 0
+	}
+	rank := uint64(q * float64(s.cnt))
+	if rank >= s.cnt {
+		rank = s.cnt - 1
+	}
+
+	if rank < s.zeros {
+		return s.clamp(0)
+	}
+	n := s.zeros
+	for _, i := range s.indexes() {
+		n += s.bins[i]
+		if rank < n {
+			return s.clamp(s.value(i))
+		}
+	}
+	return s.max
+}
+
+// Merge adds the values of o to the sketch, as if they were added with Add.
+// If o has the same relative accuracy, the merged sketch is the same as one
+// with all the values, else the values of o are estimated again.
+func (s *Sketch) Merge(o *Sketch) {
+	if o.cnt == 0 {
+		return
+	}
+	if s.cnt == 0 || o.min < s.min {
+		s.min = o.min
+	}
+	if s.cnt == 0 || o.max > s.max {
+		s.max = o.max
+	}
+	s.cnt += o.cnt
+	s.zeros += o.zeros
+	for i, n := range o.bins {
+		if o.gamma != s.gamma {
+			i = s.index(o.value(i))
+		}
+		s.bins[i] += n
+	}
+}
+
+// sketchJSON is a Sketch in JSON, so it can be merged from saved results.
+type sketchJSON struct {
+	RelativeAccuracy float64
+	Cnt              uint64
+	Min              float64
+	Max              float64
+	Zeros            uint64         `json:",omitempty"`
+	Bins             map[int]uint64 `json:",omitempty"` // bucket index => count
+}
+
+func (s *Sketch) MarshalJSON() ([]byte, error) {
+	return json.Marshal(sketchJSON{
+		RelativeAccuracy: s.relativeAccuracy,
+		Cnt:              s.cnt,
+		Min:              s.min,
+		Max:              s.max,
+		Zeros:            s.zeros,
+		Bins:             s.bins,
+	})
+}
+
+func (s *Sketch) UnmarshalJSON(data []byte) error {
+	var j sketchJSON
+	if err := json.Unmarshal(data, &j); err != nil {
+		return err
+	}
+	*s = *NewSketch(j.RelativeAccuracy)
+	s.cnt = j.Cnt
+	s.min = j.Min
+	s.max = j.Max
+	s.zeros = j.Zeros
+	for i, n := range j.Bins {
+		s.bins[i] = n
+	}
+	return nil
+}
+
+// index returns the index of the bucket of v > 0: (gamma^(i-1), gamma^i].
+func (s *Sketch) index(v float64) int {
+	return int(math.Ceil(math.Log(v) / s.logGamma))
+}
+
+// value returns the value of bucket i that is within the relative accuracy of
+// every value in the bucket.
+func (s *Sketch) value(i int) float64 {
+	return 2 * math.Pow(s.gamma, float64(i)) / (s.gamma + 1)
+}
+
+func (s *Sketch) clamp(v float64) float64 {
+	if v < s.min {
+		return s.min
+	}
+	if v > s.max {
+		return s.max
+	}
+	return v
+}
+
+// indexes returns the bucket indexes in ascending order.
+func (s *Sketch) indexes() []int {
+	indexes := make([]int, 0, len(s.bins))
+	for i := range s.bins {
+		indexes = append(indexes, i)
+	}
+	sort.Ints(indexes)
+	return indexes
+}
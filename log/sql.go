@@ -0,0 +1,212 @@
+package log
+
+import (
+	"strings"
+)
+
+// Kinds of SQL tokens.
+const (
+	sqlWord   = iota // keyword or identifier, e.g. select or t1
+	sqlQuoted        // `quoted identifier`
+	sqlString        // 'string', "string", x'hex', b'bits' or n'national'
+	sqlNumber        // 1, -1.5e3, .5, 0x1f or 0b101
+	sqlPunct         // operator, parenthesis, comma, placeholder, etc.
+)
+
+// A sqlToken is a token of a query.  Comments are not tokens, except the start
+// (/*!, with the version as a number) and end (*/) of version comments because
+// MySQL executes their contents.
+type sqlToken struct {
+	kind  int
+	text  string // as in the query
+	pos   int    // offset in the query
+	space bool   // whitespace or a comment before the token
+}
+
+// tokenizeSQL splits a query into tokens like MySQL does.  Strings can have
+// backslash escapes and doubled quotes, and comments are /* */, # and --, but
+// -- is a comment even if it is not followed by a space, like pt-query-digest.
+// A sign right before a number is part of the number unless it follows an
+// operand, so -1 is a number but the - of a-1 and a -1 is an operator.  A quote
+// that does not start a terminated string is punctuation.
+func tokenizeSQL(q string) []sqlToken {
+	var tokens []sqlToken
+	inVersion := false
+	for i := 0; i < len(q); {
+		start := i
+		for i < len(q) {
+			if isSpace(q[i]) {
+				i++
+			} else if n := commentLen(q, i); n > 0 {
+				i += n
+			} else {
+				break
+			}
+		}
+		if i == len(q) {
+			break
+		}
+		t := sqlToken{pos: i, space: i > start}
+		c := q[i]
+		switch {
+		case c == '/' && strings.HasPrefix(q[i:], "/*!"):
+			t.kind, i = sqlPunct, i+3
+			inVersion = true
+		case inVersion && c == '*' && strings.HasPrefix(q[i:], "*/"):
+			t.kind, i = sqlPunct, i+2
+			inVersion = false
+		case c == '\'' || c == '"':
+			if j, ok := scanString(q, i); ok {
+				t.kind, i = sqlString, j
+			} else {
+				t.kind, i = sqlPunct, i+1
+			}
+		case c == '`':
+			t.kind, i = sqlQuoted, quotedEnd(q, i)
+		case isDigit(c) || (c == '.' && i+1 < len(q) && isDigit(q[i+1]) && !afterOperand(tokens)):
+			t.kind, i = sqlNumber, numberEnd(q, i)
+		case (c == '-' || c == '+') && startsNumber(q, i+1) && !afterOperand(tokens):
+			t.kind, i = sqlNumber, numberEnd(q, i+1)
+		case isWordChar(c):
+			j := i + 1
+			for j < len(q) && isWordChar(q[j]) {
+				j++
+			}
+			if j-i == 1 && j < len(q) && q[j] == '\'' && strings.ContainsRune("xXbBnN", rune(c)) {
+				if end, ok := scanString(q, j); ok {
+					t.kind, i = sqlString, end
+					break
+				}
+			}
+			t.kind, i = sqlWord, j
+		default:
+			t.kind, i = sqlPunct, i+1
+		}
+		t.text = q[t.pos:i]
+		tokens = append(tokens, t)
+	}
+	return tokens
+}
+
+// commentLen returns the length of the comment at q[i], or 0 if there is none.
+// A comment to the end of the line includes the newline.
+func commentLen(q string, i int) int {
+	switch {
+	case q[i] == '#' || strings.HasPrefix(q[i:], "--"):
+		if n := strings.IndexByte(q[i:], '\n'); n >= 0 {
+			return n + 1
+		}
+		return len(q) - i
+	case strings.HasPrefix(q[i:], "/*") && !strings.HasPrefix(q[i:], "/*!"):
+		if n := strings.Index(q[i+2:], "*/"); n >= 0 {
+			return n + 4
+		}
+		return len(q) - i
+	}
+	return 0
+}
+
+// stringEnd returns the offset after the string that starts with the quote at
+// q[i], or the end of the query if the string is not terminated.
+func stringEnd(q string, i int) int {
+	j, _ := scanString(q, i)
+	return j
+}
+
+// scanString is stringEnd, and false if the string is not terminated.
+func scanString(q string, i int) (int, bool) {
+	quote := q[i]
+	for j := i + 1; j < len(q); j++ {
+		switch q[j] {
+		case '\\':
+			j++
+		case quote:
+			if j+1 < len(q) && q[j+1] == quote {
+				j++ // '' is a quote
+			} else {
+				return j + 1, true
+			}
+		}
+	}
+	return len(q), false
+}
+
+// quotedEnd returns the offset after the identifier quoted with the backtick
+// at q[i], where two backticks are one backtick.
+func quotedEnd(q string, i int) int {
+	for j := i + 1; j < len(q); j++ {
+		if q[j] == '`' {
+			if j+1 < len(q) && q[j+1] == '`' {
+				j++
+			} else {
+				return j + 1
+			}
+		}
+	}
+	return len(q)
+}
+
+// numberEnd returns the offset after the number at q[i].  Like
+// pt-query-digest, a number includes the hex digits after it, so 0x1f and
+// 123abc are numbers, but not 123_abc or the oo of 123foo.
+func numberEnd(q string, i int) int {
+	j := i
+	for j < len(q) {
+		c := q[j]
+		if isDigit(c) || c == '.' || c == 'x' || c == 'X' || ('a' <= c && c <= 'f') || ('A' <= c && c <= 'F') {
+			j++
+			if (c == 'e' || c == 'E') && j < len(q) && (q[j] == '-' || q[j] == '+') && j+1 < len(q) && isDigit(q[j+1]) {
+				j++ // exponent sign
+			}
+		} else {
+			break
+		}
+	}
+	return j
+}
+
+func startsNumber(q string, i int) bool {
+	return i < len(q) && (isDigit(q[i]) || (q[i] == '.' && i+1 < len(q) && isDigit(q[i+1])))
+}
+
+// afterOperand returns true if the next token is right after an operand, e.g.
+// the a in a-1, a -1 or t.5, so a sign or a dot is an operator, not part of a
+// number.  Keywords that an expression can follow, e.g. select or and, are
+// not operands, so the -1 in select -1 is a number.
+func afterOperand(tokens []sqlToken) bool {
+	if len(tokens) == 0 {
+		return false
+	}
+	prev := tokens[len(tokens)-1]
+	switch prev.kind {
+	case sqlWord:
+		return !operatorKeywords[strings.ToLower(prev.text)]
+	case sqlPunct:
+		return prev.text == ")" || prev.text == "?"
+	}
+	return true
+}
+
+// Keywords that can be followed by an expression, so they are not operands.
+var operatorKeywords = map[string]bool{
+	"select": true, "where": true, "and": true, "or": true, "not": true, "xor": true,
+	"in": true, "is": true, "like": true, "between": true, "case": true, "when": true,
+	"then": true, "else": true, "set": true, "values": true, "value": true, "limit": true,
+	"offset": true, "by": true, "on": true, "having": true, "div": true, "mod": true,
+	"regexp": true, "rlike": true, "return": true, "interval": true, "distinct": true,
+	"all": true, "any": true, "some": true, "exists": true, "escape": true,
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f' || c == '\v'
+}
+
+func isDigit(c byte) bool {
+	return '0' <= c && c <= '9'
+}
+
+// isWordChar returns true for the characters of unquoted identifiers, which
+// include $ and all non-ASCII characters.
+func isWordChar(c byte) bool {
+	return c == '_' || c == '$' || isDigit(c) || ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') || c >= 0x80
+}
@@ -1,39 +1,80 @@
 package log
 
 import (
+	"encoding/json"
+	"math"
 	"sort"
-	"github.com/vadimtk/gkquantile"
+	"strconv"
 )
 
+// StatsOptions are the options of EventStats.  By default, percentiles are
+// estimated by a Sketch per metric, so memory does not grow with the number
+// of events.
+type StatsOptions struct {
+	RelativeAccuracy float64   // of percentiles, e.g. 0.01 for 1% (default)
+	ExactValues      bool      // keep every value for exact percentiles
+	Percentiles      []float64 // e.g. 50, 99.9 for Percentiles p50, p99.9
+	Histogram        bool      // count values in TimeBuckets and NumberBuckets
+	TimeBuckets      []float64 // default TIME_BUCKETS
+	NumberBuckets    []float64 // default NUMBER_BUCKETS
+}
+
+// Lower bounds of the default histogram buckets: like pt-query-digest, 1us,
+// 10us, ..., 10s+ for time metrics, and 0, 1, 10, ..., 1M+ for number metrics.
+// The first bucket also counts smaller values, and the last one larger values.
+var TIME_BUCKETS = []float64{0.000001, 0.00001, 0.0001, 0.001, 0.01, 0.1, 1, 10}
+var NUMBER_BUCKETS = []float64{0, 1, 10, 100, 1000, 10000, 100000, 1000000}
+
+// A Bucket of a histogram counts the values from Min to the Min of the next
+// bucket.
+type Bucket struct {
+	Min float64
+	Cnt uint64
+}
+
 type EventStats struct {
 	TimeMetrics   map[string]*TimeStats   `json:",omitempty"`
 	NumberMetrics map[string]*NumberStats `json:",omitempty"`
 	BoolMetrics   map[string]*BoolStats   `json:",omitempty"`
+	opt           StatsOptions
 }
 
 type TimeStats struct {
-	vals   []float64 `json:"-"`
-	Cnt    uint
-	Sum    float64
-	Min    float64
-	Avg    float64
-	Pct95  float64
-	Stddev uint64
-	Med    float64
-	Max    float64
-	GKq    *gkquantile.GKSummary
+	vals    []float64 `json:"-"`
+	mean    float64   `json:"-"` // running mean and sum of squared
+	m2      float64   `json:"-"` // differences from it (Welford)
+	Cnt     uint
+	Sum     float64
+	Min     float64
+	Avg     float64
+	Pct95   float64
+	Stddev  float64
+	VarMean float64 // variance-to-mean ratio
+	Med     float64
+	Max     float64
+	// StatsOptions.Percentiles, e.g. p99.9, and Histogram if enabled
+	Percentiles map[string]float64 `json:",omitempty"`
+	Histogram   []Bucket           `json:",omitempty"`
+	sketch      *Sketch            `json:"-"` // unless ExactValues
 }
 
 type NumberStats struct {
-	vals   []uint64 `json:"-"`
-	Cnt    uint
-	Sum    uint64
-	Min    uint64
-	Avg    uint64
-	Pct95  uint64
-	Stddev uint64
-	Med    uint64
-	Max    uint64
+	vals    []uint64 `json:"-"`
+	mean    float64  `json:"-"`
+	m2      float64  `json:"-"`
+	Cnt     uint
+	Sum     uint64
+	Min     uint64
+	Avg     uint64
+	Pct95   uint64
+	Stddev  float64
+	VarMean float64 // variance-to-mean ratio
+	Med     uint64
+	Max     uint64
+	// StatsOptions.Percentiles, e.g. p99.9, and Histogram if enabled
+	Percentiles map[string]uint64 `json:",omitempty"`
+	Histogram   []Bucket          `json:",omitempty"`
+	sketch      *Sketch           `json:"-"` // unless ExactValues
 }
 
 type BoolStats struct {
@@ -42,17 +83,135 @@ type BoolStats struct {
 }
 
 func NewEventStats() *EventStats {
+	return NewEventStatsWithOptions(StatsOptions{})
+}
+
+func NewEventStatsWithOptions(opt StatsOptions) *EventStats {
+	if opt.Histogram {
+		if opt.TimeBuckets == nil {
+			opt.TimeBuckets = TIME_BUCKETS
+		}
+		if opt.NumberBuckets == nil {
+			opt.NumberBuckets = NUMBER_BUCKETS
+		}
+	}
 	s := &EventStats{
 		TimeMetrics:   make(map[string]*TimeStats),
 		NumberMetrics: make(map[string]*NumberStats),
 		BoolMetrics:   make(map[string]*BoolStats),
+		opt:           opt,
 	}
 	return s
 }
 
+// GetVals returns the values, sorted after Current, if ExactValues, else nil.
 func (s *TimeStats) GetVals() []float64 {
 	return s.vals
+}
+
+// GetVals returns the values, sorted after Current, if ExactValues, else nil.
+func (s *NumberStats) GetVals() []uint64 {
+	return s.vals
+}
+
+// Quantile returns the q quantile (0 <= q <= 1) of the values, e.g. 0.95
+// for Pct95: exact if ExactValues, else estimated.  Call Current first.
+func (s *TimeStats) Quantile(q float64) float64 {
+	if s.sketch != nil {
+		return s.sketch.Quantile(q)
+	}
+	if len(s.vals) == 0 {
+		return 0
+	}
+	return s.vals[quantileIndex(q, len(s.vals))]
+}
+
+// Quantile returns the q quantile (0 <= q <= 1) of the values, e.g. 0.95
+// for Pct95: exact if ExactValues, else estimated.  Call Current first.
+func (s *NumberStats) Quantile(q float64) uint64 {
+	if s.sketch != nil {
+		// Values are integers, so round the estimate.
+		return uint64(math.Floor(s.sketch.Quantile(q) + 0.5))
+	}
+	if len(s.vals) == 0 {
+		return 0
+	}
+	return s.vals[quantileIndex(q, len(s.vals))]
+}
+
+// PercentileName returns the name of the percentile p in Percentiles, e.g.
+// p99.9 for 99.9.
+func PercentileName(p float64) string {
+	return "p" + strconv.FormatFloat(p, 'f', -1, 64)
+}
+
+// newHistogram returns empty buckets with the lower bounds, or nil if none.
+func newHistogram(bounds []float64) []Bucket {
+	if len(bounds) == 0 {
+		return nil
+	}
+	h := make([]Bucket, len(bounds))
+	for i, min := range bounds {
+		h[i].Min = min
+	}
+	return h
+}
+
+// addToHistogram counts n values v in the last bucket with Min <= v, or the
+// first bucket.
+func addToHistogram(h []Bucket, v float64, n uint64) {
+	if len(h) == 0 {
+		return
+	}
+	i := sort.Search(len(h), func(i int) bool { return h[i].Min > v }) - 1
+	if i < 0 {
+		i = 0
+	}
+	h[i].Cnt += n
+}
+
+// mergeHistogram adds the counts of o to h, or returns a copy of o if h has
+// no buckets.
+func mergeHistogram(h []Bucket, o []Bucket) []Bucket {
+	if len(h) == 0 {
+		return append([]Bucket(nil), o...)
+	}
+	for _, b := range o {
+		addToHistogram(h, b.Min, b.Cnt)
+	}
+	return h
+}
+
+func quantileIndex(q float64, n int) int {
+	i := int(q * float64(n))
+	if i >= n {
+		i = n - 1
+	}
+	return i
+}
 
+func (s *EventStats) newTimeStats() *TimeStats {
+	stats := &TimeStats{
+		Histogram: newHistogram(s.opt.TimeBuckets),
+	}
+	if s.opt.ExactValues {
+		stats.vals = []float64{}
+	} else {
+		stats.sketch = NewSketch(s.opt.RelativeAccuracy)
+	}
+	return stats
+}
+
+func (s *EventStats) newNumberStats() *NumberStats {
+	stats := &NumberStats{
+		Histogram: newHistogram(s.opt.NumberBuckets),
+	}
+	if s.opt.ExactValues {
+		stats.vals = []uint64{}
+	} else {
+		stats.sketch = NewSketch(s.opt.RelativeAccuracy)
+	}
+	return stats
 }
 
 func (s *EventStats) Add(e *Event) {
@@ -60,29 +219,47 @@ func (s *EventStats) Add(e *Event) {
 	for metric, val := range e.TimeMetrics {
 		stats, seenMetric := s.TimeMetrics[metric]
 		if !seenMetric {
-			s.TimeMetrics[metric] = &TimeStats{
-				vals: []float64{},
-				GKq: gkquantile.NewGKSummary(0.01),
-			}
-			stats = s.TimeMetrics[metric]
+			stats = s.newTimeStats()
+			s.TimeMetrics[metric] = stats
+		}
+		if stats.Cnt == 0 || float64(val) < stats.Min {
+			stats.Min = float64(val)
+		}
+		if stats.Cnt == 0 || float64(val) > stats.Max {
+			stats.Max = float64(val)
 		}
 		stats.Cnt++
 		stats.Sum += float64(val)
-		stats.vals = append(stats.vals, float64(val))
-		stats.GKq.Add(float64(val))
+		stats.mean, stats.m2 = welford(stats.Cnt, stats.mean, stats.m2, float64(val))
+		if stats.sketch != nil {
+			stats.sketch.Add(float64(val))
+		} else {
+			stats.vals = append(stats.vals, float64(val))
+		}
+		addToHistogram(stats.Histogram, float64(val), 1)
 	}
 
 	for metric, val := range e.NumberMetrics {
 		stats, seenMetric := s.NumberMetrics[metric]
 		if !seenMetric {
-			s.NumberMetrics[metric] = &NumberStats{
-				vals: []uint64{},
-			}
-			stats = s.NumberMetrics[metric]
+			stats = s.newNumberStats()
+			s.NumberMetrics[metric] = stats
+		}
+		if stats.Cnt == 0 || val < stats.Min {
+			stats.Min = val
+		}
+		if stats.Cnt == 0 || val > stats.Max {
+			stats.Max = val
 		}
 		stats.Cnt++
 		stats.Sum += val
-		stats.vals = append(stats.vals, val)
+		stats.mean, stats.m2 = welford(stats.Cnt, stats.mean, stats.m2, float64(val))
+		if stats.sketch != nil {
+			stats.sketch.Add(float64(val))
+		} else {
+			stats.vals = append(stats.vals, val)
+		}
+		addToHistogram(stats.Histogram, float64(val), 1)
 	}
 
 	for metric, val := range e.BoolMetrics {
@@ -106,6 +283,210 @@ func (s *EventStats) Add(e *Event) {
 	}
 }
 
+// welford adds the nth value x to the running mean and m2, the sum of squared
+// differences from the mean, without the loss of precision of summing squares.
+func welford(n uint, mean float64, m2 float64, x float64) (float64, float64) {
+	delta := x - mean
+	mean += delta / float64(n)
+	m2 += delta * (x - mean)
+	return mean, m2
+}
+
+// stddev returns the population standard deviation and variance-to-mean
+// ratio (index of dispersion) of n values from their running mean and m2.
+func stddev(n uint, mean float64, m2 float64) (float64, float64) {
+	if n == 0 {
+		return 0, 0
+	}
+	variance := m2 / float64(n)
+	varMean := 0.0
+	if mean != 0 {
+		varMean = variance / mean
+	}
+	return math.Sqrt(variance), varMean
+}
+
+// mergeMoments returns the running mean and m2 of two sets of n and on values
+// (Chan et al.), the same as adding the values of one set to the other.
+func mergeMoments(n uint, mean float64, m2 float64, on uint, omean float64, om2 float64) (float64, float64) {
+	total := float64(n + on)
+	delta := omean - mean
+	mean += delta * float64(on) / total
+	m2 += om2 + delta*delta*float64(n)*float64(on)/total
+	return mean, m2
+}
+
+// Merge adds the stats of o, e.g. of another log, as if its events were added
+// with Add.  Both must have the same StatsOptions.  Percentiles are merged
+// from the sketches, or from the values with ExactValues.  Stats unmarshaled
+// from JSON have no values, so only stats without ExactValues can be merged
+// from JSON.  Metrics of o without values are skipped.  Call Current after
+// merging.
+func (s *EventStats) Merge(o *EventStats) {
+	for metric, ostats := range o.TimeMetrics {
+		if ostats.Cnt == 0 {
+			continue
+		}
+		stats, seenMetric := s.TimeMetrics[metric]
+		if !seenMetric {
+			stats = s.newTimeStats()
+			s.TimeMetrics[metric] = stats
+		}
+		stats.merge(ostats)
+	}
+
+	for metric, ostats := range o.NumberMetrics {
+		if ostats.Cnt == 0 {
+			continue
+		}
+		stats, seenMetric := s.NumberMetrics[metric]
+		if !seenMetric {
+			stats = s.newNumberStats()
+			s.NumberMetrics[metric] = stats
+		}
+		stats.merge(ostats)
+	}
+
+	for metric, ostats := range o.BoolMetrics {
+		if ostats.Cnt == 0 {
+			continue
+		}
+		stats, seenMetric := s.BoolMetrics[metric]
+		if !seenMetric {
+			stats = &BoolStats{}
+			s.BoolMetrics[metric] = stats
+		}
+		stats.Cnt += ostats.Cnt
+		stats.True += ostats.True
+	}
+}
+
+func (s *TimeStats) merge(o *TimeStats) {
+	if o.Cnt == 0 {
+		return
+	}
+	if s.Cnt == 0 || o.Min < s.Min {
+		s.Min = o.Min
+	}
+	if s.Cnt == 0 || o.Max > s.Max {
+		s.Max = o.Max
+	}
+	s.mean, s.m2 = mergeMoments(s.Cnt, s.mean, s.m2, o.Cnt, o.mean, o.m2)
+	s.Cnt += o.Cnt
+	s.Sum += o.Sum
+
+	switch {
+	case s.sketch != nil && o.sketch != nil:
+		s.sketch.Merge(o.sketch)
+	case s.sketch != nil:
+		for _, v := range o.vals {
+			s.sketch.Add(v)
+		}
+	case o.sketch != nil:
+		// The values of o are not known, so estimate these values too.
+		s.sketch = NewSketch(o.sketch.relativeAccuracy)
+		for _, v := range s.vals {
+			s.sketch.Add(v)
+		}
+		s.sketch.Merge(o.sketch)
+		s.vals = nil
+	default:
+		s.vals = append(s.vals, o.vals...)
+	}
+	s.Histogram = mergeHistogram(s.Histogram, o.Histogram)
+}
+
+func (s *NumberStats) merge(o *NumberStats) {
+	if o.Cnt == 0 {
+		return
+	}
+	if s.Cnt == 0 || o.Min < s.Min {
+		s.Min = o.Min
+	}
+	if s.Cnt == 0 || o.Max > s.Max {
+		s.Max = o.Max
+	}
+	s.mean, s.m2 = mergeMoments(s.Cnt, s.mean, s.m2, o.Cnt, o.mean, o.m2)
+	s.Cnt += o.Cnt
+	s.Sum += o.Sum
+
+	switch {
+	case s.sketch != nil && o.sketch != nil:
+		s.sketch.Merge(o.sketch)
+	case s.sketch != nil:
+		for _, v := range o.vals {
+			s.sketch.Add(float64(v))
+		}
+	case o.sketch != nil:
+		// The values of o are not known, so estimate these values too.
+		s.sketch = NewSketch(o.sketch.relativeAccuracy)
+		for _, v := range s.vals {
+			s.sketch.Add(float64(v))
+		}
+		s.sketch.Merge(o.sketch)
+		s.vals = nil
+	default:
+		s.vals = append(s.vals, o.vals...)
+	}
+	s.Histogram = mergeHistogram(s.Histogram, o.Histogram)
+}
+
+// timeStats and numberStats are the stats without their JSON methods.
+type timeStats TimeStats
+type numberStats NumberStats
+
+// MarshalJSON marshals the stats with their sketch, if any, so they can be
+// merged from JSON.
+func (s *TimeStats) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		*timeStats
+		Sketch *Sketch `json:",omitempty"`
+	}{(*timeStats)(s), s.sketch})
+}
+
+// UnmarshalJSON unmarshals stats marshaled by MarshalJSON.  The running mean
+// and m2 are restored from Sum and Stddev, so Current must have been called
+// before they were marshaled.
+func (s *TimeStats) UnmarshalJSON(data []byte) error {
+	j := struct {
+		*timeStats
+		Sketch *Sketch
+	}{timeStats: (*timeStats)(s)}
+	if err := json.Unmarshal(data, &j); err != nil {
+		return err
+	}
+	s.sketch = j.Sketch
+	s.mean, s.m2 = restoreMoments(s.Cnt, s.Sum, s.Stddev)
+	return nil
+}
+
+func (s *NumberStats) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		*numberStats
+		Sketch *Sketch `json:",omitempty"`
+	}{(*numberStats)(s), s.sketch})
+}
+
+func (s *NumberStats) UnmarshalJSON(data []byte) error {
+	j := struct {
+		*numberStats
+		Sketch *Sketch
+	}{numberStats: (*numberStats)(s)}
+	if err := json.Unmarshal(data, &j); err != nil {
+		return err
+	}
+	s.sketch = j.Sketch
+	s.mean, s.m2 = restoreMoments(s.Cnt, float64(s.Sum), s.Stddev)
+	return nil
+}
+
+func restoreMoments(n uint, sum float64, stddev float64) (float64, float64) {
+	if n == 0 {
+		return 0, 0
+	}
+	return sum / float64(n), stddev * stddev * float64(n)
+}
+
 type ByUint64 []uint64
 
 func (a ByUint64) Len() int      { return len(a) }
@@ -116,28 +497,39 @@ func (a ByUint64) Less(i, j int) bool {
 
 // Make the stats current because some values (e.g. average) change as events are added.
 // Call this function before accessing the stats, else some stats will be zero or incorrect.
-// @todo median, stddev, 95th percentile
 func (s *EventStats) Current() {
+	opt := s.opt
 	for _, s := range s.TimeMetrics {
+		if s.Cnt == 0 {
+			continue // no values, e.g. unmarshaled from JSON
+		}
 		sort.Float64s(s.vals)
-
-		s.Min = s.vals[0]
 		s.Avg = s.Sum / float64(s.Cnt)
-		s.Pct95 = s.vals[(95*s.Cnt)/100]
-		// s.Stddev = @todo
-		s.Med = s.vals[(50*s.Cnt)/100] // median = 50th percentile
-		s.Max = s.vals[s.Cnt-1]
-		s.GKq.Compress()
+		s.Pct95 = s.Quantile(0.95)
+		s.Stddev, s.VarMean = stddev(s.Cnt, s.mean, s.m2)
+		s.Med = s.Quantile(0.50) // median = 50th percentile
+		if len(opt.Percentiles) > 0 {
+			s.Percentiles = make(map[string]float64, len(opt.Percentiles))
+			for _, p := range opt.Percentiles {
+				s.Percentiles[PercentileName(p)] = s.Quantile(p / 100)
+			}
+		}
 	}
 
 	for _, s := range s.NumberMetrics {
+		if s.Cnt == 0 {
+			continue // no values, e.g. unmarshaled from JSON
+		}
 		sort.Sort(ByUint64(s.vals))
-
-		s.Min = s.vals[0]
 		s.Avg = s.Sum / uint64(s.Cnt)
-		s.Pct95 = s.vals[(95*s.Cnt)/100]
-		// s.Stddev = @todo
-		s.Med = s.vals[(50*s.Cnt)/100] // median = 50th percentile
-		s.Max = s.vals[s.Cnt-1]
+		s.Pct95 = s.Quantile(0.95)
+		s.Stddev, s.VarMean = stddev(s.Cnt, s.mean, s.m2)
+		s.Med = s.Quantile(0.50) // median = 50th percentile
+		if len(opt.Percentiles) > 0 {
+			s.Percentiles = make(map[string]uint64, len(opt.Percentiles))
+			for _, p := range opt.Percentiles {
+				s.Percentiles[PercentileName(p)] = s.Quantile(p / 100)
+			}
+		}
 	}
 }
@@ -0,0 +1,390 @@
+package log
+
+import (
+	"sort"
+	"strings"
+)
+
+// A Statement is the verb of a query and the tables that it reads and writes.
+type Statement struct {
+	Verb    string   // first word of the query in upper case, e.g. SELECT or ALTER
+	Read    []string `json:",omitempty"` // tables read, e.g. db.t
+	Written []string `json:",omitempty"` // tables written: inserted, updated, created, etc.
+}
+
+// Words after FROM, JOIN, etc. that are not table names or aliases.
+var notTables = map[string]bool{
+	"as": true, "cross": true, "delayed": true, "dual": true, "dumpfile": true,
+	"force": true, "from": true, "full": true, "group": true, "having": true,
+	"high_priority": true, "ignore": true, "inner": true, "into": true, "join": true,
+	"key": true, "lateral": true, "left": true, "limit": true, "lock": true,
+	"low_priority": true, "natural": true, "on": true, "order": true, "outer": true,
+	"outfile": true, "partition": true, "procedure": true, "quick": true, "right": true,
+	"select": true, "set": true, "straight_join": true, "union": true, "use": true,
+	"using": true, "value": true, "values": true, "where": true, "window": true,
+	"with": true,
+}
+
+// Modifiers between the verb and the tables.
+var verbModifiers = map[string]bool{
+	"low_priority": true, "delayed": true, "high_priority": true, "ignore": true,
+	"quick": true, "into": true, "temporary": true, "online": true, "offline": true,
+	"no_write_to_binlog": true, "local": true, "table": true,
+}
+
+// ParseStatement returns the verb and tables of the query.  Tables are read
+// after FROM and JOIN, including in subqueries.  Tables are written by INSERT
+// and REPLACE INTO, UPDATE (the tables of the SET columns), DELETE (the tables
+// deleted from), LOAD DATA INTO, and CREATE, ALTER, DROP, TRUNCATE, RENAME,
+// OPTIMIZE and REPAIR TABLE.  Tables are in the order they first appear, once
+// each, without aliases or backticks.
+func ParseStatement(q string) Statement {
+	p := &statementParser{tokens: withoutVersionComments(tokenizeSQL(q))}
+	i := 0
+	for i < len(p.tokens) && isPunct(p.tokens[i], "(") {
+		i++
+	}
+	if i == len(p.tokens) || p.tokens[i].kind != sqlWord {
+		return Statement{}
+	}
+	verb := strings.ToLower(p.tokens[i].text)
+	i++
+
+	// Tables read after FROM and JOIN, by token index, but not in the
+	// parentheses of a function call, e.g. EXTRACT(YEAR FROM d), only of a
+	// subquery, (SELECT ..., or a join, FROM (t1 JOIN t2).
+	reads := make(map[int]tableRef)
+	var tableParens []bool // of the parentheses around tokens[j], innermost last
+	for j := range p.tokens {
+		if isPunct(p.tokens[j], "(") {
+			prev := ""
+			if j > 0 {
+				prev = p.word(j - 1)
+			}
+			join := prev == "from" || prev == "join" || prev == "straight_join"
+			if join {
+				p.tableList(j+1, reads) // FROM (t1 JOIN t2)
+			}
+			tableParens = append(tableParens, join || p.word(j+1) == "select")
+			continue
+		} else if isPunct(p.tokens[j], ")") && len(tableParens) > 0 {
+			tableParens = tableParens[:len(tableParens)-1]
+			continue
+		}
+		if len(tableParens) > 0 && !tableParens[len(tableParens)-1] {
+			continue
+		}
+		switch p.word(j) {
+		case "from", "join", "straight_join":
+			p.tableList(j+1, reads)
+		case "using":
+			if verb == "delete" {
+				p.tableList(j+1, reads)
+			}
+		}
+	}
+
+	var written []string
+	targets := make(map[string]bool) // aliases or names of tables written
+	switch verb {
+	case "insert", "replace":
+		i = p.skipModifiers(i)
+		if ref, _, ok := p.tableRef(i); ok {
+			written = append(written, ref.name)
+		}
+	case "update":
+		i = p.skipModifiers(i)
+		p.tableList(i, reads)
+		set := i
+		for set < len(p.tokens) && p.word(set) != "set" {
+			set++
+		}
+		// SET t.col = ..., t2.col = ..., where t is a table or an alias.
+		for j := set; j+4 < len(p.tokens); {
+			if isName(p.tokens[j+1]) && isPunct(p.tokens[j+2], ".") && isPunct(p.tokens[j+4], "=") {
+				targets[strings.ToLower(unquote(p.tokens[j+1]))] = true
+			}
+			// Next assignment, after the comma not in parentheses.
+			for j++; j < len(p.tokens) && !isPunct(p.tokens[j], ","); j++ {
+				if isPunct(p.tokens[j], "(") {
+					j = closingParen(p.tokens, j)
+				} else if w := p.word(j); w == "where" || w == "order" || w == "limit" {
+					j = len(p.tokens)
+				}
+			}
+		}
+		if len(targets) == 0 {
+			// SET col = ... of the first table
+			for j := i; j < set; j++ {
+				if ref, ok := reads[j]; ok {
+					targets[strings.ToLower(ref.name)] = true
+					break
+				}
+			}
+		}
+	case "delete":
+		i = p.skipModifiers(i)
+		if p.word(i) == "from" {
+			i++
+		}
+		// DELETE t1, t2 FROM ..., DELETE FROM t1, t2 USING ... or
+		// DELETE FROM t
+		for ; i < len(p.tokens); i++ {
+			t := p.tokens[i]
+			if t.kind == sqlWord && notTables[strings.ToLower(t.text)] {
+				break
+			}
+			if t.kind == sqlWord || t.kind == sqlQuoted {
+				name := unquote(t)
+				if i+2 < len(p.tokens) && isPunct(p.tokens[i+1], ".") && p.tokens[i+2].kind != sqlPunct {
+					name += "." + unquote(p.tokens[i+2])
+					i += 2
+				}
+				targets[strings.ToLower(name)] = true
+			} else if !isPunct(t, ",") && !isPunct(t, ".") && !isPunct(t, "*") {
+				break
+			}
+		}
+	case "load":
+		for ; i+1 < len(p.tokens); i++ {
+			if p.word(i) == "into" && p.word(i+1) == "table" {
+				if ref, _, ok := p.tableRef(i + 2); ok {
+					written = append(written, ref.name)
+				}
+				break
+			}
+		}
+	case "create", "alter", "drop", "truncate", "rename", "optimize", "repair", "analyze", "check", "checksum":
+		written = p.ddlTables(verb, i)
+	}
+
+	// Resolve the UPDATE and DELETE targets, which can be aliases.
+	indexes := make([]int, 0, len(reads))
+	for j := range reads {
+		indexes = append(indexes, j)
+	}
+	sort.Ints(indexes)
+	if len(targets) > 0 {
+		for _, j := range indexes {
+			ref := reads[j]
+			if targets[strings.ToLower(ref.alias)] || targets[strings.ToLower(ref.name)] ||
+				(ref.alias == "" && targets[strings.ToLower(lastPart(ref.name))]) {
+				written = append(written, ref.name)
+			}
+		}
+	}
+
+	st := Statement{
+		Verb:    strings.ToUpper(verb),
+		Written: unique(written),
+	}
+	isWritten := make(map[string]bool)
+	for _, name := range st.Written {
+		isWritten[name] = true
+	}
+	var read []string
+	for _, j := range indexes {
+		if name := reads[j].name; !isWritten[name] || verb == "insert" || verb == "replace" || verb == "create" {
+			read = append(read, name)
+		}
+	}
+	if verb == "analyze" || verb == "check" || verb == "checksum" {
+		read, st.Written = st.Written, nil
+	}
+	st.Read = unique(read)
+	return st
+}
+
+// Tables returns the tables of the query, e.g. "db.t", once each: the tables
+// written, then the tables read, in the order they first appear.
+func Tables(query string) []string {
+	st := ParseStatement(query)
+	return unique(append(append([]string{}, st.Written...), st.Read...))
+}
+
+type tableRef struct {
+	name  string // db.t or t
+	alias string
+}
+
+type statementParser struct {
+	tokens []sqlToken
+}
+
+// word returns the lowercase word at tokens[i], else "".
+func (p *statementParser) word(i int) string {
+	if i < len(p.tokens) && p.tokens[i].kind == sqlWord {
+		return strings.ToLower(p.tokens[i].text)
+	}
+	return ""
+}
+
+func (p *statementParser) skipModifiers(i int) int {
+	for verbModifiers[p.word(i)] {
+		i++
+	}
+	return i
+}
+
+// tableRef returns the table, and its alias, at tokens[i], and the index after
+// them.
+func (p *statementParser) tableRef(i int) (tableRef, int, bool) {
+	var ref tableRef
+	if i >= len(p.tokens) || !isName(p.tokens[i]) {
+		return ref, i, false
+	}
+	ref.name = unquote(p.tokens[i])
+	i++
+	if i+1 < len(p.tokens) && isPunct(p.tokens[i], ".") && isName(p.tokens[i+1]) {
+		ref.name += "." + unquote(p.tokens[i+1])
+		i += 2
+	}
+	if p.word(i) == "as" {
+		i++
+	}
+	if i < len(p.tokens) && isName(p.tokens[i]) {
+		ref.alias = unquote(p.tokens[i])
+		i++
+	}
+	return ref, i, true
+}
+
+// tableList adds the comma-separated tables at tokens[i] to refs by index.
+func (p *statementParser) tableList(i int, refs map[int]tableRef) {
+	for {
+		ref, next, ok := p.tableRef(i)
+		if !ok {
+			return
+		}
+		refs[i] = ref
+		i = next
+		// Index hints: USE INDEX (...), FORCE KEY FOR JOIN (...), etc.
+		for w := p.word(i); w == "use" || w == "force" || w == "ignore"; w = p.word(i) {
+			for i < len(p.tokens) && !isPunct(p.tokens[i], "(") {
+				i++
+			}
+			i = closingParen(p.tokens, i) + 1
+		}
+		if i >= len(p.tokens) || !isPunct(p.tokens[i], ",") {
+			return
+		}
+		i++
+	}
+}
+
+// Objects of DDL statements, e.g. CREATE TABLE or DROP PROCEDURE.
+var ddlObjects = map[string]bool{
+	"table": true, "tables": true, "view": true, "index": true, "database": true,
+	"schema": true, "procedure": true, "function": true, "trigger": true, "event": true,
+	"user": true, "server": true, "tablespace": true, "logfile": true,
+}
+
+// ddlTables returns the tables of a DDL or table maintenance statement at
+// tokens[i], after the verb.
+func (p *statementParser) ddlTables(verb string, i int) []string {
+	// Skip OR REPLACE, ALGORITHM = MERGE, DEFINER = user, TEMPORARY, etc.
+	object := i
+	for object < len(p.tokens) && !ddlObjects[p.word(object)] {
+		object++
+	}
+	switch {
+	case object == len(p.tokens):
+		if verb != "truncate" {
+			return nil
+		}
+		i = p.skipModifiers(i) // TRUNCATE t
+	case p.word(object) == "index":
+		// CREATE INDEX i ON t, DROP INDEX i ON t
+		for i = object; i < len(p.tokens) && p.word(i) != "on"; i++ {
+		}
+		if ref, _, ok := p.tableRef(i + 1); ok {
+			return []string{ref.name}
+		}
+		return nil
+	case p.word(object) == "table" || p.word(object) == "tables" || p.word(object) == "view":
+		i = object + 1
+	default:
+		return nil // CREATE DATABASE, DROP PROCEDURE, etc.
+	}
+	if p.word(i) == "if" {
+		// IF [NOT] EXISTS
+		for i < len(p.tokens) && p.word(i) != "exists" {
+			i++
+		}
+		i++
+	}
+
+	var tables []string
+	for {
+		ref, next, ok := p.tableRef(i)
+		if !ok {
+			break
+		}
+		tables = append(tables, ref.name)
+		i = next
+		if verb == "rename" && strings.EqualFold(ref.alias, "to") {
+			// RENAME TABLE a TO b: to is not an alias.
+			if ref, next, ok = p.tableRef(i); ok {
+				tables = append(tables, ref.name)
+				i = next
+			}
+		}
+		if i >= len(p.tokens) || !isPunct(p.tokens[i], ",") {
+			break
+		}
+		i++
+	}
+	return tables
+}
+
+// isName returns true if the token can be a table name or an alias.
+func isName(t sqlToken) bool {
+	return t.kind == sqlQuoted || (t.kind == sqlWord && !notTables[strings.ToLower(t.text)])
+}
+
+// unquote returns the name without backticks.
+func unquote(t sqlToken) string {
+	if t.kind != sqlQuoted {
+		return t.text
+	}
+	name := strings.TrimPrefix(t.text, "`")
+	name = strings.TrimSuffix(name, "`")
+	return strings.Replace(name, "``", "`", -1)
+}
+
+func lastPart(name string) string {
+	return name[strings.LastIndex(name, ".")+1:]
+}
+
+// withoutVersionComments returns the tokens without the start, version and end
+// of /*! version comments, so their contents are like the rest of the query.
+func withoutVersionComments(tokens []sqlToken) []sqlToken {
+	out := make([]sqlToken, 0, len(tokens))
+	for i := 0; i < len(tokens); i++ {
+		t := tokens[i]
+		if isPunct(t, "/*!") {
+			if i+1 < len(tokens) && tokens[i+1].kind == sqlNumber && !tokens[i+1].space {
+				i++
+			}
+			continue
+		}
+		if isPunct(t, "*/") {
+			continue
+		}
+		out = append(out, t)
+	}
+	return out
+}
+
+// unique returns the strings once each, in order, or nil if there are none.
+func unique(list []string) []string {
+	var u []string
+	seen := make(map[string]bool, len(list))
+	for _, s := range list {
+		if !seen[s] {
+			seen[s] = true
+			u = append(u, s)
+		}
+	}
+	return u
+}
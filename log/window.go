@@ -0,0 +1,166 @@
+package log
+
+import (
+	"sort"
+	"strings"
+	"time"
+)
+
+// Layouts of Event.Ts: slow, general and binary logs (the hour can be one
+// digit after two spaces), the slow log in MySQL 5.7 and newer, and others.
+var tsLayouts = []string{"060102 15:04:05", time.RFC3339Nano, "2006-01-02 15:04:05"}
+
+// ParseTs parses an Event.Ts in any of the formats of the logs.  A Ts without
+// a time zone is in loc.
+func ParseTs(ts string, loc *time.Location) (time.Time, error) {
+	ts = strings.Join(strings.Fields(ts), " ")
+	var t time.Time
+	var err error
+	for _, layout := range tsLayouts {
+		if t, err = time.ParseInLocation(layout, ts, loc); err == nil {
+			return t, nil
+		}
+	}
+	return t, err
+}
+
+// A Window is the global class and query classes of the events from Start
+// to End, not including End.
+type Window struct {
+	Start   time.Time
+	End     time.Time
+	Global  *GlobalClass  // set when the window is complete
+	Classes []*QueryClass // sorted like Aggregator.Finalize
+	a       *Aggregator
+}
+
+// A WindowAggregator aggregates events into a GlobalClass and QueryClasses
+// per interval of time, e.g. a minute, like one aggregation per interval.
+// The time of an event is its Timestamp, else its Ts, else the time of the
+// previous event because mysqld writes the time only when it changes.
+// Events before the first time are in the window of the first time.
+//
+// Events are expected in time order, more or less.  A window is complete
+// when an event at or after its End plus Delay is added, so AddEvent returns
+// completed windows while the log is read.  An event of a completed window
+// starts the window again, so a window can be returned more than once; merge
+// windows with the same Start with Merge.
+type WindowAggregator struct {
+	Interval time.Duration
+	Delay    time.Duration  // to wait for events out of time order
+	Location *time.Location // of Ts without a time zone, default UTC
+	GroupBy  []string       // AggregatorOptions.GroupBy
+	Filter   *Filter        // AggregatorOptions.Filter
+	opt      StatsOptions
+	examples bool
+	// --
+	windows map[int64]*Window // by Start, Unix nanoseconds
+	last    time.Time         // time of the last event
+	latest  time.Time         // latest time of all events
+	pending []*Event          // before the first time
+}
+
+func NewWindowAggregator(interval time.Duration, opt StatsOptions, examples bool) *WindowAggregator {
+	a := &WindowAggregator{
+		Interval: interval,
+		Location: time.UTC,
+		opt:      opt,
+		examples: examples,
+		windows:  make(map[int64]*Window),
+	}
+	return a
+}
+
+// AddEvent adds the event to its window, and returns the windows that are
+// complete, in time order, with their classes finalized.
+func (a *WindowAggregator) AddEvent(e *Event) []*Window {
+	t, ok := a.eventTime(e)
+	if !ok {
+		a.pending = append(a.pending, e)
+		return nil
+	}
+	for _, p := range a.pending {
+		a.add(t, p)
+	}
+	a.pending = nil
+	a.add(t, e)
+
+	if t.After(a.latest) {
+		a.latest = t
+	}
+	return a.complete(func(w *Window) bool {
+		return !w.End.Add(a.Delay).After(a.latest)
+	})
+}
+
+// Flush returns all windows not returned yet, in time order, with their
+// classes finalized.  Call it after the last event.
+func (a *WindowAggregator) Flush() []*Window {
+	if len(a.pending) > 0 {
+		// No event had a time.
+		for _, p := range a.pending {
+			a.add(time.Time{}, p)
+		}
+		a.pending = nil
+	}
+	return a.complete(func(w *Window) bool { return true })
+}
+
+func (a *WindowAggregator) eventTime(e *Event) (time.Time, bool) {
+	if e.Timestamp > 0 {
+		a.last = time.Unix(e.Timestamp, 0).In(a.Location)
+	} else if e.Ts != "" {
+		if t, err := ParseTs(e.Ts, a.Location); err == nil {
+			a.last = t
+		}
+	}
+	return a.last, !a.last.IsZero()
+}
+
+func (a *WindowAggregator) add(t time.Time, e *Event) {
+	if a.Filter != nil && !a.Filter.Match(e) {
+		return // but its time is the time of the next events
+	}
+	start := t.Truncate(a.Interval)
+	w, haveWindow := a.windows[start.UnixNano()]
+	if !haveWindow {
+		w = &Window{
+			Start: start,
+			End:   start.Add(a.Interval),
+			a: NewAggregator(AggregatorOptions{
+				Examples: a.examples,
+				GroupBy:  a.GroupBy,
+				Stats:    a.opt,
+			}),
+		}
+		a.windows[start.UnixNano()] = w
+	}
+	w.a.AddEvent(e)
+}
+
+// complete removes the windows that are done, finalizes them, and returns
+// them in time order.
+func (a *WindowAggregator) complete(done func(*Window) bool) []*Window {
+	var windows []*Window
+	for start, w := range a.windows {
+		if done(w) {
+			windows = append(windows, w)
+			delete(a.windows, start)
+		}
+	}
+	sort.Sort(byStart(windows))
+
+	for _, w := range windows {
+		res := w.a.Finalize()
+		w.Global = res.Global
+		w.Classes = res.Classes
+		w.a = nil
+	}
+	return windows
+}
+
+type byStart []*Window
+
+func (a byStart) Len() int           { return len(a) }
+func (a byStart) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byStart) Less(i, j int) bool { return a[i].Start.Before(a[j].Start) }
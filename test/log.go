@@ -31,6 +31,51 @@ func ParseSlowLog(filename string, o parser.Options) *[]log.Event {
 	return &got
 }
 
+func ParseGeneralLog(filename string, o parser.Options) *[]log.Event {
+	file, err := os.Open(Sample + filename)
+	if err != nil {
+		l.Fatal(err)
+	}
+	stopChan := make(<-chan bool, 1)
+	p := parser.NewGeneralLogParser(file, stopChan, o)
+	var got []log.Event
+	go p.Run()
+	for e := range p.EventChan {
+		got = append(got, *e)
+	}
+	return &got
+}
+
+func ParseBinlog(filename string, o parser.Options) *[]log.Event {
+	file, err := os.Open(Sample + filename)
+	if err != nil {
+		l.Fatal(err)
+	}
+	stopChan := make(<-chan bool, 1)
+	p := parser.NewBinlogParser(file, stopChan, o)
+	var got []log.Event
+	go p.Run()
+	for e := range p.EventChan {
+		got = append(got, *e)
+	}
+	return &got
+}
+
+func ParseSlowLogTable(filename string, o parser.Options, delimiter byte) *[]log.Event {
+	file, err := os.Open(Sample + filename)
+	if err != nil {
+		l.Fatal(err)
+	}
+	stopChan := make(<-chan bool, 1)
+	p := parser.NewSlowLogTableParser(file, stopChan, o, delimiter)
+	var got []log.Event
+	go p.Run()
+	for e := range p.EventChan {
+		got = append(got, *e)
+	}
+	return &got
+}
+
 /////////////////////////////////////////////////////////////////////////////
 // EventsEqual gocheck.Checker
 /////////////////////////////////////////////////////////////////////////////